@@ -10,12 +10,21 @@ const (
 	// Manager state
 	StateDir      = "/etc/hy2mgr"
 	StatePath     = "/etc/hy2mgr/state.json"
+	StateDBPath   = "/etc/hy2mgr/state.db"
+	StateKeyPath  = "/etc/hy2mgr/state.key"
 	StateBackups  = "/etc/hy2mgr/backups"
 
+	// Full backups (hy2mgr backup create)
+	BackupDir = "/var/backups/hy2mgr"
+
 	// Manager audit log
 	AuditDir  = "/var/log/hy2mgr"
 	AuditPath = "/var/log/hy2mgr/audit.log"
 
+	// Subscription fetch log (bounded)
+	SubAccessPath = "/var/log/hy2mgr/subscription-access.log"
+
 	// Manager systemd
-	ManagerService = "hy2mgr.service"
+	ManagerService  = "hy2mgr.service"
+	FirewallService = "hy2mgr-firewall.service" // re-applies recorded firewall rules at boot
 )
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -94,6 +95,28 @@ func CopyFile(src, dst string, perm os.FileMode) error {
 	return out.Close()
 }
 
+// PruneFiles deletes all but the keep newest files matching pattern, by
+// modification time.
+func PruneFiles(pattern string, keep int) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil || len(matches) <= keep {
+		return err
+	}
+	mtime := map[string]time.Time{}
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err == nil {
+			mtime[m] = fi.ModTime()
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return mtime[matches[i]].After(mtime[matches[j]]) })
+	for _, m := range matches[keep:] {
+		if err := os.Remove(m); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func Mask(s string) string {
 	if s == "" {
 		return ""
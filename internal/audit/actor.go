@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// Actor is who caused an action and through which entry point.
+type Actor struct {
+	User   string
+	Source string // "web", "cli" or "system"
+	IP     string
+	UID    string
+	Detail string // why, for actions the actor takes on its own
+}
+
+// System is the actor for changes hy2mgr makes on its own, such as
+// automatic revocation.
+var System = Actor{User: "system", Source: "system"}
+
+// CLI is the user running the current command: the one who invoked sudo
+// when there is one, since everything runs as root.
+func CLI() Actor {
+	a := Actor{Source: "cli", User: os.Getenv("SUDO_USER"), UID: os.Getenv("SUDO_UID")}
+	if a.User == "" || a.UID == "" {
+		a.UID = strconv.Itoa(os.Getuid())
+		a.User = a.UID
+		if u, err := user.Current(); err == nil {
+			a.User = u.Username
+		}
+	}
+	return a
+}
+
+// Entry is the record of action on object by a, with its outcome.
+func (a Actor) Entry(action, object string, err error) Entry {
+	e := Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: a.IP, User: a.User, Source: a.Source, UID: a.UID,
+		Action: action, Object: object, Detail: a.Detail, Result: "ok"}
+	if err != nil {
+		e.Result, e.Error = "error", err.Error()
+	}
+	return e
+}
@@ -1,33 +1,142 @@
 package audit
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
 )
 
+// Path is the audit log location; overridable for tests.
+var Path = app.AuditPath
+
+var (
+	mu    sync.Mutex
+	hooks []func(Entry)
+)
+
+// Entry is one audit record. Hash covers every other field, including
+// Prev, the hash of the entry written before it, so editing or deleting
+// an entry breaks the chain (see Verify).
 type Entry struct {
-	Time   string `json:"time"`
-	IP     string `json:"ip"`
-	User   string `json:"user"`
-	Action string `json:"action"`
-	Object string `json:"object,omitempty"`
-	Detail string `json:"detail,omitempty"`
+	Time    string   `json:"time"`
+	IP      string   `json:"ip"`
+	User    string   `json:"user"`
+	Action  string   `json:"action"`
+	Object  string   `json:"object,omitempty"`
+	Detail  string   `json:"detail,omitempty"`
+	Source  string   `json:"source,omitempty"` // web, cli or system
+	UID     string   `json:"uid,omitempty"`    // cli: uid of the invoking user
+	Changes []Change `json:"changes,omitempty"`
+	Result  string   `json:"result,omitempty"` // ok or error; empty for plain events such as login
+	Error   string   `json:"error,omitempty"`
+	Prev    string   `json:"prev,omitempty"`
+	Hash    string   `json:"hash,omitempty"`
 }
 
-func Write(e Entry) {
-	_ = app.EnsureDir(app.AuditDir, 0750)
-	_ = os.Chmod(app.AuditDir, 0750)
-	// file 0640 root:adm best-effort
+// Change is one changed state field. Old and New are JSON values, empty
+// when the field did not exist; secrets read "***".
+type Change struct {
+	Path string `json:"path"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// Sum is the hash e should carry.
+func (e Entry) Sum() string {
+	e.Hash = ""
 	b, _ := json.Marshal(e)
-	path := app.AuditPath
-	_ = os.MkdirAll(filepath.Dir(path), 0750)
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// OnWrite registers fn to be called after every Write.
+func OnWrite(fn func(Entry)) {
+	mu.Lock()
+	hooks = append(hooks, fn)
+	mu.Unlock()
+}
+
+// Write appends e to the chain, rotating the file first when it is due.
+// Failures are reported on stderr as well as returned, since most callers
+// cannot do anything better with them.
+func Write(e Entry) error {
+	mu.Lock()
+	err := write(&e)
+	hs := hooks
+	mu.Unlock()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "audit:", err)
+	}
+	for _, fn := range hs {
+		fn(e)
+	}
+	return err
+}
+
+func write(e *Entry) error {
+	dir := filepath.Dir(Path)
+	if err := app.EnsureDir(dir, 0750); err != nil {
+		return err
+	}
+	_ = os.Chmod(dir, 0750)
+	// The web server and CLI commands both append; the lock keeps the
+	// chain linear across processes.
+	unlock, err := lockFile(Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := rotateIfDue(); err != nil {
+		return fmt.Errorf("rotate: %w", err)
+	}
+	e.Prev, err = lastHash()
 	if err != nil {
-		return
+		return err
+	}
+	e.Hash = e.Sum()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// file 0640 root:adm best-effort
+	f, err := os.OpenFile(Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// lastHash is the hash of the newest entry, in the current file or, right
+// after a rotation, in the newest rotated one.
+func lastHash() (string, error) {
+	files, err := Files()
+	if err != nil {
+		return "", err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		line, err := lastLine(files[i])
+		if err != nil {
+			return "", err
+		}
+		if line == nil {
+			continue
+		}
+		var last Entry
+		if json.Unmarshal(line, &last) != nil {
+			// Keep auditing; Verify reports the broken line.
+			return "", nil
+		}
+		return last.Hash, nil
 	}
-	defer f.Close()
-	_, _ = f.Write(append(b, '\n'))
+	return "", nil
 }
@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useTempLog(t *testing.T) {
+	t.Helper()
+	Path = filepath.Join(t.TempDir(), "audit.log")
+	oldMax, oldKeep := MaxBytes, Keep
+	t.Cleanup(func() { MaxBytes, Keep = oldMax, oldKeep })
+}
+
+func writeEntry(t *testing.T, action, user string) {
+	t.Helper()
+	if err := Write(Entry{Time: time.Now().UTC().Format(time.RFC3339), User: user, Action: action}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainAcrossRotation(t *testing.T) {
+	useTempLog(t)
+	MaxBytes = 300 // a couple of entries per file
+	for i := 0; i < 10; i++ {
+		writeEntry(t, "node.add", "admin")
+	}
+	files, err := Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("expected rotation, got files %v", files)
+	}
+	r, err := Verify()
+	if err != nil || len(r.Problems) > 0 || r.Entries != 10 || r.Anchor != "" {
+		t.Fatalf("verify: %+v, %v", r, err)
+	}
+
+	// Tamper with an entry in a rotated file.
+	b, _ := os.ReadFile(files[0])
+	if err := os.WriteFile(files[0], []byte(strings.Replace(string(b), `"user":"admin"`, `"user":"mallory"`, 1)), 0640); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = Verify()
+	if len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "hash mismatch") {
+		t.Fatalf("tampering not detected: %+v", r.Problems)
+	}
+}
+
+func TestVerifyDetectsDeletion(t *testing.T) {
+	useTempLog(t)
+	legacy := `{"time":"` + time.Now().UTC().Format(time.RFC3339) + `","ip":"","user":"old","action":"login"}` + "\n"
+	if err := os.WriteFile(Path, []byte(legacy), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		writeEntry(t, "node.add", "admin")
+	}
+	r, _ := Verify()
+	if r.Legacy != 1 || len(r.Problems) > 0 {
+		t.Fatalf("legacy prefix: %+v", r)
+	}
+	lines := strings.SplitAfter(string(must(os.ReadFile(Path))), "\n")
+	if err := os.WriteFile(Path, []byte(lines[0]+lines[1]+lines[3]), 0640); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = Verify()
+	if len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "previous hash mismatch") {
+		t.Fatalf("deletion not detected: %+v", r.Problems)
+	}
+}
+
+func TestPruneKeepsNewest(t *testing.T) {
+	useTempLog(t)
+	MaxBytes, Keep = 1, 2 // rotate before every write
+	for i := 0; i < 6; i++ {
+		writeEntry(t, "login", "admin")
+	}
+	files, _ := Files()
+	if len(files) != 3 { // 2 rotated + current
+		t.Fatalf("files = %v", files)
+	}
+	r, _ := Verify()
+	if r.Anchor == "" || len(r.Problems) > 0 || r.Entries != 3 {
+		t.Fatalf("pruned chain: %+v", r)
+	}
+}
+
+func TestRead(t *testing.T) {
+	useTempLog(t)
+	writeEntry(t, "login", "admin")
+	writeEntry(t, "node.add", "admin")
+	writeEntry(t, "node.delete", "ops")
+	writeEntry(t, "nodes.export", "admin")
+	got, total, err := Read(Query{Action: "node", Limit: 1})
+	if err != nil || total != 2 || len(got) != 1 || got[0].Action != "node.delete" {
+		t.Fatalf("Read = %+v, %d, %v", got, total, err)
+	}
+	got, total, _ = Read(Query{User: "admin", Offset: 1})
+	if total != 3 || len(got) != 2 || got[0].Action != "node.add" {
+		t.Fatalf("Read user = %+v, %d", got, total)
+	}
+	got, total, _ = Read(Query{Since: time.Now().Add(time.Hour)})
+	if total != 0 || len(got) != 0 {
+		t.Fatalf("Read since = %+v", got)
+	}
+
+	// Pages deeper than the buffered matches wrap around it.
+	for i := 0; i < 20; i++ {
+		writeEntry(t, fmt.Sprintf("bulk.%02d", i), "bot")
+	}
+	for _, q := range []Query{{User: "bot", Offset: 3, Limit: 4}, {User: "bot", Offset: 17, Limit: 5}, {User: "bot"}} {
+		got, total, _ = Read(q)
+		want := 20 - q.Offset
+		if q.Limit > 0 && want > q.Limit {
+			want = q.Limit
+		}
+		if total != 20 || len(got) != want {
+			t.Fatalf("Read %+v: %d entries of %d", q, len(got), total)
+		}
+		for i, e := range got {
+			if e.Action != fmt.Sprintf("bulk.%02d", 19-q.Offset-i) {
+				t.Fatalf("Read %+v: entry %d is %s", q, i, e.Action)
+			}
+		}
+	}
+}
+
+func must(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestRotateByAge(t *testing.T) {
+	useTempLog(t)
+	old := `{"time":"` + time.Now().Add(-MaxAge-time.Hour).UTC().Format(time.RFC3339) + `","ip":"","user":"admin","action":"login"}` + "\n"
+	if err := os.WriteFile(Path, []byte(old), 0640); err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, "login", "admin")
+	if files, _ := Files(); len(files) != 2 {
+		t.Fatalf("files = %v, want the old file rotated", files)
+	}
+}
@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/metrics"
+	"github.com/yuzeguitarist/hy2mgr/internal/outbox"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// Sink receives copies of audit entries.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, batch []Entry) error
+	Close() error
+}
+
+// Forwarder copies entries to the sinks in state.Settings.AuditSinks in
+// the background. Each sink has its own bounded queue, so a slow or
+// unreachable one neither blocks the writer nor holds up the others;
+// entries that do not fit are dropped and counted.
+type Forwarder struct {
+	// Config returns the configured sinks; nil disables forwarding.
+	Config func() []state.AuditSink
+	// Sink builds a sink; defaults to SinkFor.
+	Sink func(cfg state.AuditSink) (Sink, error)
+	// Queue is the number of entries each sink may fall behind; default 1000.
+	Queue int
+	Logf  outbox.Logf
+	// Group tracks queued entries for Flush; nil gives the forwarder its own.
+	Group *outbox.Group
+
+	mu      sync.Mutex
+	workers map[string]*worker
+}
+
+type worker struct {
+	sink     Sink
+	err      error // building the sink failed; reported once
+	queue    *outbox.Queue[Entry]
+	dropping bool
+}
+
+// Default is the process-wide forwarder fed by Write.
+var Default = &Forwarder{Group: outbox.Background}
+
+func init() {
+	OnWrite(func(e Entry) { Default.Forward(e) })
+}
+
+// Setup points Default at config; logf (may be nil) reports delivery
+// failures.
+func Setup(config func() []state.AuditSink, logf func(format string, args ...any)) {
+	Default.mu.Lock()
+	Default.Config, Default.Logf = config, logf
+	Default.mu.Unlock()
+}
+
+// Forward queues e for every configured sink. It never blocks.
+func (f *Forwarder) Forward(e Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var cfgs []state.AuditSink
+	if f.Config != nil {
+		cfgs = f.Config()
+	}
+	if len(cfgs) == 0 && len(f.workers) == 0 {
+		return
+	}
+	// Workers are keyed by their whole config, so editing a sink replaces
+	// it and removing one stops it.
+	live := map[string]*worker{}
+	for _, cfg := range cfgs {
+		b, _ := json.Marshal(cfg)
+		key := string(b)
+		if w := f.workers[key]; w != nil {
+			live[key] = w
+			continue
+		}
+		w := &worker{}
+		if w.sink, w.err = f.build(cfg); w.err != nil {
+			f.Logf.Printf("audit: sink %s: %v", cfg.Type, w.err)
+		} else {
+			n := f.Queue
+			if n <= 0 {
+				n = 1000
+			}
+			if f.Group == nil {
+				f.Group = &outbox.Group{}
+			}
+			w.queue = outbox.New(f.Group, n, 100, func(batch []Entry) { f.run(w, batch) })
+		}
+		live[key] = w
+	}
+	for key, w := range f.workers {
+		if live[key] == nil && w.queue != nil {
+			w.queue.Close()
+			go func(w *worker) {
+				<-w.queue.Done()
+				w.sink.Close()
+			}(w)
+		}
+	}
+	f.workers = live
+	for _, w := range live {
+		if w.queue == nil {
+			continue
+		}
+		if w.queue.Put(e) {
+			w.dropping = false
+			continue
+		}
+		metrics.AuditForwarded.Inc("dropped")
+		if !w.dropping {
+			f.Logf.Printf("audit: %s is falling behind; dropping entries", w.sink.Name())
+			w.dropping = true
+		}
+	}
+}
+
+func (f *Forwarder) build(cfg state.AuditSink) (Sink, error) {
+	if f.Sink != nil {
+		return f.Sink(cfg)
+	}
+	return SinkFor(cfg)
+}
+
+// run sends one batch, retrying once after a failure (sinks reconnect on
+// their own).
+func (f *Forwarder) run(w *worker, batch []Entry) {
+	err := send(w.sink, batch)
+	if err != nil {
+		time.Sleep(time.Second)
+		err = send(w.sink, batch)
+	}
+	if err != nil {
+		f.Logf.Printf("audit: %s: %v (%d entries lost)", w.sink.Name(), err, len(batch))
+		metrics.AuditForwarded.Add(float64(len(batch)), "error")
+	} else {
+		metrics.AuditForwarded.Add(float64(len(batch)), "ok")
+	}
+}
+
+func send(s Sink, batch []Entry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.Send(ctx, batch)
+}
+
+// Flush waits up to timeout for queued entries to be sent (or given up
+// on).
+func (f *Forwarder) Flush(timeout time.Duration) {
+	f.mu.Lock()
+	g := f.Group
+	f.mu.Unlock()
+	if g != nil {
+		g.Flush(timeout)
+	}
+}
+
+// SendNow sends e to every configured sink synchronously over fresh
+// connections and returns one error per failed sink, keyed by name.
+func (f *Forwarder) SendNow(ctx context.Context, e Entry) map[string]error {
+	f.mu.Lock()
+	var cfgs []state.AuditSink
+	if f.Config != nil {
+		cfgs = f.Config()
+	}
+	f.mu.Unlock()
+	errs := map[string]error{}
+	for i, cfg := range cfgs {
+		s, err := f.build(cfg)
+		if err != nil {
+			errs[fmt.Sprintf("%s #%d", cfg.Type, i+1)] = err
+			continue
+		}
+		if err := s.Send(ctx, []Entry{e}); err != nil {
+			errs[s.Name()] = err
+		}
+		s.Close()
+	}
+	return errs
+}
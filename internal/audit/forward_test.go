@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+var sample = Entry{Time: "2026-10-19T08:00:00Z", User: "alice", Source: "cli", UID: "1000", Action: "node.add", Object: "ab12",
+	Changes: []Change{{Path: "nodes/ab12/name", New: `"phone"`}}, Result: "ok", Hash: "f00d"}
+
+func TestSyslogUDPAndTCP(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	msgs := make(chan string, 4)
+	go func() {
+		buf := make([]byte, 64<<10)
+		n, _, err := udp.ReadFrom(buf)
+		if err == nil {
+			msgs <- string(buf[:n])
+		}
+	}()
+	go func() {
+		c, err := tcp.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			// Octet counting: "<length> <message>".
+			l, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(l))
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			msgs <- string(buf)
+		}
+	}()
+
+	cfg := []state.AuditSink{
+		{Type: "syslog", Addr: udp.LocalAddr().String()},
+		{Type: "syslog", Network: "tcp", Addr: tcp.Addr().String(), Facility: "local3"},
+	}
+	f := &Forwarder{Config: func() []state.AuditSink { return cfg }}
+	f.Forward(sample)
+	f.Flush(5 * time.Second)
+
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-msgs:
+			got[m[:strings.IndexByte(m, '>')+1]] = m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of 2 messages", i)
+		}
+	}
+	// authpriv (10) and local3 (19), severity notice (5).
+	for _, pri := range []string{"<85>", "<157>"} {
+		m := got[pri]
+		if !strings.HasPrefix(m, pri+"1 2026-10-19T08:00:00Z ") || !strings.Contains(m, ` node.add [hy2mgr@32473 action="node.add" object="ab12" user="alice" source="cli" uid="1000" result="ok" hash="f00d"] {`) {
+			t.Fatalf("message %s = %q", pri, m)
+		}
+		var e Entry
+		if err := json.Unmarshal([]byte(m[strings.Index(m, "] {")+2:]), &e); err != nil || e.Changes[0].Path != "nodes/ab12/name" {
+			t.Fatalf("body: %+v, %v", e, err)
+		}
+	}
+}
+
+func TestFormatSyslogEscapesAndFailures(t *testing.T) {
+	e := Entry{Time: "2026-10-19T08:00:00Z", User: `a"b]`, Action: "settings set", Result: "error", Error: "boom"}
+	m := FormatSyslog(e, 4)
+	if !strings.HasPrefix(m, "<36>1 ") || !strings.Contains(m, " settingsset [") || !strings.Contains(m, `user="a\"b\]"`) {
+		t.Fatalf("message = %q", m)
+	}
+}
+
+func TestJournaldFields(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "journal.sock")
+	ln, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	j := &Journald{Socket: sock}
+	defer j.Close()
+	e := sample
+	e.Result, e.Error = "error", "line one\nline two"
+	if err := j.Send(context.Background(), []Entry{e}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64<<10)
+	n, _, err := ln.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	for _, want := range []string{"MESSAGE\n", "node.add ab12 by alice (cli): failed: line one\nline two\nPRIORITY=4\n", "HY2MGR_ACTION=node.add\n",
+		"HY2MGR_OBJECT=ab12\n", "HY2MGR_USER=alice\n", "HY2MGR_ERROR\n", "line one\nline two\n"} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("datagram lacks %q:\n%q", want, msg)
+		}
+	}
+}
+
+func TestHTTPCollector(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0k" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sc := bufio.NewScanner(r.Body)
+		mu.Lock()
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	cfg := []state.AuditSink{{Type: "http", URL: ts.URL, Token: "t0k"}}
+	f := &Forwarder{Config: func() []state.AuditSink { return cfg }}
+	for i := 0; i < 3; i++ {
+		f.Forward(sample)
+	}
+	f.Flush(5 * time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 3 || !strings.Contains(lines[0], `"action":"node.add"`) {
+		t.Fatalf("collector got %q", lines)
+	}
+}
+
+type blockingSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	got     int
+}
+
+func (b *blockingSink) Name() string { return "slow" }
+func (b *blockingSink) Close() error { return nil }
+func (b *blockingSink) Send(ctx context.Context, batch []Entry) error {
+	<-b.release
+	b.mu.Lock()
+	b.got += len(batch)
+	b.mu.Unlock()
+	return nil
+}
+
+func TestSlowSinkDoesNotBlock(t *testing.T) {
+	slow := &blockingSink{release: make(chan struct{})}
+	cfg := []state.AuditSink{{Type: "slow"}}
+	f := &Forwarder{
+		Config: func() []state.AuditSink { return cfg },
+		Sink:   func(state.AuditSink) (Sink, error) { return slow, nil },
+		Queue:  2,
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			f.Forward(sample)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Forward blocked on a slow sink")
+	}
+	close(slow.release)
+	f.Flush(5 * time.Second)
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	// One batch in flight plus a full queue; the rest were dropped.
+	if slow.got < 1 || slow.got > 3 {
+		t.Fatalf("delivered %d entries, want 1-3", slow.got)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !unix
+
+package audit
+
+func lockFile(path string) (func(), error) { return func() {}, nil }
@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Query filters entries. Zero values match everything.
+type Query struct {
+	Since, Until time.Time
+	Action       string // exact action or a prefix up to a dot: "node" matches "node.add"
+	User         string
+	Offset       int // entries to skip, newest first
+	Limit        int // 0: no limit
+}
+
+func (q Query) match(e Entry) bool {
+	if q.Action != "" && e.Action != q.Action && !strings.HasPrefix(e.Action, q.Action+".") {
+		return false
+	}
+	if q.User != "" && e.User != q.User {
+		return false
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		t, err := time.Parse(time.RFC3339, e.Time)
+		if err != nil || (!q.Since.IsZero() && t.Before(q.Since)) || (!q.Until.IsZero() && t.After(q.Until)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Read returns one page of matching entries, newest first, and the number
+// of matching entries in total. Only the newest Offset+Limit matches are
+// held in memory while the files are scanned.
+func Read(q Query) ([]Entry, int, error) {
+	keep := q.Offset + q.Limit // 0: keep all
+	if q.Limit <= 0 {
+		keep = 0
+	}
+	var ring []Entry // the newest matches; ring[total%keep] is the oldest once full
+	total := 0
+	err := each(func(_ string, _ int, e Entry, err error) error {
+		if err != nil || !q.match(e) {
+			return nil
+		}
+		if keep > 0 && len(ring) == keep {
+			ring[total%keep] = e
+		} else {
+			ring = append(ring, e)
+		}
+		total++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	matched := make([]Entry, 0, len(ring))
+	for i := len(ring) - 1; i >= 0; i-- {
+		j := i
+		if keep > 0 && total > keep {
+			j = (total + i) % keep
+		}
+		matched = append(matched, ring[j])
+	}
+	if q.Offset >= len(matched) {
+		return []Entry{}, total, nil
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	return matched, total, nil
+}
+
+// each calls fn for every line of every file, oldest first; err is set
+// for lines that are not entries.
+func each(fn func(file string, line int, e Entry, err error) error) error {
+	mu.Lock()
+	files, err := Files()
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue // rotated away meanwhile
+		}
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64<<10), 1<<20)
+		for n := 1; sc.Scan(); n++ {
+			if len(strings.TrimSpace(sc.Text())) == 0 {
+				continue
+			}
+			var e Entry
+			perr := json.Unmarshal(sc.Bytes(), &e)
+			if err := fn(path, n, e, perr); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report is the result of Verify.
+type Report struct {
+	Files    int
+	Entries  int
+	Legacy   int      // entries written before hashing was introduced
+	Anchor   string   // Prev of the oldest kept entry; set when older files were pruned
+	Problems []string // empty when the chain is intact
+}
+
+// Verify recomputes every hash and checks that each entry links to the one
+// before it, across rotated files.
+func Verify() (Report, error) {
+	var r Report
+	prev, started, lastFile := "", false, ""
+	err := each(func(file string, line int, e Entry, err error) error {
+		if file != lastFile {
+			r.Files++
+			lastFile = file
+		}
+		r.Entries++
+		at := fmt.Sprintf("%s:%d", file, line)
+		switch {
+		case err != nil:
+			r.Problems = append(r.Problems, at+": not an audit entry")
+			return nil
+		case e.Hash == "" && !started:
+			r.Legacy++
+			return nil
+		case e.Hash == "":
+			r.Problems = append(r.Problems, at+": entry without hash inside the chain")
+			return nil
+		}
+		if e.Sum() != e.Hash {
+			r.Problems = append(r.Problems, at+": hash mismatch (entry modified)")
+		}
+		if !started {
+			started = true
+			if r.Legacy == 0 {
+				r.Anchor = e.Prev
+			} else if e.Prev != "" {
+				r.Problems = append(r.Problems, at+": first hashed entry does not follow the legacy entries")
+			}
+		} else if e.Prev != prev {
+			r.Problems = append(r.Problems, at+": previous hash mismatch (entry removed or reordered)")
+		}
+		prev = e.Hash
+		return nil
+	})
+	return r, err
+}
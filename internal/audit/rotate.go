@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rotation and retention. The current file is rotated to
+// Path.<UTC timestamp> once it reaches MaxBytes or its first entry is
+// older than MaxAge; rotated files beyond Keep, or last written more than
+// Retention ago, are deleted.
+var (
+	MaxBytes  int64 = 10 << 20
+	MaxAge          = 30 * 24 * time.Hour
+	Keep            = 12
+	Retention       = 365 * 24 * time.Hour
+)
+
+const rotatedLayout = "20060102T150405Z"
+
+// Files lists the audit log files oldest first; the current file, if it
+// exists, is last.
+func Files() ([]string, error) {
+	matches, err := filepath.Glob(Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, m := range matches {
+		ts, _, _ := strings.Cut(strings.TrimPrefix(m, Path+"."), "-")
+		if _, err := time.Parse(rotatedLayout, ts); err == nil {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(Path); err == nil {
+		files = append(files, Path)
+	}
+	return files, nil
+}
+
+func rotateIfDue() error {
+	fi, err := os.Stat(Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	due := fi.Size() >= MaxBytes
+	if !due && fi.Size() > 0 {
+		if first, err := firstLine(Path); err == nil && first != nil {
+			var e Entry
+			if json.Unmarshal(first, &e) == nil {
+				t, err := time.Parse(time.RFC3339, e.Time)
+				due = err == nil && time.Since(t) > MaxAge
+			}
+		}
+	}
+	if !due {
+		return nil
+	}
+	base := Path + "." + time.Now().UTC().Format(rotatedLayout)
+	name := base
+	for i := 1; exists(name); i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	if err := os.Rename(Path, name); err != nil {
+		return err
+	}
+	return prune()
+}
+
+func prune() error {
+	files, err := Files()
+	if err != nil {
+		return err
+	}
+	rotated := files
+	if n := len(files); n > 0 && files[n-1] == Path {
+		rotated = files[:n-1]
+	}
+	for i, f := range rotated {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if len(rotated)-i > Keep || time.Since(fi.ModTime()) > Retention {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func firstLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if line = bytes.TrimSpace(line); len(line) == 0 {
+		return nil, nil
+	}
+	return line, nil
+}
+
+// lastLine returns the last non-empty line of path, nil if there is none.
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Entries are small; the tail is enough.
+	off := max(fi.Size()-64<<10, 0)
+	buf := make([]byte, fi.Size()-off)
+	if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	return buf, nil
+}
@@ -0,0 +1,300 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/outbox"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// SinkFor builds the sink cfg describes.
+func SinkFor(cfg state.AuditSink) (Sink, error) {
+	switch cfg.Type {
+	case "journald":
+		return &Journald{Socket: JournalSocket}, nil
+	case "syslog":
+		s := &Syslog{Network: cfg.Network, Addr: cfg.Addr}
+		if s.Network == "" {
+			s.Network = "udp"
+		}
+		fac, ok := facilities[cfg.Facility]
+		if cfg.Facility == "" {
+			fac, ok = facilities["authpriv"], true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog facility %q", cfg.Facility)
+		}
+		s.Facility = fac
+		if s.Network == "tls" {
+			host, _, _ := net.SplitHostPort(cfg.Addr)
+			s.TLS = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+			if cfg.CAFile != "" {
+				pem, err := os.ReadFile(cfg.CAFile)
+				if err != nil {
+					return nil, err
+				}
+				s.TLS.RootCAs = x509.NewCertPool()
+				if !s.TLS.RootCAs.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("%s: no certificates found", cfg.CAFile)
+				}
+			}
+		}
+		return s, nil
+	case "http":
+		return &HTTP{URL: cfg.URL, Token: cfg.Token}, nil
+	}
+	return nil, fmt.Errorf("unknown audit sink type %q", cfg.Type)
+}
+
+// summary is a one-line description of e for human readers.
+func summary(e Entry) string {
+	s := e.Action
+	if e.Object != "" {
+		s += " " + e.Object
+	}
+	s += " by " + e.User
+	if e.Source != "" {
+		s += " (" + e.Source + ")"
+	}
+	if e.Result == "error" {
+		s += ": failed: " + e.Error
+	}
+	return s
+}
+
+// severity is the syslog severity of e: notice, or warning for failures.
+func severity(e Entry) int {
+	if e.Result == "error" {
+		return 4
+	}
+	return 5
+}
+
+// JournalSocket is journald's native protocol socket.
+var JournalSocket = "/run/systemd/journal/socket"
+
+// Journald logs each entry with its fields as HY2MGR_* journal fields, so
+// `journalctl HY2MGR_ACTION=node.add` finds them.
+type Journald struct {
+	Socket string
+	conn   net.Conn
+}
+
+func (j *Journald) Name() string { return "journald" }
+
+func (j *Journald) Send(ctx context.Context, batch []Entry) error {
+	if j.conn == nil {
+		c, err := (&net.Dialer{}).DialContext(ctx, "unixgram", j.Socket)
+		if err != nil {
+			return err
+		}
+		j.conn = c
+	}
+	for _, e := range batch {
+		var b bytes.Buffer
+		field := func(name, value string) {
+			if value == "" {
+				return
+			}
+			if !strings.Contains(value, "\n") {
+				fmt.Fprintf(&b, "%s=%s\n", name, value)
+				return
+			}
+			// Multi-line values are length-prefixed.
+			b.WriteString(name + "\n")
+			binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+			b.WriteString(value + "\n")
+		}
+		field("MESSAGE", summary(e))
+		field("PRIORITY", fmt.Sprint(severity(e)))
+		field("SYSLOG_IDENTIFIER", "hy2mgr-audit")
+		field("HY2MGR_ACTION", e.Action)
+		field("HY2MGR_OBJECT", e.Object)
+		field("HY2MGR_USER", e.User)
+		field("HY2MGR_SOURCE", e.Source)
+		field("HY2MGR_IP", e.IP)
+		field("HY2MGR_UID", e.UID)
+		field("HY2MGR_DETAIL", e.Detail)
+		field("HY2MGR_RESULT", e.Result)
+		field("HY2MGR_ERROR", e.Error)
+		if len(e.Changes) > 0 {
+			c, _ := json.Marshal(e.Changes)
+			field("HY2MGR_CHANGES", string(c))
+		}
+		field("HY2MGR_TIME", e.Time)
+		field("HY2MGR_HASH", e.Hash)
+		if _, err := j.conn.Write(b.Bytes()); err != nil {
+			j.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *Journald) Close() error {
+	if j.conn == nil {
+		return nil
+	}
+	err := j.conn.Close()
+	j.conn = nil
+	return err
+}
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog sends RFC 5424 messages: one datagram each over UDP, octet-
+// counted frames (RFC 5425/6587) over TCP and TLS. The message is the
+// entry as JSON; the main fields are also structured data.
+type Syslog struct {
+	Network  string // udp, tcp or tls
+	Addr     string
+	Facility int
+	TLS      *tls.Config
+	conn     net.Conn
+}
+
+func (s *Syslog) Name() string { return "syslog " + s.Network + "://" + s.Addr }
+
+func (s *Syslog) Send(ctx context.Context, batch []Entry) error {
+	if s.conn == nil {
+		var err error
+		d := &net.Dialer{Timeout: 10 * time.Second}
+		if s.Network == "tls" {
+			s.conn, err = (&tls.Dialer{NetDialer: d, Config: s.TLS}).DialContext(ctx, "tcp", s.Addr)
+		} else {
+			s.conn, err = d.DialContext(ctx, s.Network, s.Addr)
+		}
+		if err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(dl)
+	}
+	for _, e := range batch {
+		msg := FormatSyslog(e, s.Facility)
+		if s.Network != "udp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := io.WriteString(s.conn, msg); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syslog) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// sdID is the structured data ID; 32473 is the enterprise number RFC 5612
+// reserves for documentation and examples.
+const sdID = "hy2mgr@32473"
+
+var hostname = func() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "-"
+	}
+	return h
+}()
+
+// FormatSyslog renders e as an RFC 5424 message with the given facility.
+func FormatSyslog(e Entry, facility int) string {
+	ts := e.Time
+	if ts == "" {
+		ts = "-"
+	}
+	var sd strings.Builder
+	sd.WriteString("[" + sdID)
+	for _, p := range [][2]string{{"action", e.Action}, {"object", e.Object}, {"user", e.User}, {"source", e.Source},
+		{"ip", e.IP}, {"uid", e.UID}, {"result", e.Result}, {"hash", e.Hash}} {
+		if p[1] != "" {
+			fmt.Fprintf(&sd, " %s=\"%s\"", p[0], sdEscape.Replace(p[1]))
+		}
+	}
+	sd.WriteString("]")
+	body, _ := json.Marshal(e)
+	return fmt.Sprintf("<%d>1 %s %s hy2mgr %d %s %s %s", facility*8+severity(e), ts, hostname, os.Getpid(), msgID(e.Action), sd.String(), body)
+}
+
+var sdEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// msgID makes action a valid MSGID: up to 32 printable ASCII characters.
+func msgID(action string) string {
+	id := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, action)
+	if len(id) > 32 {
+		id = id[:32]
+	}
+	if id == "" {
+		return "-"
+	}
+	return id
+}
+
+// HTTP POSTs batches as JSON lines (application/x-ndjson), with the token,
+// if any, as a bearer token.
+type HTTP struct {
+	URL   string
+	Token string
+}
+
+func (h *HTTP) Name() string { return "http " + h.URL }
+
+func (h *HTTP) Send(ctx context.Context, batch []Entry) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "hy2mgr")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+	resp, err := outbox.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (h *HTTP) Close() error { return nil }
@@ -0,0 +1,261 @@
+// Package backup writes and restores single-file archives of everything
+// needed to rebuild a hy2mgr host: the state (and the key its secrets are
+// encrypted with), hysteria's config, certificate and key, and the systemd
+// units. An archive is a gzipped tar holding manifest.json, which lists
+// every file with its checksum, followed by the files; it can be encrypted
+// with a passphrase as a whole.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+const (
+	Format  = "hy2mgr-backup"
+	Version = 1
+
+	manifestName = "manifest.json"
+	stateName    = "state.json"
+	keyName      = "state.key"
+)
+
+// Dir is where Create keeps archives; overridable for tests.
+var Dir = app.BackupDir
+
+// Source is a file backed up as is when it exists.
+type Source struct {
+	Name string // path inside the archive
+	Path string
+	Mode os.FileMode
+}
+
+// Sources are the files besides the state; overridable for tests.
+var Sources = []Source{
+	{"hysteria/config.yaml", app.HysteriaConfigPath, 0640},
+	{"hysteria/cert.crt", app.HysteriaCertPath, 0644},
+	{"hysteria/cert.key", app.HysteriaKeyPath, 0640},
+	{"systemd/" + app.ManagerService, "/etc/systemd/system/" + app.ManagerService, 0644},
+	{"systemd/" + app.FirewallService, "/etc/systemd/system/" + app.FirewallService, 0644},
+	{"systemd/" + app.HysteriaService, "/etc/systemd/system/" + app.HysteriaService, 0644},
+}
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CreatedAt string `json:"createdAt"`
+	Host      string `json:"host"`
+	Files     []File `json:"files"`
+}
+
+// File is one archived file. The state has no Path: it is restored into
+// whichever backend the host uses.
+type File struct {
+	Name   string      `json:"name"`
+	Path   string      `json:"path,omitempty"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+}
+
+// Archive is an opened and checksum-verified backup.
+type Archive struct {
+	Manifest Manifest
+	Data     map[string][]byte // by File.Name
+}
+
+// Collect gathers the current files. The state is stored as the JSON store
+// would write it, so its secrets stay encrypted; the key file is included
+// with it, which makes an unencrypted archive as sensitive as the host.
+func Collect(st *state.State) (*Archive, error) {
+	host, _ := os.Hostname()
+	a := &Archive{
+		Manifest: Manifest{Format: Format, Version: Version, CreatedAt: app.NowRFC3339(), Host: host},
+		Data:     map[string][]byte{},
+	}
+	raw, err := state.Export(st)
+	if err != nil {
+		return nil, fmt.Errorf("export state: %w", err)
+	}
+	a.add(File{Name: stateName, Mode: 0600}, raw)
+	if st.Encryption != nil {
+		key, err := os.ReadFile(state.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("state is encrypted but its key cannot be read: %w", err)
+		}
+		a.add(File{Name: keyName, Path: state.KeyPath, Mode: 0600}, key)
+	}
+	for _, s := range Sources {
+		b, err := os.ReadFile(s.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.add(File{Name: s.Name, Path: s.Path, Mode: s.Mode}, b)
+	}
+	return a, nil
+}
+
+func (a *Archive) add(f File, b []byte) {
+	sum := sha256.Sum256(b)
+	f.Size, f.SHA256 = int64(len(b)), hex.EncodeToString(sum[:])
+	a.Manifest.Files = append(a.Manifest.Files, f)
+	a.Data[f.Name] = b
+}
+
+// Has reports whether the archive contains name.
+func (a *Archive) Has(name string) bool { _, ok := a.Data[name]; return ok }
+
+// Write writes a as tar.gz, encrypted if passphrase is not empty.
+func (a *Archive) Write(w io.Writer, passphrase string) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	put := func(name string, mode os.FileMode, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(b)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+	m, err := json.MarshalIndent(a.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := put(manifestName, 0600, m); err != nil {
+		return err
+	}
+	for _, f := range a.Manifest.Files {
+		if err := put(f.Name, 0600, a.Data[f.Name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	out := buf.Bytes()
+	if passphrase != "" {
+		if out, err = encrypt(out, passphrase); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// Open reads an archive, decrypting it with passphrase if it is
+// encrypted, and checks its format, version and checksums.
+func Open(raw []byte, passphrase string) (*Archive, error) {
+	if Encrypted(raw) {
+		if passphrase == "" {
+			return nil, errors.New("backup is encrypted; a passphrase is required")
+		}
+		var err error
+		if raw, err = decrypt(raw, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	data := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(tr, 64<<20))
+		if err != nil {
+			return nil, err
+		}
+		data[hdr.Name] = b
+	}
+	a := &Archive{Data: map[string][]byte{}}
+	if err := json.Unmarshal(data[manifestName], &a.Manifest); err != nil {
+		return nil, fmt.Errorf("archive has no valid %s", manifestName)
+	}
+	if a.Manifest.Format != Format {
+		return nil, fmt.Errorf("not a hy2mgr backup (format %q)", a.Manifest.Format)
+	}
+	if a.Manifest.Version < 1 || a.Manifest.Version > Version {
+		return nil, fmt.Errorf("backup format version %d is not supported (this hy2mgr reads up to %d)", a.Manifest.Version, Version)
+	}
+	for _, f := range a.Manifest.Files {
+		b, ok := data[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is listed in the manifest but missing", f.Name)
+		}
+		sum := sha256.Sum256(b)
+		if hex.EncodeToString(sum[:]) != f.SHA256 || int64(len(b)) != f.Size {
+			return nil, fmt.Errorf("%s: checksum mismatch", f.Name)
+		}
+		a.Data[f.Name] = b
+	}
+	if !a.Has(stateName) {
+		return nil, fmt.Errorf("archive contains no %s", stateName)
+	}
+	return a, nil
+}
+
+// Name is the file name Create uses for a backup taken at t.
+func Name(host string, t time.Time, encrypted bool) string {
+	name := fmt.Sprintf("hy2mgr-backup-%s-%s.tar.gz", host, t.UTC().Format("20060102T150405Z"))
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// Create writes a backup of the current files to Dir and prunes all but
+// the keep newest archives there (keep <= 0 keeps all).
+func Create(st *state.State, passphrase string, keep int) (string, error) {
+	a, err := Collect(st)
+	if err != nil {
+		return "", err
+	}
+	if err := app.EnsureDir(Dir, 0700); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := a.Write(&buf, passphrase); err != nil {
+		return "", err
+	}
+	path := filepath.Join(Dir, Name(a.Manifest.Host, time.Now(), passphrase != ""))
+	if err := app.AtomicWriteFile(path, 0600, buf.Bytes()); err != nil {
+		return "", err
+	}
+	if keep > 0 {
+		if err := app.PruneFiles(filepath.Join(Dir, "hy2mgr-backup-*"), keep); err != nil {
+			return path, fmt.Errorf("prune old backups: %w", err)
+		}
+	}
+	return path, nil
+}
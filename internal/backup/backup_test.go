@@ -0,0 +1,217 @@
+package backup
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/crypto"
+	"github.com/yuzeguitarist/hy2mgr/internal/hysteria"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// setup points every path at a temp dir and returns an encrypted state
+// with one node, plus its dir.
+func setup(t *testing.T) (*state.State, string) {
+	t.Helper()
+	dir := t.TempDir()
+	oldKey, oldDir, oldSources := state.KeyPath, Dir, Sources
+	t.Cleanup(func() { state.KeyPath, Dir, Sources = oldKey, oldDir, oldSources })
+	state.KeyPath = filepath.Join(dir, "state.key")
+	Dir = filepath.Join(dir, "backups")
+
+	cert, key, _, err := crypto.GenerateSelfSigned([]net.IP{net.ParseIP("203.0.113.1")}, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "hysteria", "cert.crt"), filepath.Join(dir, "hysteria", "cert.key")
+	cfg, err := hysteria.GenerateYAML(8443, certPath, keyPath, map[string]string{"u1": "p1"}, "https://example.com", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sources = []Source{
+		{"hysteria/config.yaml", filepath.Join(dir, "hysteria", "config.yaml"), 0640},
+		{"hysteria/cert.crt", certPath, 0644},
+		{"hysteria/cert.key", keyPath, 0640},
+	}
+	_ = os.MkdirAll(filepath.Join(dir, "hysteria"), 0750)
+	for s, b := range map[int][]byte{0: cfg, 1: cert, 2: key} {
+		if err := os.WriteFile(Sources[s].Path, b, Sources[s].Mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := state.LoadFrom(state.NewFileStore(filepath.Join(dir, "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Settings.ListenHost = "203.0.113.1"
+	st.Nodes = []state.Node{{ID: "n1", Name: "phone", Username: "u1", Password: "node-secret-1", Enabled: true}}
+	if err := st.SaveAtomic(); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Rekey(st, false); err != nil {
+		t.Fatal(err)
+	}
+	return st, dir
+}
+
+func roundTrip(t *testing.T, st *state.State, pass string) (*Archive, []byte) {
+	t.Helper()
+	a, err := Collect(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.Write(&buf, pass); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Open(buf.Bytes(), pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got, buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	st, _ := setup(t)
+	for _, pass := range []string{"", "correct horse"} {
+		a, raw := roundTrip(t, st, pass)
+		if Encrypted(raw) != (pass != "") {
+			t.Fatalf("passphrase %q: encrypted = %v", pass, Encrypted(raw))
+		}
+		if pass != "" && bytes.Contains(raw, []byte("hysteria")) {
+			t.Fatal("encrypted archive leaks file names")
+		}
+		for _, name := range []string{stateName, keyName, "hysteria/config.yaml", "hysteria/cert.crt", "hysteria/cert.key"} {
+			if !a.Has(name) {
+				t.Fatalf("archive lacks %s", name)
+			}
+		}
+		if bytes.Contains(a.Data[stateName], []byte("node-secret-1")) {
+			t.Fatal("state secrets archived in plaintext")
+		}
+		got, err := a.Check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Nodes[0].Password != "node-secret-1" {
+			t.Fatalf("nodes = %+v", got.Nodes)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	st, _ := setup(t)
+	_, raw := roundTrip(t, st, "correct horse")
+	if _, err := Open(raw, "wrong"); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	if _, err := Open(raw, ""); err == nil {
+		t.Fatal("opened an encrypted backup without a passphrase")
+	}
+
+	a, _ := Collect(st)
+	a.Data["hysteria/cert.crt"] = append(a.Data["hysteria/cert.crt"], '\n')
+	var buf bytes.Buffer
+	_ = a.Write(&buf, "")
+	if _, err := Open(buf.Bytes(), ""); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("tampered file: %v", err)
+	}
+
+	a, _ = Collect(st)
+	a.Manifest.Version = Version + 1
+	buf.Reset()
+	_ = a.Write(&buf, "")
+	if _, err := Open(buf.Bytes(), ""); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatalf("future version: %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	st, dir := setup(t)
+	a, _ := roundTrip(t, st, "")
+	origCfg := a.Data["hysteria/config.yaml"]
+
+	// Wreck the host: new key, different nodes, lost config.
+	st.Nodes = nil
+	if err := state.Rekey(st, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(Sources[0].Path); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := state.LoadFrom(state.NewFileStore(filepath.Join(dir, "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Restore(a, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Revision <= cur.Revision {
+		t.Fatalf("revision %d, was %d", got.Revision, cur.Revision)
+	}
+	if b, _ := os.ReadFile(Sources[0].Path); !bytes.Equal(b, origCfg) {
+		t.Fatal("config not restored")
+	}
+	if fi, _ := os.Stat(Sources[0].Path); fi.Mode().Perm() != 0640 {
+		t.Fatalf("config mode %v", fi.Mode().Perm())
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "hysteria", "*.restore")); len(leftovers) > 0 {
+		t.Fatalf("staged files left: %v", leftovers)
+	}
+	// Reloading reads the restored secrets with the restored key.
+	back, err := state.LoadFrom(state.NewFileStore(filepath.Join(dir, "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Nodes) != 1 || back.Nodes[0].Password != "node-secret-1" {
+		t.Fatalf("reloaded nodes = %+v", back.Nodes)
+	}
+}
+
+func TestRestoreRejectsBadCertificate(t *testing.T) {
+	st, _ := setup(t)
+	a, _ := roundTrip(t, st, "")
+	a.Data["hysteria/cert.key"] = []byte("not a key")
+	cfg, _ := os.ReadFile(Sources[0].Path)
+	if _, err := Restore(a, st); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Restore = %v", err)
+	}
+	if b, _ := os.ReadFile(Sources[0].Path); !bytes.Equal(b, cfg) {
+		t.Fatal("files changed by a rejected restore")
+	}
+}
+
+func TestCreatePrunes(t *testing.T) {
+	st, _ := setup(t)
+	_ = os.MkdirAll(Dir, 0700)
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		p := filepath.Join(Dir, Name("h", old.Add(time.Duration(i)*time.Minute), false))
+		_ = os.WriteFile(p, nil, 0600)
+		_ = os.Chtimes(p, old.Add(time.Duration(i)*time.Minute), old.Add(time.Duration(i)*time.Minute))
+	}
+	path, err := Create(st, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("archive: %v, %v", fi, err)
+	}
+	files, _ := filepath.Glob(filepath.Join(Dir, "hy2mgr-backup-*"))
+	if len(files) != 3 {
+		t.Fatalf("kept %d archives, want 3", len(files))
+	}
+	for _, f := range files {
+		if strings.Contains(f, Name("h", old, false)) || strings.Contains(f, Name("h", old.Add(time.Minute), false)) {
+			t.Fatalf("kept old archive %s", f)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted archives are magic | salt | nonce | AES-256-GCM ciphertext,
+// keyed with scrypt(passphrase, salt). The magic is authenticated too.
+// README.md documents the layout for decrypting without hy2mgr; keep it
+// in sync.
+var magic = []byte("HY2MGRBK\x00\x01")
+
+const saltSize = 16
+
+// Encrypted reports whether raw is a passphrase-encrypted archive.
+func Encrypted(raw []byte) bool { return bytes.HasPrefix(raw, magic) }
+
+func aead(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(plain []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := aead(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte{}, magic...), salt...), nonce...)
+	return gcm.Seal(out, nonce, plain, magic), nil
+}
+
+func decrypt(raw []byte, passphrase string) ([]byte, error) {
+	raw = raw[len(magic):]
+	if len(raw) < saltSize+12 {
+		return nil, errors.New("encrypted backup is truncated")
+	}
+	gcm, err := aead(passphrase, raw[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	raw = raw[saltSize:]
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], magic)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted backup")
+	}
+	return plain, nil
+}
@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/hysteria"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// Targets lists the archived files with where Restore puts them. Targets
+// come from Sources, never from the manifest, so a crafted archive cannot
+// write anywhere else. The state has no Path.
+func (a *Archive) Targets() []File {
+	paths := map[string]string{keyName: state.KeyPath}
+	for _, s := range Sources {
+		paths[s.Name] = s.Path
+	}
+	var out []File
+	for _, f := range a.Manifest.Files {
+		p, ok := paths[f.Name]
+		if f.Name != stateName && !ok {
+			continue
+		}
+		f.Path = p
+		out = append(out, f)
+	}
+	return out
+}
+
+// Check decodes the archived state, with the archived key if there is one,
+// and validates it along with hysteria's config and key pair. It returns
+// the state to restore.
+func (a *Archive) Check() (*state.State, error) {
+	var key []byte
+	if a.Has(keyName) {
+		key = a.Data[keyName]
+	}
+	st, err := state.Import(a.Data[stateName], key)
+	if err != nil {
+		return nil, fmt.Errorf("state: %w", err)
+	}
+	if p := st.Check(); len(p) > 0 {
+		return nil, fmt.Errorf("state: %s (%d problem(s))", p[0], len(p))
+	}
+	if a.Has("hysteria/config.yaml") {
+		if err := hysteria.ValidateYAML(a.Data["hysteria/config.yaml"]); err != nil {
+			return nil, fmt.Errorf("hysteria/config.yaml: %w", err)
+		}
+	}
+	if a.Has("hysteria/cert.crt") != a.Has("hysteria/cert.key") {
+		return nil, fmt.Errorf("archive has only one of hysteria/cert.crt and hysteria/cert.key")
+	}
+	if a.Has("hysteria/cert.crt") {
+		if _, err := tls.X509KeyPair(a.Data["hysteria/cert.crt"], a.Data["hysteria/cert.key"]); err != nil {
+			return nil, fmt.Errorf("hysteria certificate: %w", err)
+		}
+	}
+	return st, nil
+}
+
+// Restore checks a, then puts its files in place and saves its state into
+// the store cur was loaded from. Files are staged next to their targets
+// first, so a failure before the switch leaves the host untouched.
+func Restore(a *Archive, cur *state.State) (*state.State, error) {
+	st, err := a.Check()
+	if err != nil {
+		return nil, err
+	}
+	var staged []File
+	defer func() {
+		for _, f := range staged {
+			_ = os.Remove(f.Path + ".restore")
+		}
+	}()
+	for _, f := range a.Targets() {
+		if f.Path == "" {
+			continue
+		}
+		// MkdirAll leaves the permissions of existing directories alone.
+		if err := os.MkdirAll(filepath.Dir(f.Path), 0750); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(f.Path+".restore", a.Data[f.Name], f.Mode.Perm()); err != nil {
+			return nil, fmt.Errorf("stage %s: %w", f.Path, err)
+		}
+		// WriteFile keeps the mode of a leftover file.
+		if err := os.Chmod(f.Path+".restore", f.Mode.Perm()); err != nil {
+			return nil, err
+		}
+		staged = append(staged, f)
+	}
+	// The key goes first (it is first in the archive), so the state saved
+	// below is sealed with the key that is then installed.
+	for len(staged) > 0 {
+		f := staged[0]
+		if err := os.Rename(f.Path+".restore", f.Path); err != nil {
+			return nil, fmt.Errorf("install %s: %w", f.Path, err)
+		}
+		staged = staged[1:]
+	}
+	st.Revision = cur.Revision
+	st.SetStore(cur.Store())
+	if err := st.SaveAtomic(); err != nil {
+		return nil, fmt.Errorf("save restored state: %w", err)
+	}
+	return st, nil
+}
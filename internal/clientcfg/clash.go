@@ -0,0 +1,79 @@
+package clientcfg
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+type clashProfile struct {
+	MixedPort   int          `yaml:"mixed-port"`
+	AllowLAN    bool         `yaml:"allow-lan"`
+	Mode        string       `yaml:"mode"`
+	LogLevel    string       `yaml:"log-level"`
+	Proxies     []clashProxy `yaml:"proxies"`
+	ProxyGroups []clashGroup `yaml:"proxy-groups"`
+	Rules       []string     `yaml:"rules"`
+}
+
+// clashProxy follows the mihomo (Clash Meta) hysteria2 proxy schema.
+type clashProxy struct {
+	Name           string   `yaml:"name"`
+	Type           string   `yaml:"type"`
+	Server         string   `yaml:"server"`
+	Port           int      `yaml:"port"`
+	Ports          string   `yaml:"ports,omitempty"`
+	Password       string   `yaml:"password"`
+	Obfs           string   `yaml:"obfs,omitempty"`
+	ObfsPassword   string   `yaml:"obfs-password,omitempty"`
+	SNI            string   `yaml:"sni,omitempty"`
+	SkipCertVerify bool     `yaml:"skip-cert-verify"`
+	Fingerprint    string   `yaml:"fingerprint,omitempty"`
+	ALPN           []string `yaml:"alpn,omitempty"`
+}
+
+type clashGroup struct {
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Proxies []string `yaml:"proxies"`
+}
+
+const clashGroupName = "PROXY"
+
+// Clash renders a complete Clash Meta / mihomo profile: one hysteria2 proxy
+// per endpoint, a selector group and rules that keep LAN traffic direct.
+func Clash(eps []Endpoint) ([]byte, error) {
+	names := uniqueNames(eps)
+	p := clashProfile{
+		MixedPort: 7890,
+		Mode:      "rule",
+		LogLevel:  "info",
+		Rules: []string{
+			"IP-CIDR,127.0.0.0/8,DIRECT,no-resolve",
+			"IP-CIDR,10.0.0.0/8,DIRECT,no-resolve",
+			"IP-CIDR,172.16.0.0/12,DIRECT,no-resolve",
+			"IP-CIDR,192.168.0.0/16,DIRECT,no-resolve",
+			"IP-CIDR6,fc00::/7,DIRECT,no-resolve",
+			"MATCH," + clashGroupName,
+		},
+	}
+	group := clashGroup{Name: clashGroupName, Type: "select"}
+	for i, ep := range eps {
+		p.Proxies = append(p.Proxies, clashProxy{
+			Name:           names[i],
+			Type:           "hysteria2",
+			Server:         ep.Host,
+			Port:           ep.Port,
+			Ports:          ep.Ports,
+			Password:       ep.Auth,
+			Obfs:           ep.Obfs,
+			ObfsPassword:   ep.ObfsPassword,
+			SNI:            ep.SNI,
+			SkipCertVerify: ep.Insecure,
+			Fingerprint:    ep.pinHex(),
+			ALPN:           []string{"h3"},
+		})
+		group.Proxies = append(group.Proxies, names[i])
+	}
+	group.Proxies = append(group.Proxies, "DIRECT")
+	p.ProxyGroups = []clashGroup{group}
+	return yaml.Marshal(&p)
+}
@@ -0,0 +1,41 @@
+package clientcfg
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestClash(t *testing.T) {
+	eps := []Endpoint{
+		{Name: "phone", Host: "203.0.113.1", Port: 443, Auth: "u1:p@ss", SNI: "www.bing.com", Insecure: true, PinSHA256: "AB:CD:EF"},
+		{Name: "phone", Host: "2001:db8::1", Port: 8443, Ports: "20000-50000", Auth: "u2:x", Obfs: "salamander", ObfsPassword: "o"},
+	}
+	b, err := Clash(eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p clashProfile
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Proxies) != 2 {
+		t.Fatalf("proxies = %+v", p.Proxies)
+	}
+	a, c := p.Proxies[0], p.Proxies[1]
+	if a.Type != "hysteria2" || a.Server != "203.0.113.1" || a.Port != 443 || a.Password != "u1:p@ss" {
+		t.Fatalf("proxy 0 = %+v", a)
+	}
+	if a.SNI != "www.bing.com" || !a.SkipCertVerify || a.Fingerprint != "abcdef" {
+		t.Fatalf("proxy 0 tls = %+v", a)
+	}
+	if c.Name != "phone-2" || c.Server != "2001:db8::1" || c.Ports != "20000-50000" || c.Obfs != "salamander" || c.ObfsPassword != "o" {
+		t.Fatalf("proxy 1 = %+v", c)
+	}
+	if len(p.ProxyGroups) != 1 || len(p.ProxyGroups[0].Proxies) != 3 || p.ProxyGroups[0].Proxies[1] != "phone-2" {
+		t.Fatalf("groups = %+v", p.ProxyGroups)
+	}
+	if p.Rules[len(p.Rules)-1] != "MATCH,"+clashGroupName {
+		t.Fatalf("rules = %v", p.Rules)
+	}
+}
@@ -0,0 +1,48 @@
+// Package clientcfg renders client-side configuration for hysteria2 nodes in
+// the formats popular clients import.
+package clientcfg
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Endpoint is everything a client needs to reach one node. service.NodeURI
+// and every export format are built from it.
+type Endpoint struct {
+	Name         string
+	Host         string
+	Port         int
+	Ports        string // port hopping range, e.g. "20000-50000"; empty if unused
+	Auth         string // userpass auth string "username:password"
+	SNI          string
+	Insecure     bool
+	PinSHA256    string // colon-separated upper-case hex as printed by openssl
+	Obfs         string // "salamander" or empty
+	ObfsPassword string
+}
+
+// pinHex returns the pin as lower-case hex without separators, the form
+// most non-hysteria clients expect.
+func (e Endpoint) pinHex() string {
+	return strings.ToLower(strings.ReplaceAll(e.PinSHA256, ":", ""))
+}
+
+// uniqueNames returns display names for eps, suffixing duplicates so that
+// formats keyed by name stay valid.
+func uniqueNames(eps []Endpoint) []string {
+	seen := map[string]int{}
+	out := make([]string, len(eps))
+	for i, ep := range eps {
+		name := ep.Name
+		if name == "" {
+			name = "hy2"
+		}
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			name = name + "-" + strconv.Itoa(n)
+		}
+		out[i] = name
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package clientcfg
+
+import (
+	"net"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClientOptions are the client-side knobs that are not part of a node:
+// bandwidth hints and local proxy listeners.
+type ClientOptions struct {
+	UpMbps   int // 0 leaves congestion control to the client (BBR)
+	DownMbps int
+	SOCKS5   string // local SOCKS5 listen address; empty -> 127.0.0.1:1080
+	HTTP     string // local HTTP proxy listen address; empty -> 127.0.0.1:8080
+}
+
+// hysteriaClient follows the official Hysteria 2 client config.yaml.
+type hysteriaClient struct {
+	Server    string             `yaml:"server"`
+	Auth      string             `yaml:"auth"`
+	TLS       hysteriaTLS        `yaml:"tls"`
+	Obfs      *hysteriaObfs      `yaml:"obfs,omitempty"`
+	Bandwidth *hysteriaBandwidth `yaml:"bandwidth,omitempty"`
+	SOCKS5    hysteriaListen     `yaml:"socks5"`
+	HTTP      hysteriaListen     `yaml:"http"`
+}
+
+type hysteriaTLS struct {
+	SNI       string `yaml:"sni,omitempty"`
+	Insecure  bool   `yaml:"insecure"`
+	PinSHA256 string `yaml:"pinSHA256,omitempty"`
+}
+
+type hysteriaObfs struct {
+	Type       string `yaml:"type"`
+	Salamander struct {
+		Password string `yaml:"password"`
+	} `yaml:"salamander"`
+}
+
+type hysteriaBandwidth struct {
+	Up   string `yaml:"up,omitempty"`
+	Down string `yaml:"down,omitempty"`
+}
+
+type hysteriaListen struct {
+	Listen string `yaml:"listen"`
+}
+
+// Hysteria renders a complete config.yaml for the official hysteria client.
+func Hysteria(ep Endpoint, opts ClientOptions) ([]byte, error) {
+	port := strconv.Itoa(ep.Port)
+	if ep.Ports != "" {
+		port = ep.Ports
+	}
+	c := hysteriaClient{
+		Server: net.JoinHostPort(ep.Host, port),
+		Auth:   ep.Auth,
+		TLS:    hysteriaTLS{SNI: ep.SNI, Insecure: ep.Insecure, PinSHA256: ep.PinSHA256},
+		SOCKS5: hysteriaListen{Listen: "127.0.0.1:1080"},
+		HTTP:   hysteriaListen{Listen: "127.0.0.1:8080"},
+	}
+	if opts.SOCKS5 != "" {
+		c.SOCKS5.Listen = opts.SOCKS5
+	}
+	if opts.HTTP != "" {
+		c.HTTP.Listen = opts.HTTP
+	}
+	if ep.Obfs != "" {
+		c.Obfs = &hysteriaObfs{Type: ep.Obfs}
+		c.Obfs.Salamander.Password = ep.ObfsPassword
+	}
+	if opts.UpMbps > 0 || opts.DownMbps > 0 {
+		c.Bandwidth = &hysteriaBandwidth{}
+		if opts.UpMbps > 0 {
+			c.Bandwidth.Up = strconv.Itoa(opts.UpMbps) + " mbps"
+		}
+		if opts.DownMbps > 0 {
+			c.Bandwidth.Down = strconv.Itoa(opts.DownMbps) + " mbps"
+		}
+	}
+	return yaml.Marshal(&c)
+}
@@ -0,0 +1,34 @@
+package clientcfg
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestHysteria(t *testing.T) {
+	ep := Endpoint{Host: "2001:db8::1", Port: 443, Ports: "20000-50000", Auth: "u:p", SNI: "www.bing.com", Insecure: true, PinSHA256: "AB:CD", Obfs: "salamander", ObfsPassword: "o"}
+	b, err := Hysteria(ep, ClientOptions{DownMbps: 100, SOCKS5: "127.0.0.1:1081"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c hysteriaClient
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Server != "[2001:db8::1]:20000-50000" || c.Auth != "u:p" {
+		t.Fatalf("server/auth = %q %q", c.Server, c.Auth)
+	}
+	if c.TLS.SNI != "www.bing.com" || !c.TLS.Insecure || c.TLS.PinSHA256 != "AB:CD" {
+		t.Fatalf("tls = %+v", c.TLS)
+	}
+	if c.Obfs == nil || c.Obfs.Type != "salamander" || c.Obfs.Salamander.Password != "o" {
+		t.Fatalf("obfs = %+v", c.Obfs)
+	}
+	if c.Bandwidth == nil || c.Bandwidth.Up != "" || c.Bandwidth.Down != "100 mbps" {
+		t.Fatalf("bandwidth = %+v", c.Bandwidth)
+	}
+	if c.SOCKS5.Listen != "127.0.0.1:1081" || c.HTTP.Listen != "127.0.0.1:8080" {
+		t.Fatalf("listeners = %+v %+v", c.SOCKS5, c.HTTP)
+	}
+}
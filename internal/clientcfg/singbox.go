@@ -0,0 +1,69 @@
+package clientcfg
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type singBoxConfig struct {
+	Outbounds []singBoxOutbound `json:"outbounds"`
+}
+
+// singBoxOutbound follows the sing-box hysteria2 outbound schema.
+type singBoxOutbound struct {
+	Type        string       `json:"type"`
+	Tag         string       `json:"tag"`
+	Server      string       `json:"server"`
+	ServerPort  int          `json:"server_port"`
+	ServerPorts []string     `json:"server_ports,omitempty"`
+	UpMbps      int          `json:"up_mbps,omitempty"`
+	DownMbps    int          `json:"down_mbps,omitempty"`
+	Password    string       `json:"password"`
+	Obfs        *singBoxObfs `json:"obfs,omitempty"`
+	TLS         singBoxTLS   `json:"tls"`
+}
+
+type singBoxObfs struct {
+	Type     string `json:"type"`
+	Password string `json:"password"`
+}
+
+type singBoxTLS struct {
+	Enabled    bool     `json:"enabled"`
+	ServerName string   `json:"server_name,omitempty"`
+	Insecure   bool     `json:"insecure,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+}
+
+// SingBox renders the hysteria2 outbounds for eps as a sing-box config
+// fragment ({"outbounds": [...]}) ready to merge into a client config.
+// sing-box has no certificate pinning, so Insecure is passed through as-is.
+func SingBox(eps []Endpoint, opts ClientOptions) ([]byte, error) {
+	names := uniqueNames(eps)
+	cfg := singBoxConfig{Outbounds: []singBoxOutbound{}}
+	for i, ep := range eps {
+		out := singBoxOutbound{
+			Type:       "hysteria2",
+			Tag:        names[i],
+			Server:     ep.Host,
+			ServerPort: ep.Port,
+			UpMbps:     opts.UpMbps,
+			DownMbps:   opts.DownMbps,
+			Password:   ep.Auth,
+			TLS:        singBoxTLS{Enabled: true, ServerName: ep.SNI, Insecure: ep.Insecure, ALPN: []string{"h3"}},
+		}
+		if ep.Ports != "" {
+			// sing-box writes port ranges as "from:to".
+			out.ServerPorts = []string{strings.ReplaceAll(ep.Ports, "-", ":")}
+		}
+		if ep.Obfs != "" {
+			out.Obfs = &singBoxObfs{Type: ep.Obfs, Password: ep.ObfsPassword}
+		}
+		cfg.Outbounds = append(cfg.Outbounds, out)
+	}
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
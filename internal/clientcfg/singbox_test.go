@@ -0,0 +1,34 @@
+package clientcfg
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSingBox(t *testing.T) {
+	eps := []Endpoint{
+		{Name: "laptop", Host: "203.0.113.1", Port: 443, Auth: "u1:p", SNI: "www.bing.com", Insecure: true},
+		{Name: "laptop", Host: "203.0.113.1", Port: 443, Ports: "20000-50000", Auth: "u2:p", Obfs: "salamander", ObfsPassword: "o"},
+	}
+	b, err := SingBox(eps, ClientOptions{UpMbps: 20, DownMbps: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg singBoxConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Outbounds) != 2 {
+		t.Fatalf("outbounds = %+v", cfg.Outbounds)
+	}
+	a, c := cfg.Outbounds[0], cfg.Outbounds[1]
+	if a.Type != "hysteria2" || a.Tag != "laptop" || a.ServerPort != 443 || a.Password != "u1:p" || a.UpMbps != 20 || a.DownMbps != 100 {
+		t.Fatalf("outbound 0 = %+v", a)
+	}
+	if !a.TLS.Enabled || a.TLS.ServerName != "www.bing.com" || !a.TLS.Insecure || a.Obfs != nil {
+		t.Fatalf("outbound 0 tls = %+v", a.TLS)
+	}
+	if c.Tag != "laptop-2" || len(c.ServerPorts) != 1 || c.ServerPorts[0] != "20000:50000" || c.Obfs == nil || c.Obfs.Password != "o" {
+		t.Fatalf("outbound 1 = %+v", c)
+	}
+}
@@ -0,0 +1,129 @@
+package clientcfg
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URI renders ep as a hysteria2:// URI following the official URI scheme:
+// the auth string goes into the userinfo (user:pass split at the first
+// colon, each part percent-encoded), the port may be a hopping range and
+// the fragment carries the display name.
+func URI(ep Endpoint) string {
+	var b strings.Builder
+	b.WriteString("hysteria2://")
+	if ep.Auth != "" {
+		user, pass, ok := strings.Cut(ep.Auth, ":")
+		b.WriteString(escapeUserinfo(user))
+		if ok {
+			b.WriteString(":" + escapeUserinfo(pass))
+		}
+		b.WriteString("@")
+	}
+	port := strconv.Itoa(ep.Port)
+	if ep.Ports != "" {
+		port = ep.Ports
+	}
+	b.WriteString(net.JoinHostPort(ep.Host, port))
+	b.WriteString("/")
+	q := url.Values{}
+	if ep.Insecure {
+		q.Set("insecure", "1")
+	}
+	if ep.SNI != "" {
+		q.Set("sni", ep.SNI)
+	}
+	if ep.PinSHA256 != "" {
+		q.Set("pinSHA256", ep.PinSHA256)
+	}
+	if ep.Obfs != "" {
+		q.Set("obfs", ep.Obfs)
+		q.Set("obfs-password", ep.ObfsPassword)
+	}
+	if len(q) > 0 {
+		b.WriteString("?" + q.Encode())
+	}
+	if ep.Name != "" {
+		b.WriteString("#" + url.PathEscape(ep.Name))
+	}
+	return b.String()
+}
+
+// escapeUserinfo percent-encodes everything but RFC 3986 unreserved
+// characters; url.QueryEscape would turn spaces into "+", which clients
+// read back literally.
+func escapeUserinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// ParseURI is the inverse of URI. It also accepts the "hy2://" alias.
+// net/url cannot be used directly because it rejects port ranges.
+func ParseURI(s string) (Endpoint, error) {
+	var ep Endpoint
+	rest, ok := strings.CutPrefix(s, "hysteria2://")
+	if !ok {
+		if rest, ok = strings.CutPrefix(s, "hy2://"); !ok {
+			return ep, fmt.Errorf("not a hysteria2:// URI")
+		}
+	}
+	rest, frag, _ := strings.Cut(rest, "#")
+	rest, query, _ := strings.Cut(rest, "?")
+	authority, _, _ := strings.Cut(rest, "/")
+	var err error
+	if ep.Name, err = url.PathUnescape(frag); err != nil {
+		return ep, fmt.Errorf("fragment: %w", err)
+	}
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		user, pass, hasPass := strings.Cut(authority[:i], ":")
+		if ep.Auth, err = url.PathUnescape(user); err != nil {
+			return ep, fmt.Errorf("userinfo: %w", err)
+		}
+		if hasPass {
+			p, err := url.PathUnescape(pass)
+			if err != nil {
+				return ep, fmt.Errorf("userinfo: %w", err)
+			}
+			ep.Auth += ":" + p
+		}
+		authority = authority[i+1:]
+	}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		// hysteria defaults to 443 when the port is omitted
+		host, port = strings.Trim(authority, "[]"), "443"
+	}
+	if host == "" {
+		return ep, fmt.Errorf("missing host")
+	}
+	ep.Host = host
+	if from, _, isRange := strings.Cut(port, "-"); isRange || strings.Contains(port, ",") {
+		ep.Ports = port
+		from, _, _ = strings.Cut(from, ",")
+		port = from
+	}
+	if ep.Port, err = strconv.Atoi(port); err != nil || ep.Port < 1 || ep.Port > 65535 {
+		return ep, fmt.Errorf("invalid port %q", port)
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return ep, fmt.Errorf("query: %w", err)
+	}
+	ep.Insecure = q.Get("insecure") == "1" || q.Get("insecure") == "true"
+	ep.SNI = q.Get("sni")
+	ep.PinSHA256 = q.Get("pinSHA256")
+	ep.Obfs = q.Get("obfs")
+	ep.ObfsPassword = q.Get("obfs-password")
+	return ep, nil
+}
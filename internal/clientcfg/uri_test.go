@@ -0,0 +1,56 @@
+package clientcfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestURIRoundTrip(t *testing.T) {
+	eps := []Endpoint{
+		{Name: "hk 01/主", Host: "203.0.113.7", Port: 443, Auth: "u1:p a@ss:+%/#?", SNI: "www.bing.com", Insecure: true, PinSHA256: "AB:CD"},
+		{Name: "v6", Host: "2001:db8::1", Port: 20000, Ports: "20000-50000", Auth: "u2:x", Obfs: "salamander", ObfsPassword: "o p&q"},
+		{Name: "plain", Host: "example.com", Port: 8443, Auth: "token-only"},
+	}
+	for _, ep := range eps {
+		s := URI(ep)
+		if strings.Contains(s, " ") {
+			t.Fatalf("unescaped space in %q", s)
+		}
+		got, err := ParseURI(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if got != ep {
+			t.Fatalf("round trip of %q:\n got %+v\nwant %+v", s, got, ep)
+		}
+	}
+}
+
+func TestURIFormat(t *testing.T) {
+	s := URI(Endpoint{Name: "a b", Host: "2001:db8::1", Port: 443, Auth: "u:p w", SNI: "s.example"})
+	if want := "hysteria2://u:p%20w@[2001:db8::1]:443/?sni=s.example#a%20b"; s != want {
+		t.Fatalf("URI = %q, want %q", s, want)
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	ep, err := ParseURI("hy2://secret@example.com/?insecure=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Host != "example.com" || ep.Port != 443 || ep.Auth != "secret" || !ep.Insecure {
+		t.Fatalf("ep = %+v", ep)
+	}
+	ep, err = ParseURI("hysteria2://u:p@[2001:db8::2]:1000,2000-3000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Host != "2001:db8::2" || ep.Port != 1000 || ep.Ports != "1000,2000-3000" {
+		t.Fatalf("ep = %+v", ep)
+	}
+	for _, bad := range []string{"vless://x@h:1", "hysteria2://u@:443/", "hysteria2://u@h:99999/", "hysteria2://u@h:abc/"} {
+		if _, err := ParseURI(bad); err == nil {
+			t.Fatalf("ParseURI(%q) succeeded", bad)
+		}
+	}
+}
@@ -22,7 +22,9 @@ var applyCmd = &cobra.Command{
 			prev, _ := service.SaveConfigPreview(st)
 			fmt.Println(prev)
 		}
-		if err := service.Apply(st, dry); err != nil {
+		m := service.NewManager(st)
+		m.Logf = printStep
+		if err := m.Apply(dry); err != nil {
 			return err
 		}
 		fmt.Println("Applied.")
@@ -30,6 +32,11 @@ var applyCmd = &cobra.Command{
 	},
 }
 
+// printStep prints one line of Apply's report.
+func printStep(format string, args ...any) {
+	fmt.Printf("    "+format+"\n", args...)
+}
+
 func init() {
 	applyCmd.Flags().Bool("dry-run", false, "preview changes without applying")
 }
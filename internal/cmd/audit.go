@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Query and verify the audit log",
+}
+
+var auditLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List audit entries, newest first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+		var q audit.Query
+		q.Action, _ = f.GetString("action")
+		q.User, _ = f.GetString("user")
+		q.Limit, _ = f.GetInt("limit")
+		now := time.Now()
+		for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+			if s, _ := f.GetString(name); s != "" {
+				t, err := systemd.ParseTime(s, now)
+				if err != nil {
+					return fmt.Errorf("--%s: %w", name, err)
+				}
+				*dst = t
+			}
+		}
+		entries, total, err := audit.Read(q)
+		if err != nil {
+			return err
+		}
+		if asJSON, _ := f.GetBool("json"); asJSON {
+			for _, e := range entries {
+				b, _ := json.Marshal(e)
+				fmt.Println(string(b))
+			}
+			return nil
+		}
+		fmt.Printf("%-20s %-12s %-6s %-16s %-26s %s\n", "TIME", "USER", "SOURCE", "IP", "ACTION", "OBJECT / DETAIL")
+		for _, e := range entries {
+			obj := e.Object
+			if e.Detail != "" {
+				obj += " " + e.Detail
+			}
+			if e.Result == "error" {
+				obj += " " + app.Color("failed: "+e.Error, "1;31")
+			}
+			fmt.Printf("%-20s %-12s %-6s %-16s %-26s %s\n", e.Time, e.User, e.Source, e.IP, e.Action, obj)
+			for _, c := range e.Changes {
+				fmt.Printf("    %s: %s -> %s\n", c.Path, orNone(c.Old), orNone(c.New))
+			}
+		}
+		if total > len(entries) {
+			fmt.Printf("(%d of %d matching entries; raise --limit to see more)\n", len(entries), total)
+		}
+		return nil
+	},
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	return v
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the audit log hash chain for modified, removed or reordered entries",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := audit.Verify()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d entries in %d file(s)", r.Entries, r.Files)
+		if r.Legacy > 0 {
+			fmt.Printf(", %d written before hashing (not covered)", r.Legacy)
+		}
+		fmt.Println()
+		if r.Anchor != "" {
+			fmt.Println("Older files were pruned; the chain starts after hash", r.Anchor)
+		}
+		for _, p := range r.Problems {
+			fmt.Println(app.Color("!!", "1;31"), p)
+		}
+		if len(r.Problems) > 0 {
+			return fmt.Errorf("audit log chain is broken (%d problem(s))", len(r.Problems))
+		}
+		fmt.Println(app.Color("OK", "1;32"), "hash chain intact")
+		return nil
+	},
+}
+
+var auditSinkCmd = &cobra.Command{
+	Use:   "sink",
+	Short: "Forward audit entries to journald, a syslog server or an HTTP collector",
+}
+
+var auditSinkLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List audit sinks (tokens masked)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sinks := mustLoadState().Settings.AuditSinks
+		if len(sinks) == 0 {
+			fmt.Println("No audit sinks; entries are only written to", audit.Path)
+			return nil
+		}
+		for i, c := range sinks {
+			var target string
+			switch c.Type {
+			case "syslog":
+				target = fmt.Sprintf("%s://%s facility=%s", orDefault(c.Network, "udp"), c.Addr, orDefault(c.Facility, "authpriv"))
+				if c.CAFile != "" {
+					target += " ca=" + c.CAFile
+				}
+			case "http":
+				target = c.URL
+				if c.Token != "" {
+					target += " (token ***)"
+				}
+			}
+			fmt.Printf("%d  %-8s %s\n", i+1, c.Type, target)
+		}
+		return nil
+	},
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+var auditSinkAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a sink: --type journald | --type syslog --addr host:port [--network udp|tcp|tls] | --type http --url URL [--token]",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		f := cmd.Flags()
+		var c state.AuditSink
+		c.Type, _ = f.GetString("type")
+		c.Network, _ = f.GetString("network")
+		c.Addr, _ = f.GetString("addr")
+		c.Facility, _ = f.GetString("facility")
+		c.CAFile, _ = f.GetString("ca-file")
+		c.URL, _ = f.GetString("url")
+		c.Token, _ = f.GetString("token")
+		// Catch unknown facilities and unreadable CA files before saving.
+		if _, err := audit.SinkFor(c); err != nil {
+			return err
+		}
+		err := service.NewManager(mustLoadState()).UpdateNoApply("audit.sink.add", c.Type, func(st *state.State) error {
+			st.Settings.AuditSinks = append(st.Settings.AuditSinks, c)
+			return settingsProblem(st)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Audit sink added; check it with: hy2mgr audit sink test")
+		return nil
+	},
+}
+
+var auditSinkRmCmd = &cobra.Command{
+	Use:   "rm <number>",
+	Short: "Remove a sink by its number in 'audit sink ls'",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("sink number: %w", err)
+		}
+		return service.NewManager(mustLoadState()).UpdateNoApply("audit.sink.rm", args[0], func(st *state.State) error {
+			if n < 1 || n > len(st.Settings.AuditSinks) {
+				return fmt.Errorf("no audit sink %d", n)
+			}
+			st.Settings.AuditSinks = append(st.Settings.AuditSinks[:n-1], st.Settings.AuditSinks[n:]...)
+			return nil
+		})
+	},
+}
+
+var auditSinkTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Send a test entry to every sink and report the result (not written to the local log)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := mustLoadState()
+		if len(st.Settings.AuditSinks) == 0 {
+			return fmt.Errorf("no audit sinks configured")
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), time.Minute)
+		defer cancel()
+		e := service.DefaultActor.Entry("audit.test", "", nil)
+		errs := audit.Default.SendNow(ctx, e)
+		for i, c := range st.Settings.AuditSinks {
+			name := fmt.Sprintf("%s #%d", c.Type, i+1)
+			if s, err := audit.SinkFor(c); err == nil {
+				name = s.Name()
+			}
+			if err := errs[name]; err != nil {
+				fmt.Println(app.Color("FAIL", "1;31"), name+":", err)
+			} else {
+				fmt.Println(app.Color("OK  ", "1;32"), name)
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d sink(s) failed", len(errs))
+		}
+		return nil
+	},
+}
+
+func init() {
+	auditCmd.AddCommand(auditLsCmd, auditVerifyCmd, auditSinkCmd)
+	auditSinkCmd.AddCommand(auditSinkLsCmd, auditSinkAddCmd, auditSinkRmCmd, auditSinkTestCmd)
+	sf := auditSinkAddCmd.Flags()
+	sf.String("type", "", "journald, syslog or http")
+	sf.String("network", "", "syslog transport: udp (default), tcp or tls")
+	sf.String("addr", "", "syslog server host:port")
+	sf.String("facility", "", "syslog facility, e.g. authpriv (default), auth, local0")
+	sf.String("ca-file", "", "syslog over tls: CA bundle to verify the server with (default: system roots)")
+	sf.String("url", "", "http: collector receiving JSON lines by POST")
+	sf.String("token", "", "http: bearer token")
+	f := auditLsCmd.Flags()
+	f.String("since", "", "start time: RFC 3339, \"2006-01-02 15:04\" or a duration like 24h")
+	f.String("until", "", "end time, same formats as --since")
+	f.String("action", "", "action or action prefix, e.g. node or node.add")
+	f.String("user", "", "only entries by this user")
+	f.Int("limit", 50, "maximum entries to print (0: all)")
+	f.Bool("json", false, "print one JSON object per entry")
+}
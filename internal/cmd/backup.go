@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/backup"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+	"github.com/spf13/cobra"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Create, list and restore full backups (state, key, cert, config, units)",
+}
+
+var backupCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Write a backup archive to " + app.BackupDir + " and prune old ones",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		pass, err := backupPassphrase(cmd)
+		if err != nil {
+			return err
+		}
+		keep, _ := cmd.Flags().GetInt("keep")
+		st := mustLoadState()
+		path, err := backup.Create(st, pass, keep)
+		record("backup.create", path, err)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Backup written:", path)
+		if pass == "" && st.Encryption != nil {
+			fmt.Println(app.Color("!!", "1;33"), "The archive holds the state key unencrypted; keep it as safe as the host or use --passphrase-file.")
+		}
+		return nil
+	},
+}
+
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "Validate a backup archive, put its files in place and apply",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		pass, err := backupPassphrase(cmd)
+		if err != nil {
+			return err
+		}
+		dry, _ := cmd.Flags().GetBool("dry-run")
+		raw, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		a, err := backup.Open(raw, pass)
+		if err != nil {
+			return err
+		}
+		restored, err := a.Check()
+		if err != nil {
+			return fmt.Errorf("backup is not usable: %w", err)
+		}
+		cur := mustLoadState()
+		m := a.Manifest
+		fmt.Printf("Backup of %s taken %s (format v%d): %d nodes\n", m.Host, m.CreatedAt, m.Version, len(restored.Nodes))
+		for _, f := range a.Targets() {
+			dst := f.Path
+			if dst == "" {
+				dst = "state (" + cur.Store().Kind() + " backend)"
+			}
+			fmt.Printf("    %-28s %8d  -> %s\n", f.Name, f.Size, dst)
+		}
+		if dry {
+			fmt.Println("Dry run: nothing changed.")
+			return nil
+		}
+		defer func() { record("backup.restore", args[0], err) }()
+
+		safety, err := backup.Create(cur, "", 0)
+		if err != nil {
+			return fmt.Errorf("back up current files before restoring: %w", err)
+		}
+		fmt.Println("Current files saved to:", safety)
+		restored, err = backup.Restore(a, cur)
+		if err != nil {
+			return err
+		}
+		if _, err := systemd.Systemctl("daemon-reload"); err != nil {
+			fmt.Println("warning: systemctl daemon-reload:", err)
+		}
+		mgr := service.NewManager(restored)
+		mgr.Logf = printStep
+		if err := mgr.Apply(false); err != nil {
+			return fmt.Errorf("files restored but apply failed (previous files: %s): %w", safety, err)
+		}
+		if ok, _ := systemd.IsActive(app.ManagerService); ok {
+			_ = systemd.Restart(app.ManagerService)
+		}
+		fmt.Println("Restored and applied.")
+		return nil
+	},
+}
+
+var backupLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List backup archives, newest first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files, _ := filepath.Glob(filepath.Join(backup.Dir, "hy2mgr-backup-*"))
+		sort.Sort(sort.Reverse(sort.StringSlice(files)))
+		if len(files) == 0 {
+			fmt.Println("No backups in", backup.Dir)
+			return nil
+		}
+		fmt.Printf("%-64s %10s  %s\n", "FILE", "SIZE", "ENCRYPTED")
+		for _, f := range files {
+			fi, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			enc := "no"
+			if strings.HasSuffix(f, ".enc") {
+				enc = "yes"
+			}
+			fmt.Printf("%-64s %10d  %s\n", filepath.Base(f), fi.Size(), enc)
+		}
+		return nil
+	},
+}
+
+var backupPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete all but the newest backup archives",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		keep, _ := cmd.Flags().GetInt("keep")
+		if keep < 1 {
+			return fmt.Errorf("--keep must be at least 1")
+		}
+		return app.PruneFiles(filepath.Join(backup.Dir, "hy2mgr-backup-*"), keep)
+	},
+}
+
+// backupPassphrase reads the archive passphrase from --passphrase-file or
+// HY2MGR_BACKUP_PASSPHRASE; it is empty when neither is set.
+func backupPassphrase(cmd *cobra.Command) (string, error) {
+	if f, _ := cmd.Flags().GetString("passphrase-file"); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		pass := strings.TrimRight(string(b), "\r\n")
+		if pass == "" {
+			return "", fmt.Errorf("%s is empty", f)
+		}
+		return pass, nil
+	}
+	return os.Getenv("HY2MGR_BACKUP_PASSPHRASE"), nil
+}
+
+func init() {
+	backupCmd.AddCommand(backupCreateCmd, backupRestoreCmd, backupLsCmd, backupPruneCmd)
+	for _, c := range []*cobra.Command{backupCreateCmd, backupRestoreCmd} {
+		c.Flags().String("passphrase-file", "", "file holding the archive passphrase (default: $HY2MGR_BACKUP_PASSPHRASE, none)")
+	}
+	backupCreateCmd.Flags().Int("keep", 10, "archives to keep in "+app.BackupDir+" (0 keeps all)")
+	backupPruneCmd.Flags().Int("keep", 10, "archives to keep")
+	backupRestoreCmd.Flags().Bool("dry-run", false, "validate and show what would be restored")
+}
@@ -23,10 +23,14 @@ var certRotateCmd = &cobra.Command{
 		}
 		dry, _ := cmd.Flags().GetBool("dry-run")
 		st := mustLoadState()
-		if err := service.RotateCert(st, dry); err != nil {
-			return err
-		}
-		if err := service.Apply(st, dry); err != nil {
+		if dry {
+			if err := service.RotateCert(st, true); err != nil {
+				return err
+			}
+			if err := service.NewManager(st).Apply(true); err != nil {
+				return err
+			}
+		} else if err := service.NewManager(st).RotateCert(); err != nil {
 			return err
 		}
 		fmt.Println("Rotated.")
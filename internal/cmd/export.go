@@ -5,11 +5,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
-	"github.com/yuzeguitarist/hy2mgr/internal/netutil"
+	"github.com/yuzeguitarist/hy2mgr/internal/clientcfg"
 	"github.com/yuzeguitarist/hy2mgr/internal/qr"
 	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
 	"github.com/spf13/cobra"
 )
 
@@ -20,41 +22,107 @@ var exportCmd = &cobra.Command{
 
 var exportURICmd = &cobra.Command{
 	Use:   "uri",
-	Short: "Print hysteria2 URI for a node",
+	Short: "Print hysteria2 URIs for a node (one per advertised endpoint)",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		id, _ := cmd.Flags().GetString("id")
 		if id == "" {
 			return fmt.Errorf("--id required")
 		}
 		st := mustLoadState()
-		uri, err := service.NodeURI(st, id)
+		uris, err := service.NodeURIs(st, id)
 		if err != nil {
 			return err
 		}
-		fmt.Println(uri)
+		for _, uri := range uris {
+			fmt.Println(uri)
+		}
 		return nil
 	},
 }
 
 var exportQRCmd = &cobra.Command{
 	Use:   "qrcode",
-	Short: "Export QR code for a node URI (PNG or SVG by file extension)",
+	Short: "Export QR code for a node URI (PNG/SVG by extension, --terminal), or a PDF/HTML sheet of cards",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		id, _ := cmd.Flags().GetString("id")
+		tag, _ := cmd.Flags().GetString("tag")
 		out, _ := cmd.Flags().GetString("out")
-		if id == "" || out == "" {
-			return fmt.Errorf("--id and --out required")
+		term, _ := cmd.Flags().GetBool("terminal")
+		caption, _ := cmd.Flags().GetBool("caption")
+		o := qr.DefaultOptions()
+		o.Level, _ = cmd.Flags().GetString("level")
+		o.Size, _ = cmd.Flags().GetInt("size")
+		o.Margin, _ = cmd.Flags().GetInt("margin")
+		o.FG, _ = cmd.Flags().GetString("fg")
+		o.BG, _ = cmd.Flags().GetString("bg")
+		lower := strings.ToLower(out)
+		sheet := strings.HasSuffix(lower, ".pdf") || strings.HasSuffix(lower, ".html")
+		if tag != "" && !sheet {
+			return fmt.Errorf("--tag renders a sheet of cards: --out must end in .pdf or .html")
 		}
-		st := mustLoadState()
-		uri, err := service.NodeURI(st, id)
-		if err != nil {
-			return err
+		if id == "" && tag == "" {
+			return fmt.Errorf("--id (or --tag with a .pdf/.html --out) required")
+		}
+		if !term && out == "" {
+			return fmt.Errorf("--out or --terminal required")
 		}
-		var b []byte
-		if strings.HasSuffix(strings.ToLower(out), ".svg") {
-			b, err = qr.SVG(uri, 6)
+		st := mustLoadState()
+		var nodes []state.Node
+		if tag != "" {
+			nodes = service.SubscriptionNodes(st, state.Subscription{Tag: tag})
+			if len(nodes) == 0 {
+				return fmt.Errorf("no enabled nodes with tag %q", tag)
+			}
 		} else {
-			b, err = qr.PNG(uri, 256)
+			var err error
+			if nodes, err = exportNodes(st, id); err != nil {
+				return err
+			}
+		}
+
+		var (
+			b   []byte
+			err error
+		)
+		switch {
+		case sheet:
+			var cards []qr.Card
+			for _, n := range nodes {
+				uri, err := service.NodeURI(st, n.ID)
+				if err != nil {
+					return err
+				}
+				cards = append(cards, qr.Card{Title: n.Name, Lines: nodeCaption(n)[1:], Content: uri})
+			}
+			if strings.HasSuffix(lower, ".pdf") {
+				b, err = qr.CardsPDF(cards, o)
+			} else {
+				b, err = qr.CardsHTML(cards, o)
+			}
+		default:
+			uri, uerr := service.NodeURI(st, id)
+			if uerr != nil {
+				return uerr
+			}
+			if term {
+				s, err := qr.Terminal(uri, o)
+				if err != nil {
+					return err
+				}
+				fmt.Print(s)
+				fmt.Println(nodes[0].Name)
+				if out == "" {
+					return nil
+				}
+			}
+			if caption {
+				o.Caption = nodeCaption(nodes[0])
+			}
+			if strings.HasSuffix(lower, ".svg") {
+				b, err = qr.SVGWith(uri, o)
+			} else {
+				b, err = qr.PNGWith(uri, o)
+			}
 		}
 		if err != nil {
 			return err
@@ -67,26 +135,137 @@ var exportQRCmd = &cobra.Command{
 	},
 }
 
+// nodeCaption is the text printed with a node's QR code: its name and,
+// when set, its expiry.
+func nodeCaption(n state.Node) []string {
+	lines := []string{n.Name}
+	if t, err := time.Parse(time.RFC3339, n.ExpiresAt); err == nil {
+		lines = append(lines, "Expires "+t.Format("2006-01-02"))
+	}
+	return lines
+}
+
+var exportClashCmd = &cobra.Command{
+	Use:   "clash",
+	Short: "Print a Clash Meta (mihomo) profile for a node (default: all enabled nodes)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, _ := cmd.Flags().GetString("id")
+		st := mustLoadState()
+		nodes, err := exportNodes(st, id)
+		if err != nil {
+			return err
+		}
+		y, err := clientcfg.Clash(service.NodeEndpoints(st, nodes))
+		if err != nil {
+			return err
+		}
+		return writeExport(cmd, y)
+	},
+}
+
+var exportSingBoxCmd = &cobra.Command{
+	Use:   "singbox",
+	Short: "Print sing-box hysteria2 outbounds for a node (default: all enabled nodes)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, _ := cmd.Flags().GetString("id")
+		st := mustLoadState()
+		nodes, err := exportNodes(st, id)
+		if err != nil {
+			return err
+		}
+		b, err := clientcfg.SingBox(service.NodeEndpoints(st, nodes), clientOptions(cmd))
+		if err != nil {
+			return err
+		}
+		return writeExport(cmd, b)
+	},
+}
+
+var exportHy2ClientCmd = &cobra.Command{
+	Use:   "hy2client",
+	Short: "Print an official Hysteria 2 client config.yaml for a node",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, _ := cmd.Flags().GetString("id")
+		if id == "" {
+			return fmt.Errorf("--id required")
+		}
+		st := mustLoadState()
+		ep, err := service.NodeEndpoint(st, id)
+		if err != nil {
+			return err
+		}
+		b, err := clientcfg.Hysteria(ep, clientOptions(cmd))
+		if err != nil {
+			return err
+		}
+		return writeExport(cmd, b)
+	},
+}
+
+func clientOptions(cmd *cobra.Command) clientcfg.ClientOptions {
+	var o clientcfg.ClientOptions
+	o.UpMbps, _ = cmd.Flags().GetInt("up")
+	o.DownMbps, _ = cmd.Flags().GetInt("down")
+	if cmd.Flags().Lookup("socks5") != nil {
+		o.SOCKS5, _ = cmd.Flags().GetString("socks5")
+		o.HTTP, _ = cmd.Flags().GetString("http")
+	}
+	return o
+}
+
+// exportNodes returns the node with id, or every enabled node if id is empty.
+func exportNodes(st *state.State, id string) ([]state.Node, error) {
+	if id == "" {
+		return service.SubscriptionNodes(st, state.Subscription{}), nil
+	}
+	for _, n := range st.Nodes {
+		if n.ID == id {
+			return []state.Node{n}, nil
+		}
+	}
+	return nil, service.ErrNodeNotFound
+}
+
+// writeExport prints b, or writes it to --out when given.
+func writeExport(cmd *cobra.Command, b []byte) error {
+	out, _ := cmd.Flags().GetString("out")
+	if out == "" {
+		fmt.Print(string(b))
+		return nil
+	}
+	if err := os.WriteFile(out, b, 0600); err != nil {
+		return err
+	}
+	fmt.Println("Wrote:", filepath.Clean(out))
+	return nil
+}
+
 var exportSubCmd = &cobra.Command{
 	Use:   "subscription",
-	Short: "Print subscription URL and optionally rotate token",
+	Short: "Print subscription URL and optionally rotate token (global, or per node/tag)",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := app.MustBeRoot(); err != nil {
 			return err
 		}
 		rotate, _ := cmd.Flags().GetBool("rotate")
+		revoke, _ := cmd.Flags().GetBool("revoke")
+		id, _ := cmd.Flags().GetString("id")
+		tag, _ := cmd.Flags().GetString("tag")
 		st := mustLoadState()
+		if id != "" || tag != "" {
+			return exportScopedSubscription(st, id, tag, rotate, revoke)
+		}
+		if revoke {
+			return fmt.Errorf("--revoke needs --id or --tag; rotate the global token instead")
+		}
 		if rotate || st.Subscription.TokenSHA256 == "" {
-			token, path, err := service.SubscriptionRotate(st)
+			token, path, err := service.NewManager(st).SubscriptionRotate()
 			if err != nil {
 				return err
 			}
 			fmt.Println("New token (shown once):", token)
-			base := webURLFromListen(st.Settings.ManageListen)
-			if base == "" {
-				base = "http://" + netutil.PublicIP() + ":3333"
-			}
-			fmt.Println("Subscription URL:", base+path)
+			fmt.Println("Subscription URL:", subscriptionBaseURL(st)+path)
+			fmt.Println("Share page:      ", subscriptionBaseURL(st)+service.SharePath(st, token))
 			return nil
 		}
 		fmt.Println("Token is stored hashed; to show a usable URL, rotate it:")
@@ -95,10 +274,79 @@ var exportSubCmd = &cobra.Command{
 	},
 }
 
+// exportScopedSubscription manages the token of one node or tag without
+// touching any other customer's link.
+func exportScopedSubscription(st *state.State, id, tag string, rotate, revoke bool) error {
+	m := service.NewManager(st)
+	if revoke {
+		if err := m.ScopedSubscriptionRevoke(id, tag); err != nil {
+			return err
+		}
+		fmt.Println("Revoked subscription for", scopeLabel(id, tag))
+		return nil
+	}
+	active := false
+	for _, sub := range service.ScopedSubscriptions(st) {
+		if sub.NodeID == id && sub.Tag == tag {
+			active = true
+		}
+	}
+	if !rotate && active {
+		fmt.Println("Token is stored hashed; to show a usable URL, rotate it:")
+		fmt.Println("  hy2mgr export subscription", scopeFlags(id, tag), "--rotate")
+		return nil
+	}
+	token, path, err := m.ScopedSubscriptionRotate(id, tag)
+	if err != nil {
+		return err
+	}
+	fmt.Println("New token for", scopeLabel(id, tag), "(shown once):", token)
+	fmt.Println("Subscription URL:", subscriptionBaseURL(st)+path)
+	fmt.Println("Share page:      ", subscriptionBaseURL(st)+service.SharePath(st, token))
+	return nil
+}
+
+func scopeLabel(id, tag string) string {
+	if id != "" {
+		return "node " + id
+	}
+	return "tag " + tag
+}
+
+func scopeFlags(id, tag string) string {
+	if id != "" {
+		return "--id " + id
+	}
+	return "--tag " + tag
+}
+
 func init() {
-	exportCmd.AddCommand(exportURICmd, exportQRCmd, exportSubCmd)
+	exportCmd.AddCommand(exportURICmd, exportQRCmd, exportSubCmd, exportClashCmd)
+	exportClashCmd.Flags().String("id", "", "node id (default: all enabled nodes)")
+	exportClashCmd.Flags().String("out", "", "write to file instead of stdout")
+	for _, c := range []*cobra.Command{exportSingBoxCmd, exportHy2ClientCmd} {
+		exportCmd.AddCommand(c)
+		c.Flags().String("out", "", "write to file instead of stdout")
+		c.Flags().Int("up", 0, "upload bandwidth hint in Mbps (0: let the client decide)")
+		c.Flags().Int("down", 0, "download bandwidth hint in Mbps (0: let the client decide)")
+	}
+	exportSingBoxCmd.Flags().String("id", "", "node id (default: all enabled nodes)")
+	exportHy2ClientCmd.Flags().String("id", "", "node id")
+	exportHy2ClientCmd.Flags().String("socks5", "127.0.0.1:1080", "local SOCKS5 listen address")
+	exportHy2ClientCmd.Flags().String("http", "127.0.0.1:8080", "local HTTP proxy listen address")
 	exportURICmd.Flags().String("id", "", "node id")
 	exportQRCmd.Flags().String("id", "", "node id")
-	exportQRCmd.Flags().String("out", "", "output file path (.png or .svg)")
+	exportQRCmd.Flags().String("tag", "", "all enabled nodes with this tag, as a sheet of cards")
+	exportQRCmd.Flags().String("out", "", "output file path (.png, .svg, or .pdf/.html for cards)")
+	exportQRCmd.Flags().Bool("terminal", false, "print the QR code in the terminal (UTF-8 half blocks)")
+	exportQRCmd.Flags().Bool("caption", false, "print node name and expiry under the code (PNG: ASCII only)")
+	exportQRCmd.Flags().String("level", "M", "error correction level: L, M, Q or H")
+	exportQRCmd.Flags().Int("size", 256, "image width in pixels (PNG/SVG)")
+	exportQRCmd.Flags().Int("margin", 4, "quiet zone in modules")
+	exportQRCmd.Flags().String("fg", "#000000", "foreground colour")
+	exportQRCmd.Flags().String("bg", "#ffffff", "background colour")
 	exportSubCmd.Flags().Bool("rotate", false, "rotate token and print the new URL")
+	exportSubCmd.Flags().Bool("revoke", false, "revoke the token of --id/--tag")
+	exportSubCmd.Flags().String("id", "", "per-node token: only this node's URI")
+	exportSubCmd.Flags().String("tag", "", "per-tag token: only nodes with this tag")
 }
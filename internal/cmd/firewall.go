@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/firewall"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var firewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Inspect and reconcile the firewall rules hy2mgr manages",
+}
+
+var firewallStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show recorded, wanted and live firewall rules",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := mustLoadState()
+		fmt.Println("Backend:", firewall.Detect())
+		fmt.Println("iptables persistence:", firewall.DetectPersistence())
+		recorded := service.FirewallRecorded(st)
+		wanted := service.FirewallWanted(st)
+		rules := append([]firewall.Rule(nil), recorded...)
+		for _, r := range wanted {
+			if !firewall.Contains(rules, r) {
+				rules = append(rules, r)
+			}
+		}
+		if len(rules) == 0 {
+			fmt.Println("No rules recorded or wanted.")
+			return nil
+		}
+		fmt.Printf("%-36s %-9s %-7s %s\n", "RULE", "RECORDED", "WANTED", "LIVE")
+		for _, r := range rules {
+			fmt.Printf("%-36s %-9s %-7s %s\n", r, yesNo(firewall.Contains(recorded, r)), yesNo(firewall.Contains(wanted, r)), yesNo(firewall.Present(r)))
+		}
+		return nil
+	},
+}
+
+var firewallSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Open wanted ports and close stale hy2mgr rules",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		dry, _ := cmd.Flags().GetBool("dry-run")
+		return firewallRun("firewall.sync", dry, service.FirewallSync)
+	},
+}
+
+var firewallPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Close every rule hy2mgr recorded and delete its nftables table",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		dry, _ := cmd.Flags().GetBool("dry-run")
+		return firewallRun("firewall.purge", dry, service.FirewallPurge)
+	},
+}
+
+var firewallRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Re-apply the recorded rules (run at boot by " + app.FirewallService + ")",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		msgs, err := firewall.Restore(service.FirewallRecorded(mustLoadState()), false)
+		for _, m := range msgs {
+			fmt.Println(m)
+		}
+		return err
+	},
+}
+
+// firewallRun runs fn against the state and saves the updated rule record;
+// a dry run works on a throwaway clone.
+func firewallRun(action string, dry bool, fn func(st *state.State, dryRun bool) ([]string, error)) error {
+	st := mustLoadState()
+	var msgs []string
+	var err error
+	if dry {
+		msgs, err = fn(st.Clone(), true)
+	} else {
+		// Save the record even when some rule failed: it reflects what is
+		// actually open now.
+		saveErr := service.NewManager(st).UpdateNoApply(action, "", func(st *state.State) error {
+			msgs, err = fn(st, false)
+			return nil
+		})
+		if err == nil {
+			err = saveErr
+		}
+	}
+	for _, m := range msgs {
+		fmt.Println(m)
+	}
+	return err
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func init() {
+	firewallCmd.AddCommand(firewallStatusCmd, firewallSyncCmd, firewallPurgeCmd, firewallRestoreCmd)
+	firewallSyncCmd.Flags().Bool("dry-run", false, "print the commands without running them")
+	firewallPurgeCmd.Flags().Bool("dry-run", false, "print the commands without running them")
+}
@@ -7,10 +7,12 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
 	"github.com/yuzeguitarist/hy2mgr/internal/netutil"
 	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
 	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/bcrypt"
@@ -62,18 +64,17 @@ var installCmd = &cobra.Command{
 			fmt.Println("    password:", pw)
 			fmt.Println(app.Color("==> Subscription URL (shown once):", "1;36"))
 			fmt.Println("    token:", token)
-			subBase := webURLFromListen(st.Settings.ManageListen)
-			if subBase == "" {
-				subBase = "http://" + netutil.PublicIP() + ":3333"
-			}
-			fmt.Println("    url:", subBase+"/sub/"+token)
+			fmt.Println("    url:", subscriptionBaseURL(st)+service.SubscriptionPath(st, token))
 			fmt.Println("    (Rotate later: hy2mgr export subscription --rotate)")
 		}
 
 		fmt.Println(app.Color("==> Applying configuration (idempotent)", "1;34"))
-		if err := service.Apply(st, dry); err != nil {
+		m := service.NewManager(st)
+		m.Logf = printStep
+		if err := m.Apply(dry); err != nil {
 			return err
 		}
+		st = m.State()
 
 		if !dry {
 			if err := app.EnsureDir(app.AuditDir, 0750); err != nil {
@@ -110,7 +111,10 @@ var installCmd = &cobra.Command{
 		fmt.Println(app.Color("Done.", "1;32"))
 		if url := webURLFromListen(st.Settings.ManageListen); url != "" {
 			fmt.Println(app.Color("Web UI:", "1;32"), url)
-			fmt.Println(app.Color("Tip:", "1;33"), "ensure firewall allows TCP/3333")
+			if !st.Settings.ManagePublic {
+				fmt.Println(app.Color("Tip:", "1;33"), "the local firewall is not opened for the web UI; use SSH forwarding, or:")
+				fmt.Println("     hy2mgr settings set --manage-public [--manage-allow <your IP>/32]")
+			}
 		}
 		return nil
 	},
@@ -124,6 +128,10 @@ func versionArg(v string) string {
 }
 
 func webURLFromListen(listen string) string {
+	return urlFromListen("http", listen)
+}
+
+func urlFromListen(scheme, listen string) string {
 	host, port, err := net.SplitHostPort(listen)
 	if err != nil || port == "" {
 		return ""
@@ -134,7 +142,28 @@ func webURLFromListen(listen string) string {
 	if host == "" {
 		host = "YOUR_VPS_IP"
 	}
-	return "http://" + host + ":" + port
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// subscriptionBaseURL is the origin printed in subscription URLs:
+// PublicBaseURL if set, else the subscription listener, else the web UI.
+func subscriptionBaseURL(st *state.State) string {
+	if u := st.Settings.PublicBaseURL; u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	if l := st.Settings.SubscriptionListen; l != "" {
+		scheme := "http"
+		if st.Settings.SubscriptionTLSCert != "" {
+			scheme = "https"
+		}
+		if base := urlFromListen(scheme, l); base != "" {
+			return base
+		}
+	}
+	if base := webURLFromListen(st.Settings.ManageListen); base != "" {
+		return base
+	}
+	return "http://" + netutil.PublicIP() + ":3333"
 }
 
 func installManagerUnit(dry bool) error {
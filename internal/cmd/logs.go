@@ -1,7 +1,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
 	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
@@ -10,18 +15,65 @@ import (
 
 var logsCmd = &cobra.Command{
 	Use:   "logs",
-	Short: "Show recent journal logs for hysteria-server.service",
+	Short: "Show journal logs for hysteria-server.service (filter by level, time, text; --follow to tail)",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		lines, _ := cmd.Flags().GetInt("lines")
-		if lines <= 0 || lines > 5000 {
-			lines = 200
+		f := cmd.Flags()
+		q := systemd.JournalQuery{Unit: app.HysteriaService, MaxPriority: -1}
+		q.Lines, _ = f.GetInt("lines")
+		if q.Lines <= 0 || q.Lines > 5000 {
+			q.Lines = 200
+		}
+		q.Grep, _ = f.GetString("grep")
+		if l, _ := f.GetString("level"); l != "" {
+			p, err := systemd.ParseLevel(l)
+			if err != nil {
+				return err
+			}
+			q.MaxPriority = p
+		}
+		now := time.Now()
+		for name, dst := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+			if s, _ := f.GetString(name); s != "" {
+				t, err := systemd.ParseTime(s, now)
+				if err != nil {
+					return fmt.Errorf("--%s: %w", name, err)
+				}
+				*dst = t
+			}
+		}
+		asJSON, _ := f.GetBool("json")
+		print := func(e systemd.Entry) {
+			if asJSON {
+				b, _ := json.Marshal(e)
+				fmt.Println(string(b))
+				return
+			}
+			fmt.Println(e)
+		}
+
+		if follow, _ := f.GetBool("follow"); follow {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return systemd.JournalFollow(ctx, systemd.DefaultJournal, q, print)
+		}
+		entries, err := systemd.JournalEntries(cmd.Context(), systemd.DefaultJournal, q)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			print(e)
 		}
-		out, _ := systemd.JournalTail(app.HysteriaService, lines)
-		fmt.Println(out)
 		return nil
 	},
 }
 
 func init() {
-	logsCmd.Flags().Int("lines", 200, "number of lines")
+	f := logsCmd.Flags()
+	f.Int("lines", 200, "number of (matching) entries")
+	f.String("level", "", "minimum severity: err, warning, notice, info, debug")
+	f.String("since", "", "start time: RFC 3339, \"2006-01-02 15:04\" or a duration like 2h")
+	f.String("until", "", "end time, same formats as --since")
+	f.String("grep", "", "only messages containing this text (case-insensitive)")
+	f.BoolP("follow", "f", false, "keep printing new entries until interrupted")
+	f.Bool("json", false, "print one JSON object per entry")
 }
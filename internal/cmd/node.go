@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
 	"github.com/yuzeguitarist/hy2mgr/internal/service"
@@ -25,8 +26,9 @@ var nodeAddCmd = &cobra.Command{
 		if strings.TrimSpace(name) == "" {
 			return fmt.Errorf("--name required")
 		}
+		tags, _ := cmd.Flags().GetStringSlice("tag")
 		st := mustLoadState()
-		n, err := service.NodeAdd(st, name, "", "")
+		n, err := service.NewManager(st).NodeAdd(name, "", "", tags...)
 		if err != nil {
 			return err
 		}
@@ -49,7 +51,7 @@ var nodeRmCmd = &cobra.Command{
 			return fmt.Errorf("--id required")
 		}
 		st := mustLoadState()
-		if err := service.NodeDelete(st, id); err != nil {
+		if err := service.NewManager(st).NodeDelete(id); err != nil {
 			return err
 		}
 		fmt.Println("Deleted:", id)
@@ -62,9 +64,9 @@ var nodeLsCmd = &cobra.Command{
 	Short: "List nodes",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		st := mustLoadState()
-		fmt.Printf("%-10s  %-18s  %-8s  %s\n", "ID", "USERNAME", "ENABLED", "NAME")
+		fmt.Printf("%-10s  %-18s  %-8s  %-16s  %s\n", "ID", "USERNAME", "ENABLED", "TAGS", "NAME")
 		for _, n := range st.NodesSorted() {
-			fmt.Printf("%-10s  %-18s  %-8v  %s\n", n.ID, n.Username, n.Enabled, n.Name)
+			fmt.Printf("%-10s  %-18s  %-8v  %-16s  %s\n", n.ID, n.Username, n.Enabled, strings.Join(n.Tags, ","), n.Name)
 		}
 		return nil
 	},
@@ -79,7 +81,7 @@ var nodeDisableCmd = &cobra.Command{
 		}
 		id, _ := cmd.Flags().GetString("id")
 		st := mustLoadState()
-		if err := service.NodeSetEnabled(st, id, false); err != nil {
+		if err := service.NewManager(st).NodeSetEnabled(id, false); err != nil {
 			return err
 		}
 		fmt.Println("Disabled:", id)
@@ -96,7 +98,7 @@ var nodeEnableCmd = &cobra.Command{
 		}
 		id, _ := cmd.Flags().GetString("id")
 		st := mustLoadState()
-		if err := service.NodeSetEnabled(st, id, true); err != nil {
+		if err := service.NewManager(st).NodeSetEnabled(id, true); err != nil {
 			return err
 		}
 		fmt.Println("Enabled:", id)
@@ -113,7 +115,7 @@ var nodeResetCmd = &cobra.Command{
 		}
 		id, _ := cmd.Flags().GetString("id")
 		st := mustLoadState()
-		if err := service.NodeResetPassword(st, id); err != nil {
+		if err := service.NewManager(st).NodeResetPassword(id); err != nil {
 			return err
 		}
 		fmt.Println("Reset password:", id)
@@ -122,9 +124,88 @@ var nodeResetCmd = &cobra.Command{
 	},
 }
 
+var nodeTagCmd = &cobra.Command{
+	Use:   "tag",
+	Short: "Set node tags (used by per-tag subscriptions)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		id, _ := cmd.Flags().GetString("id")
+		tags, _ := cmd.Flags().GetStringSlice("set")
+		st := mustLoadState()
+		if err := service.NewManager(st).NodeSetTags(id, tags); err != nil {
+			return err
+		}
+		fmt.Println("Tagged:", id, strings.Join(tags, ","))
+		return nil
+	},
+}
+
+var nodeSNICmd = &cobra.Command{
+	Use:   "sni",
+	Short: "Override the SNI in a node's URIs (empty restores the global SNI)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		id, _ := cmd.Flags().GetString("id")
+		sni, _ := cmd.Flags().GetString("set")
+		if strings.ContainsAny(sni, "/: ") {
+			return fmt.Errorf("--set must be a hostname")
+		}
+		st := mustLoadState()
+		if err := service.NewManager(st).NodeSetSNI(id, sni); err != nil {
+			return err
+		}
+		fmt.Println("SNI set:", id, sni)
+		fmt.Println("Next: hy2mgr export uri --id", id)
+		return nil
+	},
+}
+
+var nodeLimitCmd = &cobra.Command{
+	Use:   "limit",
+	Short: "Set the quota/expiry shown to subscription clients (informational, not enforced)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		id, _ := cmd.Flags().GetString("id")
+		quotaGB, _ := cmd.Flags().GetFloat64("quota-gb")
+		expire, _ := cmd.Flags().GetString("expire")
+		if quotaGB < 0 {
+			return fmt.Errorf("--quota-gb must not be negative")
+		}
+		if expire != "" {
+			t, err := time.Parse("2006-01-02", expire)
+			if err != nil {
+				if t, err = time.Parse(time.RFC3339, expire); err != nil {
+					return fmt.Errorf("--expire: want YYYY-MM-DD or RFC3339")
+				}
+			}
+			expire = t.UTC().Format(time.RFC3339)
+		}
+		st := mustLoadState()
+		if err := service.NewManager(st).NodeSetLimits(id, int64(quotaGB*(1<<30)), expire); err != nil {
+			return err
+		}
+		fmt.Println("Limits set:", id)
+		return nil
+	},
+}
+
 func init() {
-	nodeCmd.AddCommand(nodeAddCmd, nodeRmCmd, nodeLsCmd, nodeDisableCmd, nodeEnableCmd, nodeResetCmd)
+	nodeCmd.AddCommand(nodeAddCmd, nodeRmCmd, nodeLsCmd, nodeDisableCmd, nodeEnableCmd, nodeResetCmd, nodeTagCmd, nodeLimitCmd, nodeSNICmd)
 	nodeAddCmd.Flags().String("name", "", "node display name")
+	nodeAddCmd.Flags().StringSlice("tag", nil, "tags (repeatable or comma-separated)")
+	nodeTagCmd.Flags().String("id", "", "node id")
+	nodeTagCmd.Flags().StringSlice("set", nil, "replace tags (empty clears)")
+	nodeSNICmd.Flags().String("id", "", "node id")
+	nodeSNICmd.Flags().String("set", "", "SNI hostname (empty: use the global SNI)")
+	nodeLimitCmd.Flags().String("id", "", "node id")
+	nodeLimitCmd.Flags().Float64("quota-gb", 0, "traffic quota in GiB (0 = unlimited)")
+	nodeLimitCmd.Flags().String("expire", "", "expiry date YYYY-MM-DD or RFC3339 (empty = never)")
 	nodeRmCmd.Flags().String("id", "", "node id")
 	nodeDisableCmd.Flags().String("id", "", "node id")
 	nodeEnableCmd.Flags().String("id", "", "node id")
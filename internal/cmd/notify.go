@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/notify"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var notifyCmd = &cobra.Command{
+	Use:   "notify",
+	Short: "Configure alerts (webhook, Telegram, email) and send a test",
+}
+
+// updateNotify edits Settings.Notify, creating it if needed and dropping
+// it again once nothing is configured.
+func updateNotify(action, object string, fn func(n *state.Notify) error) error {
+	if err := app.MustBeRoot(); err != nil {
+		return err
+	}
+	return service.NewManager(mustLoadState()).UpdateNoApply(action, object, func(st *state.State) error {
+		n := st.Settings.Notify
+		if n == nil {
+			n = &state.Notify{}
+		}
+		if err := fn(n); err != nil {
+			return err
+		}
+		st.Settings.Notify = n
+		if len(n.Webhooks) == 0 && n.Telegram == nil && n.SMTP == nil && len(n.Events) == 0 && n.DedupeMinutes == 0 && n.CertWarnDays == 0 {
+			st.Settings.Notify = nil
+		}
+		return settingsProblem(st)
+	})
+}
+
+var notifyShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print alert settings (secrets masked)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		n := mustLoadState().Clone().Settings.Notify
+		if n == nil {
+			fmt.Println("No alert destinations configured.")
+			return nil
+		}
+		mask := func(s *string) {
+			if *s != "" {
+				*s = "***"
+			}
+		}
+		for i := range n.Webhooks {
+			mask(&n.Webhooks[i].Secret)
+		}
+		if n.Telegram != nil {
+			mask(&n.Telegram.BotToken)
+		}
+		if n.SMTP != nil {
+			mask(&n.SMTP.Password)
+		}
+		b, err := json.MarshalIndent(n, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var notifyWebhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "Add (--url, optional --secret) or remove (--rm --url) a JSON webhook",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+		url, _ := f.GetString("url")
+		secret, _ := f.GetString("secret")
+		rm, _ := f.GetBool("rm")
+		err := updateNotify("notify.webhook", url, func(n *state.Notify) error {
+			for i, w := range n.Webhooks {
+				if w.URL == url {
+					n.Webhooks = append(n.Webhooks[:i], n.Webhooks[i+1:]...)
+					break
+				}
+			}
+			if !rm {
+				n.Webhooks = append(n.Webhooks, state.Webhook{URL: url, Secret: secret})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if rm {
+			fmt.Println("Webhook removed:", url)
+		} else {
+			fmt.Println("Webhook saved:", url)
+		}
+		return nil
+	},
+}
+
+var notifyTelegramCmd = &cobra.Command{
+	Use:   "telegram",
+	Short: "Send alerts through a Telegram bot (--token --chat-id), or --rm",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+		rm, _ := f.GetBool("rm")
+		t := &state.Telegram{}
+		t.BotToken, _ = f.GetString("token")
+		t.ChatID, _ = f.GetString("chat-id")
+		t.APIBase, _ = f.GetString("api-base")
+		err := updateNotify("notify.telegram", "", func(n *state.Notify) error {
+			if rm {
+				n.Telegram = nil
+			} else {
+				n.Telegram = t
+			}
+			return nil
+		})
+		if err == nil {
+			fmt.Println("Telegram settings saved.")
+		}
+		return err
+	},
+}
+
+var notifySMTPCmd = &cobra.Command{
+	Use:   "smtp",
+	Short: "Send alerts by email (--addr --from --to [--user --password]), or --rm",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+		rm, _ := f.GetBool("rm")
+		m := &state.SMTP{}
+		m.Addr, _ = f.GetString("addr")
+		m.Username, _ = f.GetString("user")
+		m.Password, _ = f.GetString("password")
+		m.From, _ = f.GetString("from")
+		to, _ := f.GetString("to")
+		m.To = splitList(to)
+		err := updateNotify("notify.smtp", "", func(n *state.Notify) error {
+			if rm {
+				n.SMTP = nil
+			} else {
+				n.SMTP = m
+			}
+			return nil
+		})
+		if err == nil {
+			fmt.Println("SMTP settings saved.")
+		}
+		return err
+	},
+}
+
+var notifyEventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Choose which alerts are sent, how often repeats are allowed and when to warn about the cert",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+		if !f.Changed("set") && !f.Changed("dedupe-minutes") && !f.Changed("cert-warn-days") {
+			fmt.Println("Kinds:", strings.Join(notify.Kinds, ", "))
+			return nil
+		}
+		return updateNotify("notify.events", "", func(n *state.Notify) error {
+			if f.Changed("set") {
+				set, _ := f.GetString("set")
+				n.Events = nil
+				for _, k := range splitList(set) {
+					if k == "all" {
+						continue
+					}
+					known := false
+					for _, kind := range notify.Kinds {
+						known = known || k == kind
+					}
+					if !known {
+						return fmt.Errorf("unknown alert kind %q (want: %s)", k, strings.Join(notify.Kinds, ", "))
+					}
+					n.Events = append(n.Events, k)
+				}
+			}
+			if f.Changed("dedupe-minutes") {
+				n.DedupeMinutes, _ = f.GetInt("dedupe-minutes")
+			}
+			if f.Changed("cert-warn-days") {
+				n.CertWarnDays, _ = f.GetInt("cert-warn-days")
+			}
+			return nil
+		})
+	},
+}
+
+var notifyTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Send a test alert to every destination and report the result",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := mustLoadState()
+		if st.Settings.Notify == nil {
+			return fmt.Errorf("no alert destinations configured")
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), time.Minute)
+		defer cancel()
+		n := &notify.Notifier{Config: func() *state.Notify { return st.Settings.Notify }, Attempts: 1}
+		errs := n.SendNow(ctx, notify.Event{Kind: notify.Test, Title: "Test alert", Text: "If you can read this, hy2mgr alerts work."})
+		for _, s := range notify.SinksFor(st.Settings.Notify) {
+			if err := errs[s.Name()]; err != nil {
+				fmt.Println(app.Color("FAIL", "1;31"), s.Name()+":", err)
+			} else {
+				fmt.Println(app.Color("OK  ", "1;32"), s.Name())
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d destination(s) failed", len(errs))
+		}
+		return nil
+	},
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func init() {
+	notifyCmd.AddCommand(notifyShowCmd, notifyWebhookCmd, notifyTelegramCmd, notifySMTPCmd, notifyEventsCmd, notifyTestCmd)
+	f := notifyWebhookCmd.Flags()
+	f.String("url", "", "endpoint receiving a JSON POST per alert")
+	f.String("secret", "", "HMAC key; signs the body in X-Hy2mgr-Signature: sha256=<hex>")
+	f.Bool("rm", false, "remove the webhook with this URL")
+	f = notifyTelegramCmd.Flags()
+	f.String("token", "", "bot token from @BotFather")
+	f.String("chat-id", "", "chat to post to (user, group or channel ID)")
+	f.String("api-base", "", "Bot API base URL (default https://api.telegram.org)")
+	f.Bool("rm", false, "stop sending to Telegram")
+	f = notifySMTPCmd.Flags()
+	f.String("addr", "", "SMTP server host:port, e.g. smtp.example.com:587")
+	f.String("user", "", "login (omit for an open relay)")
+	f.String("password", "", "password")
+	f.String("from", "", "sender address")
+	f.String("to", "", "comma-separated recipients")
+	f.Bool("rm", false, "stop sending email")
+	f = notifyEventsCmd.Flags()
+	f.String("set", "", "comma-separated kinds to send; \"all\" or empty sends every kind")
+	f.Int("dedupe-minutes", 0, "suppress identical alerts for this long (default 60)")
+	f.Int("cert-warn-days", 0, "warn this many days before the certificate expires (default 14)")
+}
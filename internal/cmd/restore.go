@@ -14,7 +14,7 @@ import (
 
 var restoreCmd = &cobra.Command{
 	Use:   "restore",
-	Short: "Restore /etc/hysteria/config.yaml from a backup created by hy2mgr",
+	Short: "Restore /etc/hysteria/config.yaml from a backup created by hy2mgr (see also: backup restore)",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := app.MustBeRoot(); err != nil {
 			return err
@@ -30,7 +30,7 @@ var restoreCmd = &cobra.Command{
 			backup = filepath.Join(filepath.Dir(app.HysteriaConfigPath), backup)
 		}
 		fmt.Println("Restoring from:", backup)
-		if err := app.CopyFile(backup, app.HysteriaConfigPath, 0640); err != nil {
+		if err := record("restore", backup, app.CopyFile(backup, app.HysteriaConfigPath, 0640)); err != nil {
 			return err
 		}
 		_ = systemd.Restart(app.HysteriaService)
@@ -3,8 +3,13 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/notify"
+	"github.com/yuzeguitarist/hy2mgr/internal/outbox"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
 	"github.com/yuzeguitarist/hy2mgr/internal/state"
 	"github.com/spf13/cobra"
 )
@@ -17,7 +22,14 @@ var (
 )
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// Changes made by commands are audited as the user who ran them.
+	service.DefaultActor = audit.CLI()
+	err := rootCmd.Execute()
+	// Alerts raised by this command (e.g. a failed apply) and copies of its
+	// audit entries are sent in the background; give them a moment before
+	// exiting.
+	outbox.Background.Flush(20 * time.Second)
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -30,9 +42,21 @@ func mustLoadState() *state.State {
 		os.Exit(1)
 	}
 	_ = app.EnsureDir(app.StateDir, 0700)
+	logf := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+	notify.Setup(func() *state.Notify { return st.Settings.Notify }, logf)
+	audit.Setup(func() []state.AuditSink { return st.Settings.AuditSinks }, logf)
 	return st
 }
 
+// record audits a command that changes the system outside the state
+// store, and returns err.
+func record(action, object string, err error) error {
+	audit.Write(service.DefaultActor.Entry(action, object, err))
+	return err
+}
+
 func init() {
 	rootCmd.AddCommand(installCmd)
 	rootCmd.AddCommand(uninstallCmd)
@@ -40,9 +64,15 @@ func init() {
 	rootCmd.AddCommand(logsCmd)
 	rootCmd.AddCommand(applyCmd)
 	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(backupCmd)
 
 	rootCmd.AddCommand(nodeCmd)
 	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(certCmd)
 	rootCmd.AddCommand(webCmd)
+	rootCmd.AddCommand(stateCmd)
+	rootCmd.AddCommand(settingsCmd)
+	rootCmd.AddCommand(firewallCmd)
+	rootCmd.AddCommand(notifyCmd)
+	rootCmd.AddCommand(auditCmd)
 }
@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var settingsCmd = &cobra.Command{
+	Use:   "settings",
+	Short: "Show or change manager settings",
+}
+
+var settingsShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print current settings as JSON",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		b, err := json.MarshalIndent(mustLoadState().Settings, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var settingsSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Change web UI exposure and subscription listener/prefix/base URL (only flags given are changed)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		st := mustLoadState()
+		err := service.NewManager(st).UpdateNoApply("settings.set", "", func(st *state.State) error {
+			f := cmd.Flags()
+			set := func(name string, dst *string) {
+				if f.Changed(name) {
+					*dst, _ = f.GetString(name)
+				}
+			}
+			set("subscription-listen", &st.Settings.SubscriptionListen)
+			set("subscription-tls-cert", &st.Settings.SubscriptionTLSCert)
+			set("subscription-tls-key", &st.Settings.SubscriptionTLSKey)
+			set("public-base-url", &st.Settings.PublicBaseURL)
+			set("metrics-listen", &st.Settings.MetricsListen)
+			set("traffic-stats-listen", &st.Settings.TrafficStatsListen)
+			if f.Changed("manage-public") {
+				st.Settings.ManagePublic, _ = f.GetBool("manage-public")
+			}
+			if f.Changed("manage-allow") {
+				allow, _ := f.GetString("manage-allow")
+				st.Settings.ManageAllowCIDRs = nil
+				for _, c := range strings.Split(allow, ",") {
+					if c = strings.TrimSpace(c); c != "" {
+						if !strings.Contains(c, "/") && strings.Contains(c, ":") {
+							c += "/128"
+						} else if !strings.Contains(c, "/") {
+							c += "/32"
+						}
+						st.Settings.ManageAllowCIDRs = append(st.Settings.ManageAllowCIDRs, c)
+					}
+				}
+			}
+			if f.Changed("subscription-prefix") {
+				p, _ := f.GetString("subscription-prefix")
+				if p == "random" {
+					tok, err := app.RandToken(12)
+					if err != nil {
+						return err
+					}
+					p = "/" + tok
+				}
+				st.Settings.SubscriptionPathPrefix = p
+			}
+			return settingsProblem(st)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Settings saved. Existing subscription URLs change with the prefix/base URL;")
+		fmt.Println("restart the web UI to apply listener changes: systemctl restart", app.ManagerService)
+		f := cmd.Flags()
+		if f.Changed("traffic-stats-listen") {
+			fmt.Println("Run 'hy2mgr apply' to reconfigure hysteria's stats API.")
+		}
+		if f.Changed("manage-public") || f.Changed("manage-allow") || f.Changed("subscription-listen") || f.Changed("metrics-listen") {
+			fmt.Println("==> Updating firewall")
+			return firewallRun("firewall.sync", false, service.FirewallSync)
+		}
+		return nil
+	},
+}
+
+var settingsMetricsTokenCmd = &cobra.Command{
+	Use:   "metrics-token",
+	Short: "Issue (or revoke) the bearer token Prometheus uses to scrape /metrics",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		m := service.NewManager(mustLoadState())
+		if revoke, _ := cmd.Flags().GetBool("revoke"); revoke {
+			if err := m.MetricsTokenRevoke(); err != nil {
+				return err
+			}
+			fmt.Println("Metrics token revoked; /metrics on the web UI now needs a login session.")
+			return firewallRun("firewall.sync", false, service.FirewallSync)
+		}
+		token, err := m.MetricsTokenRotate()
+		if err != nil {
+			return err
+		}
+		fmt.Println("==> Metrics token (shown once; any previous token stops working):")
+		fmt.Println("   ", token)
+		fmt.Println("Prometheus: authorization: { type: Bearer, credentials: <token> }")
+		return firewallRun("firewall.sync", false, service.FirewallSync)
+	},
+}
+
+// settingsProblem reports the first Check failure about settings.
+func settingsProblem(st *state.State) error {
+	for _, p := range st.Check() {
+		if strings.HasPrefix(p, "settings.") || strings.HasPrefix(p, "endpoint ") {
+			return fmt.Errorf("%s", p)
+		}
+	}
+	return nil
+}
+
+var settingsEndpointCmd = &cobra.Command{
+	Use:   "endpoint",
+	Short: "Manage extra addresses advertised to clients (IPv6, domain, alt port)",
+}
+
+var settingsEndpointLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List advertised endpoints",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := mustLoadState()
+		fmt.Printf("%-10s %-28s %-6s %-12s %-20s %s\n", "NAME", "HOST", "PORT", "PORTS", "SNI", "VERIFY-TLS")
+		for _, ep := range st.Settings.Endpoints {
+			port := "-"
+			if ep.Port != 0 {
+				port = fmt.Sprint(ep.Port)
+			}
+			fmt.Printf("%-10s %-28s %-6s %-12s %-20s %v\n", ep.Name, ep.Host, port, ep.Ports, ep.SNI, ep.VerifyTLS)
+		}
+		return nil
+	},
+}
+
+var settingsEndpointAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add or replace an advertised endpoint",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		var ep state.Endpoint
+		f := cmd.Flags()
+		ep.Name, _ = f.GetString("name")
+		ep.Host, _ = f.GetString("host")
+		ep.Port, _ = f.GetInt("port")
+		ep.Ports, _ = f.GetString("ports")
+		ep.SNI, _ = f.GetString("sni")
+		ep.VerifyTLS, _ = f.GetBool("verify-tls")
+		st := mustLoadState()
+		err := service.NewManager(st).UpdateNoApply("settings.endpoint.set", ep.Name, func(st *state.State) error {
+			replaced := false
+			for i := range st.Settings.Endpoints {
+				if st.Settings.Endpoints[i].Name == ep.Name {
+					st.Settings.Endpoints[i], replaced = ep, true
+				}
+			}
+			if !replaced {
+				st.Settings.Endpoints = append(st.Settings.Endpoints, ep)
+			}
+			return settingsProblem(st)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Endpoint saved:", ep.Name)
+		fmt.Println("Nodes now export one extra URI each; check: hy2mgr export uri --id <ID>")
+		return firewallRun("firewall.sync", false, service.FirewallSync)
+	},
+}
+
+var settingsEndpointRmCmd = &cobra.Command{
+	Use:   "rm",
+	Short: "Remove an advertised endpoint",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		name, _ := cmd.Flags().GetString("name")
+		st := mustLoadState()
+		err := service.NewManager(st).UpdateNoApply("settings.endpoint.rm", name, func(st *state.State) error {
+			for i, ep := range st.Settings.Endpoints {
+				if ep.Name == name {
+					st.Settings.Endpoints = append(st.Settings.Endpoints[:i], st.Settings.Endpoints[i+1:]...)
+					return nil
+				}
+			}
+			return fmt.Errorf("no endpoint named %q", name)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Endpoint removed:", name)
+		return firewallRun("firewall.sync", false, service.FirewallSync)
+	},
+}
+
+func init() {
+	settingsCmd.AddCommand(settingsShowCmd, settingsSetCmd, settingsEndpointCmd, settingsMetricsTokenCmd)
+	settingsMetricsTokenCmd.Flags().Bool("revoke", false, "remove the token instead of issuing one")
+	settingsEndpointCmd.AddCommand(settingsEndpointLsCmd, settingsEndpointAddCmd, settingsEndpointRmCmd)
+	settingsEndpointAddCmd.Flags().String("name", "", "short name, appended to the URI fragment (e.g. v6, cdn)")
+	settingsEndpointAddCmd.Flags().String("host", "", "IP address or domain")
+	settingsEndpointAddCmd.Flags().Int("port", 0, "UDP port (default: the listen port)")
+	settingsEndpointAddCmd.Flags().String("ports", "", "port hopping range, e.g. 20000-50000")
+	settingsEndpointAddCmd.Flags().String("sni", "", "SNI for this endpoint (default: node/global SNI)")
+	settingsEndpointAddCmd.Flags().Bool("verify-tls", false, "host has a publicly trusted certificate: omit insecure=1 and the pin")
+	settingsEndpointRmCmd.Flags().String("name", "", "endpoint name")
+	f := settingsSetCmd.Flags()
+	f.String("subscription-listen", "", "separate listener serving only subscriptions, e.g. 0.0.0.0:8443 (empty: serve from the web UI)")
+	f.String("subscription-tls-cert", "", "PEM certificate for the subscription listener (enables HTTPS)")
+	f.String("subscription-tls-key", "", "PEM private key for the subscription listener")
+	f.String("subscription-prefix", "", "secret path prefix before /sub/, e.g. /k3x9; \"random\" generates one; empty removes it")
+	f.String("public-base-url", "", "origin printed in subscription URLs, e.g. https://sub.example.com (empty: derive from listener)")
+	f.String("metrics-listen", "", "separate listener serving only /metrics, e.g. 0.0.0.0:9101 (empty: serve from the web UI)")
+	f.String("traffic-stats-listen", "", "loopback address for hysteria's traffic stats API, e.g. 127.0.0.1:25413 (empty disables per-node metrics)")
+	f.Bool("manage-public", false, "open the web UI's TCP port in the local firewall")
+	f.String("manage-allow", "", "comma-separated IPs/CIDRs allowed to reach the web UI port (empty: anyone)")
+}
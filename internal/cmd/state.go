@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/spf13/cobra"
+)
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspect and maintain hy2mgr state storage",
+}
+
+var stateMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move state to another storage backend (json or sqlite)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		to, _ := cmd.Flags().GetString("to")
+		st := mustLoadState()
+		from := st.Store()
+		if from.Kind() == to {
+			fmt.Println("State already uses the", to, "backend.")
+			return nil
+		}
+		dst, err := state.OpenStoreKind(to)
+		if err != nil {
+			return err
+		}
+		if err := dst.Save(st); err != nil {
+			_ = dst.Close()
+			return fmt.Errorf("write %s state: %w", to, err)
+		}
+		check, err := dst.Load()
+		if err != nil || len(check.Nodes) != len(st.Nodes) {
+			_ = dst.Close()
+			return fmt.Errorf("verify %s state failed (nodes %d), source left untouched: %v", to, len(st.Nodes), err)
+		}
+		_ = dst.Close()
+		_ = from.Close()
+
+		// Retire the old backend so OpenStore picks the new one.
+		for _, p := range retiredPaths(from.Kind()) {
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+			moved := filepath.Join(app.StateBackups, filepath.Base(p)+"."+app.NowRFC3339()+".migrated")
+			if err := os.Rename(p, moved); err != nil {
+				return fmt.Errorf("retire %s: %w", p, err)
+			}
+			fmt.Println("Moved old state:", moved)
+		}
+		record("state.migrate", to, nil)
+		fmt.Printf("Migrated state (%d nodes) to %s.\n", len(st.Nodes), to)
+		fmt.Println("Restart the web UI to pick it up: systemctl restart", app.ManagerService)
+		return nil
+	},
+}
+
+var stateCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate state invariants (unique IDs/usernames, port range, URLs)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := mustLoadState()
+		problems := st.Check()
+		fmt.Printf("State: %s backend, version %d, revision %d, %d nodes\n", st.Store().Kind(), st.Version, st.Revision, len(st.Nodes))
+		if len(problems) == 0 {
+			fmt.Println(app.Color("OK", "1;32"))
+			return nil
+		}
+		for _, p := range problems {
+			fmt.Println(app.Color("!!", "1;31"), p)
+		}
+		return fmt.Errorf("%d problem(s) found", len(problems))
+	},
+}
+
+var stateRekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Encrypt secrets in state with a new key file (enables encryption on first use)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.MustBeRoot(); err != nil {
+			return err
+		}
+		plaintext, _ := cmd.Flags().GetBool("plaintext")
+		st := mustLoadState()
+		action := "state.rekey"
+		if plaintext {
+			action = "state.decrypt"
+		}
+		if err := record(action, "", state.Rekey(st, plaintext)); err != nil {
+			return err
+		}
+		if plaintext {
+			fmt.Println("Secrets are now stored in plaintext.")
+		} else {
+			fmt.Println("Secrets encrypted with new key:", state.KeyPath, "(key id "+st.Encryption.KeyID+")")
+			fmt.Println("Keep a copy of the key with your backups; state cannot be read without it.")
+			fmt.Println("Backups written before encryption was enabled still hold plaintext:", app.StateBackups)
+		}
+		return nil
+	},
+}
+
+func retiredPaths(kind string) []string {
+	if kind == state.KindSQLite {
+		return []string{app.StateDBPath, app.StateDBPath + "-wal", app.StateDBPath + "-shm"}
+	}
+	return []string{app.StatePath}
+}
+
+func init() {
+	stateCmd.AddCommand(stateMigrateCmd, stateCheckCmd, stateRekeyCmd)
+	stateRekeyCmd.Flags().Bool("plaintext", false, "decrypt secrets and disable encryption")
+	stateMigrateCmd.Flags().String("to", state.KindSQLite, "target backend: json or sqlite")
+}
@@ -5,6 +5,8 @@ import (
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
 	"github.com/yuzeguitarist/hy2mgr/internal/crypto"
+	"github.com/yuzeguitarist/hy2mgr/internal/firewall"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
 	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
 	"github.com/spf13/cobra"
 )
@@ -26,6 +28,17 @@ var statusCmd = &cobra.Command{
 		fmt.Println("\n== hy2mgr.service ==")
 		out2, _ := systemd.Status(app.ManagerService)
 		fmt.Println(out2)
+
+		fmt.Println("\n== firewall ==")
+		recorded := service.FirewallRecorded(st)
+		fmt.Printf("Backend: %s, %d rules recorded\n", firewall.Detect(), len(recorded))
+		if missing := firewall.Missing(recorded); len(missing) > 0 {
+			fmt.Println(app.Color("!! recorded but missing from the live ruleset:", "1;31"))
+			for _, r := range missing {
+				fmt.Println("   ", r)
+			}
+			fmt.Println("   fix: sudo hy2mgr firewall sync")
+		}
 		return nil
 	},
 }
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
 	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
 	"github.com/spf13/cobra"
 )
@@ -13,12 +14,16 @@ import (
 var uninstallCmd = &cobra.Command{
 	Use:   "uninstall",
 	Short: "Uninstall hysteria2 (official script --remove) and optionally remove hy2mgr state",
-	RunE: func(cmd *cobra.Command, args []string) error {
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		if err := app.MustBeRoot(); err != nil {
 			return err
 		}
 		purge, _ := cmd.Flags().GetBool("purge")
 		dry, _ := cmd.Flags().GetBool("dry-run")
+		// --purge deletes the audit log along with everything else.
+		if !dry && !purge {
+			defer func() { record("uninstall", "", err) }()
+		}
 
 		fmt.Println("==> Stopping services")
 		if dry {
@@ -41,6 +46,11 @@ var uninstallCmd = &cobra.Command{
 			}
 		}
 
+		fmt.Println("==> Removing firewall rules")
+		if err := firewallRun("firewall.purge", dry, service.FirewallPurge); err != nil {
+			fmt.Println(app.Color("!! firewall:", "1;31"), err)
+		}
+
 		fmt.Println("==> Removing hy2mgr unit")
 		if !dry {
 			_ = os.Remove("/etc/systemd/system/" + app.ManagerService)
@@ -6,6 +6,9 @@ import (
 	"time"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/notify"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
 	"github.com/yuzeguitarist/hy2mgr/internal/state"
 	"github.com/yuzeguitarist/hy2mgr/internal/web"
 	"github.com/spf13/cobra"
@@ -46,7 +49,31 @@ var webCmd = &cobra.Command{
 		}
 		// session key derived from state path (not secret but stable) + random in state would be better for prod
 		sk := []byte("change-me-" + app.StatePath)
+		// Requests act as the logged-in admin; what the server does on its
+		// own is not the doing of whoever started it.
+		service.DefaultActor = audit.System
 		srv := web.NewServer(st, sk)
+		srv.Svc.Logf = func(format string, args ...any) {
+			fmt.Printf("apply: "+format+"\n", args...)
+		}
+
+		logf := func(format string, args ...any) {
+			fmt.Println(app.Color("!! "+fmt.Sprintf(format, args...), "1;31"))
+		}
+		notify.Setup(func() *state.Notify { return srv.Svc.State().Settings.Notify }, logf)
+		audit.Setup(func() []state.AuditSink { return srv.Svc.State().Settings.AuditSinks }, logf)
+		notify.WatchAudit()
+		go service.NewHealth(srv.Svc).Run(cmd.Context(), time.Minute)
+
+		// Pick up changes saved by CLI commands while we run.
+		go func() {
+			err := srv.Svc.Watch(cmd.Context(), func(err error) {
+				fmt.Println(app.Color("!! reload state:", "1;31"), err)
+			})
+			if err != nil {
+				fmt.Println(app.Color("!! state watcher stopped:", "1;31"), err)
+			}
+		}()
 
 		httpSrv := &http.Server{
 			Addr:              listen,
@@ -54,11 +81,39 @@ var webCmd = &cobra.Command{
 			ReadHeaderTimeout: 5 * time.Second,
 		}
 
+		errc := make(chan error, 3)
+		if set := st.Settings; set.SubscriptionListen != "" {
+			subSrv := &http.Server{
+				Addr:              set.SubscriptionListen,
+				Handler:           srv.SubscriptionRouter(),
+				ReadHeaderTimeout: 5 * time.Second,
+			}
+			fmt.Println(app.Color("Subscriptions:", "1;34"), set.SubscriptionListen)
+			go func() {
+				if set.SubscriptionTLSCert != "" {
+					errc <- subSrv.ListenAndServeTLS(set.SubscriptionTLSCert, set.SubscriptionTLSKey)
+					return
+				}
+				errc <- subSrv.ListenAndServe()
+			}()
+		}
+
+		if l := st.Settings.MetricsListen; l != "" {
+			metricsSrv := &http.Server{
+				Addr:              l,
+				Handler:           srv.MetricsRouter(),
+				ReadHeaderTimeout: 5 * time.Second,
+			}
+			fmt.Println(app.Color("Metrics:", "1;34"), l)
+			go func() { errc <- metricsSrv.ListenAndServe() }()
+		}
+
 		fmt.Println(app.Color("Listening:", "1;34"), listen)
 		if url := webURLFromListen(listen); url != "" {
 			fmt.Println(app.Color("Web UI:", "1;32"), url)
 		}
-		return httpSrv.ListenAndServe()
+		go func() { errc <- httpSrv.ListenAndServe() }()
+		return <-errc
 	},
 }
 
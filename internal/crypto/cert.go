@@ -110,3 +110,20 @@ func ParseCertPin(certPath string) (string, error) {
 	}
 	return strings.Join(parts, ":"), nil
 }
+
+// ParseCertNotAfter returns the expiry of the first certificate in certPath.
+func ParseCertNotAfter(certPath string) (time.Time, error) {
+	b, err := os.ReadFile(certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("invalid PEM: %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
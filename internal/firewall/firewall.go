@@ -3,7 +3,6 @@ package firewall
 import (
 	"fmt"
 	"regexp"
-	"strconv"
 	"strings"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
@@ -15,9 +14,16 @@ const (
 	BackendUFW      Backend = "ufw"
 	BackendFirewalld Backend = "firewalld"
 	BackendIptables Backend = "iptables"
+	BackendNftables Backend = "nftables"
+	// Mirror of the iptables rules for IPv6; never detected on its own.
+	BackendIp6tables Backend = "ip6tables"
 	BackendNone     Backend = "none"
 )
 
+// Comment tags the rules hy2mgr creates (ufw, iptables) so they can be
+// told apart from rules the administrator added for the same port.
+const Comment = "hy2mgr"
+
 func Detect() Backend {
 	if app.CommandExists("ufw") {
 		return BackendUFW
@@ -25,84 +31,470 @@ func Detect() Backend {
 	if app.CommandExists("firewall-cmd") {
 		return BackendFirewalld
 	}
+	if app.CommandExists("nft") {
+		return BackendNftables
+	}
 	if app.CommandExists("iptables") {
 		return BackendIptables
 	}
 	return BackendNone
 }
 
-func EnsureUDPPortOpen(port int, dryRun bool) (Backend, string, error) {
-	b := Detect()
-	switch b {
+// Ports is what hy2mgr wants reachable. Entries are a single port ("443")
+// or an inclusive range ("20000-50000").
+type Ports struct {
+	UDP   []string
+	Hop   []string // UDP port hopping ranges, redirected to HopTo
+	HopTo int
+	TCP   []string
+	// TCPAllow ports accept connections only from the Allow CIDRs.
+	TCPAllow []string
+	Allow    []string
+}
+
+// Rule is one port opened through one backend.
+type Rule struct {
+	Backend  Backend
+	Proto    string // "udp" or "tcp"
+	Spec     string // "443" or "20000-50000"
+	Redirect int    // hop range redirected to this port; nftables only
+	Source   string // CIDR allowed to connect; "" = anyone
+	Comment  string
+}
+
+func (r Rule) String() string {
+	s := r.Proto + "/" + r.Spec
+	if r.Redirect > 0 {
+		s += fmt.Sprintf(" -> %d", r.Redirect)
+	}
+	if r.Source != "" {
+		s += " from " + r.Source
+	}
+	return s + " (" + string(r.Backend) + ")"
+}
+
+// same compares what a rule opens, ignoring the comment.
+func (r Rule) same(o Rule) bool {
+	return r.Backend == o.Backend && r.Proto == o.Proto && r.Spec == o.Spec && r.Redirect == o.Redirect && r.Source == o.Source
+}
+
+// Contains reports whether rules opens the same port as r.
+func Contains(rules []Rule, r Rule) bool {
+	for _, o := range rules {
+		if o.same(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules expands p into the rules backend b should hold. For iptables every
+// rule is mirrored with ip6tables when it is installed; the other backends
+// cover both families with one rule.
+func Rules(b Backend, p Ports) []Rule {
+	if b == BackendNone {
+		return nil
+	}
+	rules := expand(b, p)
+	if b == BackendIptables && app.CommandExists("ip6tables") {
+		rules = append(rules, expand(BackendIp6tables, p)...)
+	}
+	return rules
+}
+
+func expand(b Backend, p Ports) []Rule {
+	var rules []Rule
+	for _, spec := range p.UDP {
+		rules = append(rules, Rule{Backend: b, Proto: "udp", Spec: spec, Comment: Comment})
+	}
+	for _, spec := range p.Hop {
+		rules = append(rules, Rule{Backend: b, Proto: "udp", Spec: spec, Redirect: p.HopTo, Comment: Comment})
+	}
+	for _, spec := range p.TCP {
+		rules = append(rules, Rule{Backend: b, Proto: "tcp", Spec: spec, Comment: Comment})
+	}
+	for _, spec := range p.TCPAllow {
+		for _, cidr := range p.Allow {
+			v6 := strings.Contains(cidr, ":")
+			if (b == BackendIptables && v6) || (b == BackendIp6tables && !v6) {
+				continue
+			}
+			rules = append(rules, Rule{Backend: b, Proto: "tcp", Spec: spec, Source: cidr, Comment: Comment})
+		}
+	}
+	return rules
+}
+
+// Sync opens want and closes the rules in have (what hy2mgr recorded
+// earlier) that are no longer wanted. It returns the rules hy2mgr owns
+// afterwards, to be recorded in place of have, even when it fails part
+// way. Ports that were already open by other means are not claimed.
+func Sync(want, have []Rule, dryRun bool) ([]Rule, []string, error) {
+	var owned []Rule
+	var msgs []string
+	var firstErr error
+	iptChanged := false
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+		msgs = append(msgs, "error: "+err.Error())
+	}
+
+	var wantNft []Rule
+	for _, r := range want {
+		if r.Backend == BackendNftables {
+			wantNft = append(wantNft, r)
+		}
+	}
+	staleNft := false
+	for _, r := range have {
+		if Contains(want, r) {
+			continue
+		}
+		if r.Backend == BackendNftables {
+			// Replacing the table drops it; only a table with nothing
+			// left to hold needs deleting.
+			staleNft = staleNft || len(wantNft) == 0
+			continue
+		}
+		if isIptables(r) && Present(r) {
+			iptChanged = true
+		}
+		msg, err := remove(r, dryRun)
+		if err != nil {
+			owned = append(owned, r) // retried on the next sync
+			fail(fmt.Errorf("remove %s: %w", r, err))
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if staleNft {
+		msg, err := removeNftables(dryRun)
+		if err != nil {
+			fail(err)
+		} else {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	if len(wantNft) > 0 {
+		msg, err := ensureNftables(wantNft, dryRun)
+		if err != nil {
+			fail(err)
+			// the old table, if any, is still in place
+			for _, r := range have {
+				if r.Backend == BackendNftables {
+					owned = append(owned, r)
+				}
+			}
+		} else {
+			msgs = append(msgs, msg)
+			owned = append(owned, wantNft...)
+		}
+	}
+	hopNote := false
+	for _, r := range want {
+		if r.Backend == BackendNftables {
+			continue
+		}
+		if r.Redirect > 0 {
+			hopNote = true
+		}
+		if isIptables(r) && !Present(r) {
+			iptChanged = true
+		}
+		created, msg, err := ensure(r, dryRun)
+		if err != nil {
+			if Contains(have, r) {
+				owned = append(owned, r)
+			}
+			fail(fmt.Errorf("open %s: %w", r, err))
+			continue
+		}
+		msgs = append(msgs, msg)
+		if created || Contains(have, r) {
+			owned = append(owned, r)
+		}
+	}
+	if hopNote {
+		msgs = append(msgs, "Port hopping redirect is only managed with nftables; add the DNAT rule yourself.")
+	}
+	if iptChanged {
+		if msg, err := saveIptables(dryRun); err != nil {
+			fail(err)
+		} else {
+			msgs = append(msgs, msg)
+		}
+	}
+	return owned, msgs, firstErr
+}
+
+// Purge closes every rule in have and deletes the nftables table.
+func Purge(have []Rule, dryRun bool) ([]string, error) {
+	var msgs []string
+	var firstErr error
+	iptChanged := false
+	for _, r := range have {
+		if r.Backend == BackendNftables {
+			continue
+		}
+		if isIptables(r) && Present(r) {
+			iptChanged = true
+		}
+		msg, err := remove(r, dryRun)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("remove %s: %w", r, err)
+			}
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if iptChanged {
+		msg, err := saveIptables(dryRun)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		} else if err == nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	if app.CommandExists("nft") {
+		msg, err := removeNftables(dryRun)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, firstErr
+}
+
+// Present reports whether r is in the live ruleset.
+func Present(r Rule) bool {
+	switch r.Backend {
+	case BackendNftables:
+		return nftPresent(r)
 	case BackendUFW:
-		msg, err := ensureUFW(port, dryRun)
-		return b, msg, err
+		out, _, _ := app.Exec("ufw", "status")
+		return ufwLine(out, r) != ""
 	case BackendFirewalld:
-		msg, err := ensureFirewalld(port, dryRun)
-		return b, msg, err
-	case BackendIptables:
-		msg, err := ensureIptables(port, dryRun)
-		return b, msg, err
-	default:
-		return b, "No supported firewall backend detected; skipped local firewall rules.", nil
+		return firewalldHas(r)
+	case BackendIptables, BackendIp6tables:
+		out, _, _ := app.Exec(string(r.Backend), "-S", "INPUT")
+		return strings.Contains(out, iptablesSpec(r, true)) || strings.Contains(out, iptablesSpec(r, false))
 	}
+	return false
 }
 
-func ensureUFW(port int, dryRun bool) (string, error) {
+func ensure(r Rule, dryRun bool) (bool, string, error) {
+	switch r.Backend {
+	case BackendUFW:
+		return ensureUFW(r, dryRun)
+	case BackendFirewalld:
+		return ensureFirewalld(r, dryRun)
+	case BackendIptables, BackendIp6tables:
+		return ensureIptables(r, dryRun)
+	}
+	return false, "No supported firewall backend detected; skipped local firewall rules.", nil
+}
+
+func remove(r Rule, dryRun bool) (string, error) {
+	if !Present(r) {
+		return r.String() + " already gone.", nil
+	}
+	switch r.Backend {
+	case BackendUFW:
+		return removeUFW(r, dryRun)
+	case BackendFirewalld:
+		return removeFirewalld(r, dryRun)
+	case BackendIptables, BackendIp6tables:
+		return removeIptables(r, dryRun)
+	}
+	return fmt.Sprintf("%s: backend no longer supported; skipped.", r), nil
+}
+
+func ufwRule(r Rule) string {
+	return strings.Replace(r.Spec, "-", ":", 1) + "/" + r.Proto
+}
+
+// ufwArgs is the rule in ufw's full syntax, as taken by "allow" and
+// "delete allow".
+func ufwArgs(r Rule) []string {
+	if r.Source == "" {
+		return []string{ufwRule(r)}
+	}
+	return []string{"proto", r.Proto, "from", nftAddr(r.Source), "to", "any", "port", strings.Replace(r.Spec, "-", ":", 1)}
+}
+
+// ufwLine returns the "ufw status" line for r, if any.
+func ufwLine(status string, r Rule) string {
+	for _, l := range strings.Split(status, "\n") {
+		f := strings.Fields(l)
+		if len(f) == 0 || f[0] != ufwRule(r) {
+			continue
+		}
+		if r.Source == "" && strings.Contains(l, "Anywhere") {
+			return l
+		}
+		for _, x := range f[1:] {
+			if r.Source != "" && x == nftAddr(r.Source) {
+				return l
+			}
+		}
+	}
+	return ""
+}
+
+func ensureUFW(r Rule, dryRun bool) (bool, string, error) {
 	out, _, _ := app.Exec("ufw", "status")
 	if strings.Contains(out, "Status: inactive") {
-		return "UFW detected but inactive; skipped.", nil
+		return false, "UFW detected but inactive; skipped.", nil
 	}
-	rule := fmt.Sprintf("%d/udp", port)
-	if strings.Contains(out, rule) {
-		return "UFW rule already present.", nil
+	rule := strings.Join(ufwArgs(r), " ")
+	if l := ufwLine(out, r); l != "" {
+		return strings.Contains(l, "# "+r.Comment), "UFW rule " + rule + " already present.", nil
 	}
 	if dryRun {
-		return fmt.Sprintf("[dry-run] ufw allow %d/udp", port), nil
+		return true, "[dry-run] ufw allow " + rule + " comment " + r.Comment, nil
 	}
-	_, _, err := app.Exec("ufw", "allow", rule)
-	return fmt.Sprintf("UFW allow %s added.", rule), err
+	_, _, err := app.Exec("ufw", append(append([]string{"allow"}, ufwArgs(r)...), "comment", r.Comment)...)
+	return err == nil, fmt.Sprintf("UFW allow %s added.", rule), err
 }
 
-func ensureFirewalld(port int, dryRun bool) (string, error) {
-	out, _, _ := app.Exec("firewall-cmd", "--state")
-	if strings.TrimSpace(out) != "running" {
-		return "firewalld detected but not running; skipped.", nil
+func removeUFW(r Rule, dryRun bool) (string, error) {
+	rule := strings.Join(ufwArgs(r), " ")
+	if dryRun {
+		return "[dry-run] ufw delete allow " + rule, nil
+	}
+	if out, _, err := app.Exec("ufw", append([]string{"delete", "allow"}, ufwArgs(r)...)...); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(out))
+	}
+	return "UFW allow " + rule + " removed.", nil
+}
+
+// firewalldRich is the rich rule for a source-restricted port, as
+// "firewall-cmd --list-rich-rules" prints it.
+func firewalldRich(r Rule) string {
+	family := "ipv4"
+	if strings.Contains(r.Source, ":") {
+		family = "ipv6"
+	}
+	return fmt.Sprintf(`rule family="%s" source address="%s" port port="%s" protocol="%s" accept`, family, r.Source, r.Spec, r.Proto)
+}
+
+// firewalldArgs adds or removes r (op "add" or "remove").
+func firewalldArgs(op string, r Rule) []string {
+	if r.Source != "" {
+		return []string{"--permanent", "--" + op + "-rich-rule", firewalldRich(r)}
+	}
+	return []string{"--permanent", "--" + op + "-port", r.Spec + "/" + r.Proto}
+}
+
+func firewalldHas(r Rule) bool {
+	if r.Source != "" {
+		rich, _, _ := app.Exec("firewall-cmd", "--list-rich-rules")
+		for _, l := range strings.Split(rich, "\n") {
+			if strings.TrimSpace(l) == firewalldRich(r) {
+				return true
+			}
+		}
+		return false
 	}
-	// list ports
 	lp, _, _ := app.Exec("firewall-cmd", "--list-ports")
-	re := regexp.MustCompile(`\b(\d+)/(tcp|udp)\b`)
-	matches := re.FindAllStringSubmatch(lp, -1)
-	for _, m := range matches {
-		p, _ := strconv.Atoi(m[1])
-		if p == port && m[2] == "udp" {
-			return "firewalld port already open.", nil
+	re := regexp.MustCompile(`\b(\d+(?:-\d+)?)/(tcp|udp)\b`)
+	for _, m := range re.FindAllStringSubmatch(lp, -1) {
+		if m[1] == r.Spec && m[2] == r.Proto {
+			return true
 		}
 	}
+	return false
+}
+
+// firewalld has no rule comments: a port that is already open is left
+// alone and not claimed.
+func ensureFirewalld(r Rule, dryRun bool) (bool, string, error) {
+	out, _, _ := app.Exec("firewall-cmd", "--state")
+	if strings.TrimSpace(out) != "running" {
+		return false, "firewalld detected but not running; skipped.", nil
+	}
+	if firewalldHas(r) {
+		return false, "firewalld " + r.String() + " already open.", nil
+	}
+	args := firewalldArgs("add", r)
 	if dryRun {
-		return fmt.Sprintf("[dry-run] firewall-cmd --permanent --add-port=%d/udp && firewall-cmd --reload", port), nil
+		return true, fmt.Sprintf("[dry-run] firewall-cmd %s && firewall-cmd --reload", strings.Join(args, " ")), nil
 	}
-	_, _, err := app.Exec("firewall-cmd", "--permanent", "--add-port", fmt.Sprintf("%d/udp", port))
+	_, _, err := app.Exec("firewall-cmd", args...)
 	if err != nil {
-		return "", err
+		return false, "", err
 	}
 	_, _, err = app.Exec("firewall-cmd", "--reload")
-	return "firewalld rule added and reloaded.", err
+	return true, "firewalld " + r.String() + " added and reloaded.", err
+}
+
+func removeFirewalld(r Rule, dryRun bool) (string, error) {
+	args := firewalldArgs("remove", r)
+	if dryRun {
+		return fmt.Sprintf("[dry-run] firewall-cmd %s && firewall-cmd --reload", strings.Join(args, " ")), nil
+	}
+	if _, _, err := app.Exec("firewall-cmd", args...); err != nil {
+		return "", err
+	}
+	_, _, err := app.Exec("firewall-cmd", "--reload")
+	return "firewalld " + r.String() + " removed.", err
 }
 
-func ensureIptables(port int, dryRun bool) (string, error) {
+// iptablesSpec is the rule as "iptables -S" prints it, with or without
+// hy2mgr's comment.
+func iptablesSpec(r Rule, tagged bool) string {
+	dport := strings.Replace(r.Spec, "-", ":", 1)
+	s := fmt.Sprintf("-p %s -m %s --dport %s", r.Proto, r.Proto, dport)
+	if r.Source != "" {
+		s = "-s " + r.Source + " " + s
+	}
+	if tagged {
+		s += " -m comment --comment " + r.Comment
+	}
+	return s + " -j ACCEPT"
+}
+
+func iptablesArgs(op string, r Rule) []string {
+	args := []string{op, "INPUT"}
+	if r.Source != "" {
+		args = append(args, "-s", r.Source)
+	}
+	return append(args, "-p", r.Proto, "--dport", strings.Replace(r.Spec, "-", ":", 1),
+		"-m", "comment", "--comment", r.Comment, "-j", "ACCEPT")
+}
+
+func ensureIptables(r Rule, dryRun bool) (bool, string, error) {
 	// check existing rule
-	out, _, _ := app.Exec("iptables", "-S", "INPUT")
-	needle := fmt.Sprintf("-p udp -m udp --dport %d -j ACCEPT", port)
-	if strings.Contains(out, needle) {
-		return "iptables rule already present.", nil
+	bin := string(r.Backend)
+	out, _, _ := app.Exec(bin, "-S", "INPUT")
+	if strings.Contains(out, iptablesSpec(r, true)) {
+		return true, bin + " rule " + r.Proto + "/" + r.Spec + " already present.", nil
+	}
+	if strings.Contains(out, iptablesSpec(r, false)) {
+		return false, bin + " rule " + r.Proto + "/" + r.Spec + " already present (not managed by hy2mgr).", nil
 	}
+	args := iptablesArgs("-I", r)
 	if dryRun {
-		return fmt.Sprintf("[dry-run] iptables -I INPUT -p udp --dport %d -j ACCEPT", port), nil
+		return true, "[dry-run] " + bin + " " + strings.Join(args, " "), nil
 	}
-	_, _, err := app.Exec("iptables", "-I", "INPUT", "-p", "udp", "--dport", fmt.Sprintf("%d", port), "-j", "ACCEPT")
-	if err != nil {
-		return "", err
+	if _, _, err := app.Exec(bin, args...); err != nil {
+		return false, "", err
+	}
+	return true, bin + " rule " + r.Proto + "/" + r.Spec + " inserted.", nil
+}
+
+func removeIptables(r Rule, dryRun bool) (string, error) {
+	bin := string(r.Backend)
+	args := iptablesArgs("-D", r)
+	if dryRun {
+		return "[dry-run] " + bin + " " + strings.Join(args, " "), nil
+	}
+	if out, _, err := app.Exec(bin, args...); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(out))
 	}
-	return "iptables rule inserted. NOTE: persist rules yourself (e.g., iptables-persistent).", nil
+	return bin + " rule " + r.Proto + "/" + r.Spec + " removed.", nil
 }
@@ -0,0 +1,140 @@
+package firewall
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeIptables puts "iptables" and "ip6tables" on PATH that keep their
+// INPUT chain in dir/<name>.rules, printed the way "iptables -S" does.
+func fakeIptables(t *testing.T) string {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+r="` + dir + `/${0##*/}.rules"
+[ -f "$r" ] || : > "$r"
+op=$1; shift 2
+line="-A INPUT $(echo "$*" | /bin/sed 's/-p \([a-z]*\) /-p \1 -m \1 /')"
+case "$op" in
+-S) /bin/cat "$r" ;;
+-I) echo "$line" >> "$r" ;;
+-D) /bin/grep -qxF -- "$line" "$r" || exit 1; /bin/grep -vxF -- "$line" "$r" > "$r.new"; /bin/mv "$r.new" "$r" ;;
+esac
+`
+	for _, name := range []string{"iptables", "ip6tables"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	return dir
+}
+
+func TestSyncLifecycle(t *testing.T) {
+	dir := fakeIptables(t)
+	if b := Detect(); b != BackendIptables {
+		t.Fatalf("Detect() = %s", b)
+	}
+	path := filepath.Join(dir, "iptables.rules")
+	live := func() string {
+		b, _ := os.ReadFile(path)
+		return string(b)
+	}
+	live6 := func() string {
+		b, _ := os.ReadFile(filepath.Join(dir, "ip6tables.rules"))
+		return string(b)
+	}
+
+	owned, _, err := Sync(Rules(BackendIptables, Ports{UDP: []string{"443"}}), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != 2 || !strings.Contains(live(), "--dport 443 -m comment --comment hy2mgr -j ACCEPT") {
+		t.Fatalf("owned = %v, live:\n%s", owned, live())
+	}
+	if !strings.Contains(live6(), "--dport 443 -m comment --comment hy2mgr -j ACCEPT") {
+		t.Fatalf("rule not mirrored for IPv6:\n%s", live6())
+	}
+
+	// The administrator already opened 8443 themselves: hy2mgr must not
+	// claim (and later delete) that rule.
+	os.WriteFile(path, []byte(live()+"-A INPUT -p udp -m udp --dport 8443 -j ACCEPT\n"), 0644)
+	p := Ports{UDP: []string{"8443"}, TCPAllow: []string{"3333"}, Allow: []string{"198.51.100.0/24", "2001:db8::/32"}}
+	owned, _, err = Sync(Rules(BackendIptables, p), owned, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(live(), "--dport 443 ") || strings.Contains(live6(), "--dport 443 ") {
+		t.Fatalf("stale rule for old port kept:\n%s%s", live(), live6())
+	}
+	// 8443/udp on IPv6 was not taken yet, so hy2mgr owns that one.
+	if len(owned) != 3 {
+		t.Fatalf("owned after port change = %v", owned)
+	}
+	if !strings.Contains(live(), "-A INPUT -s 198.51.100.0/24 -p tcp -m tcp --dport 3333 -m comment --comment hy2mgr -j ACCEPT") || strings.Contains(live(), "2001:db8") {
+		t.Fatalf("IPv4 allowlist:\n%s", live())
+	}
+	if !strings.Contains(live6(), "-A INPUT -s 2001:db8::/32 -p tcp") || strings.Contains(live6(), "198.51.100") {
+		t.Fatalf("IPv6 allowlist:\n%s", live6())
+	}
+
+	if _, err := Purge(owned, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := live(); got != "-A INPUT -p udp -m udp --dport 8443 -j ACCEPT\n" {
+		t.Fatalf("after purge:\n%s", got)
+	}
+	if got := live6(); got != "" {
+		t.Fatalf("after purge (IPv6):\n%s", got)
+	}
+	// A rule removed by hand is not an error.
+	if _, err := Purge(owned, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIptablesPersistence(t *testing.T) {
+	dir := fakeIptables(t)
+	saves := filepath.Join(dir, "saves")
+	script := "#!/bin/sh\necho \"$@\" >> " + saves + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "netfilter-persistent"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if p := DetectPersistence(); p != PersistNetfilter {
+		t.Fatalf("DetectPersistence() = %s", p)
+	}
+	countSaves := func() int {
+		b, _ := os.ReadFile(saves)
+		return strings.Count(string(b), "save")
+	}
+
+	want := Rules(BackendIptables, Ports{UDP: []string{"443"}})
+	owned, _, err := Sync(want, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countSaves(); n != 1 {
+		t.Fatalf("saves after adding rules = %d", n)
+	}
+	if _, _, err := Sync(want, owned, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSaves(); n != 1 {
+		t.Fatalf("unchanged rules saved again (%d saves)", n)
+	}
+
+	// Rules lost (e.g. after a reboot without persistence) are reported
+	// and brought back by Restore.
+	os.Remove(filepath.Join(dir, "ip6tables.rules"))
+	missing := Missing(owned)
+	if len(missing) != 1 || missing[0].Backend != BackendIp6tables {
+		t.Fatalf("Missing = %v", missing)
+	}
+	if _, err := Restore(owned, false); err != nil {
+		t.Fatal(err)
+	}
+	if missing := Missing(owned); len(missing) != 0 {
+		t.Fatalf("Missing after Restore = %v", missing)
+	}
+}
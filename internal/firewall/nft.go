@@ -0,0 +1,318 @@
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+)
+
+// NftTable is the table hy2mgr owns in the inet family. Nothing outside it
+// is touched, so removing it undoes every nftables change.
+const NftTable = "hy2mgr"
+
+// nftSets are the table's named sets, in rendering order.
+var nftSets = []struct{ name, typ string }{
+	{"udp_ports", "inet_service"},
+	{"hop_ports", "inet_service"}, // redirected to the listen port
+	{"tcp_ports", "inet_service"},
+	{"tcp_allow_ports", "inet_service"}, // only from allow_v4/allow_v6
+	{"allow_v4", "ipv4_addr"},
+	{"allow_v6", "ipv6_addr"},
+}
+
+// nftRuleset renders the whole table. The leading "table"/"delete table"
+// pair makes "nft -f" replace it in one transaction whether or not it
+// already exists.
+//
+// An accept here does not override a drop in another table's input chain;
+// hosts with a restrictive nftables ruleset must accept the sets there too.
+func nftRuleset(rules []Rule) string {
+	sets, hopTo := nftElements(rules)
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", NftTable, NftTable)
+	fmt.Fprintf(&b, "table inet %s {\n", NftTable)
+	for _, set := range nftSets {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n\t\tauto-merge\n", set.name, set.typ)
+		if elems := sets[set.name]; len(elems) > 0 {
+			fmt.Fprintf(&b, "\t\telements = { %s }\n", strings.Join(elems, ", "))
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter - 1; policy accept;\n")
+	b.WriteString("\t\tudp dport @udp_ports accept\n")
+	b.WriteString("\t\tudp dport @hop_ports accept\n")
+	b.WriteString("\t\ttcp dport @tcp_ports accept\n")
+	b.WriteString("\t\tip saddr @allow_v4 tcp dport @tcp_allow_ports accept\n")
+	b.WriteString("\t\tip6 saddr @allow_v6 tcp dport @tcp_allow_ports accept\n")
+	b.WriteString("\t}\n")
+	if hopTo > 0 {
+		b.WriteString("\tchain prerouting {\n")
+		b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tudp dport @hop_ports redirect to :%d\n", hopTo)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// nftElements sorts rules into the table's sets (sorted, deduplicated) and
+// returns the hop redirect target, 0 without hop ranges.
+func nftElements(rules []Rule) (map[string][]string, int) {
+	sets := map[string][]string{}
+	add := func(set, elem string) {
+		for _, e := range sets[set] {
+			if e == elem {
+				return
+			}
+		}
+		sets[set] = append(sets[set], elem)
+	}
+	hopTo := 0
+	for _, r := range rules {
+		set := nftSetFor(r)
+		add(set, r.Spec)
+		if set == "hop_ports" {
+			hopTo = r.Redirect
+		}
+		if r.Source != "" {
+			add(nftSourceSet(r.Source), nftAddr(r.Source))
+		}
+	}
+	// nft rejects overlapping intervals in a set, so ranges are merged and
+	// addresses inside another prefix dropped; this is also how nft lists
+	// them, which keeps nftUpToDate exact.
+	for name, elems := range sets {
+		elems = nftMerge(elems)
+		sort.Strings(elems)
+		sets[name] = elems
+	}
+	return sets, hopTo
+}
+
+// nftInterval is an element as a closed interval: ports, or an address
+// prefix as its first address and bit count.
+type nftInterval struct {
+	lo, hi int
+	prefix netip.Prefix
+}
+
+func parseNftElem(elem string) (nftInterval, bool) {
+	if strings.ContainsAny(elem, ".:") {
+		p, err := netip.ParsePrefix(elem)
+		if err != nil {
+			a, aerr := netip.ParseAddr(elem)
+			if aerr != nil {
+				return nftInterval{}, false
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		return nftInterval{prefix: p.Masked()}, true
+	}
+	lo, hi, found := strings.Cut(elem, "-")
+	var iv nftInterval
+	var err error
+	if iv.lo, err = strconv.Atoi(lo); err != nil {
+		return nftInterval{}, false
+	}
+	iv.hi = iv.lo
+	if found {
+		if iv.hi, err = strconv.Atoi(hi); err != nil || iv.hi < iv.lo {
+			return nftInterval{}, false
+		}
+	}
+	return iv, true
+}
+
+// covers reports whether iv contains all of o.
+func (iv nftInterval) covers(o nftInterval) bool {
+	if iv.prefix.IsValid() || o.prefix.IsValid() {
+		return iv.prefix.IsValid() && o.prefix.IsValid() && iv.prefix.Bits() <= o.prefix.Bits() && iv.prefix.Contains(o.prefix.Addr())
+	}
+	return iv.lo <= o.lo && o.hi <= iv.hi
+}
+
+// nftMerge joins overlapping and adjacent port ranges and drops addresses
+// covered by another element. Elements it cannot parse are kept as is.
+func nftMerge(elems []string) []string {
+	var ports []nftInterval
+	var out []string
+	for _, e := range elems {
+		iv, ok := parseNftElem(e)
+		switch {
+		case !ok:
+			out = append(out, e)
+		case iv.prefix.IsValid():
+			covered := false
+			for _, o := range elems {
+				if ov, ok := parseNftElem(o); ok && o != e && ov.covers(iv) && !(iv.covers(ov) && o > e) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				out = append(out, e)
+			}
+		default:
+			ports = append(ports, iv)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].lo < ports[j].lo })
+	for i := 0; i < len(ports); {
+		cur := ports[i]
+		for i++; i < len(ports) && ports[i].lo <= cur.hi+1; i++ {
+			if ports[i].hi > cur.hi {
+				cur.hi = ports[i].hi
+			}
+		}
+		if cur.lo == cur.hi {
+			out = append(out, strconv.Itoa(cur.lo))
+		} else {
+			out = append(out, fmt.Sprintf("%d-%d", cur.lo, cur.hi))
+		}
+	}
+	return out
+}
+
+func nftSetFor(r Rule) string {
+	switch {
+	case r.Proto == "tcp" && r.Source != "":
+		return "tcp_allow_ports"
+	case r.Proto == "tcp":
+		return "tcp_ports"
+	case r.Redirect > 0:
+		return "hop_ports"
+	}
+	return "udp_ports"
+}
+
+func nftSourceSet(cidr string) string {
+	if strings.Contains(cidr, ":") {
+		return "allow_v6"
+	}
+	return "allow_v4"
+}
+
+// nftAddr is cidr the way nft lists it: single hosts without a prefix.
+func nftAddr(cidr string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(cidr, "/32"), "/128")
+}
+
+var (
+	nftSetRe      = regexp.MustCompile(`(?s)set (\w+) \{(.*?)\n\s*\}`)
+	nftElementsRe = regexp.MustCompile(`(?s)elements = \{(.*?)\}`)
+	nftRedirectRe = regexp.MustCompile(`redirect to :(\d+)`)
+)
+
+// nftLive parses "nft -nn list table" output into set name -> sorted
+// elements, plus the hop redirect target ("" if none).
+func nftLive(out string) (map[string][]string, string) {
+	sets := map[string][]string{}
+	for _, m := range nftSetRe.FindAllStringSubmatch(out, -1) {
+		var elems []string
+		if e := nftElementsRe.FindStringSubmatch(m[2]); e != nil {
+			for _, s := range strings.Split(e[1], ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					elems = append(elems, s)
+				}
+			}
+		}
+		sort.Strings(elems)
+		sets[m[1]] = elems
+	}
+	redirect := ""
+	if m := nftRedirectRe.FindStringSubmatch(out); m != nil {
+		redirect = m[1]
+	}
+	return sets, redirect
+}
+
+func nftUpToDate(out string, rules []Rule) bool {
+	want, hopTo := nftElements(rules)
+	live, redirect := nftLive(out)
+	for _, set := range nftSets {
+		elems, ok := live[set.name]
+		if !ok || strings.Join(elems, ",") != strings.Join(want[set.name], ",") {
+			return false
+		}
+	}
+	wantRedirect := ""
+	if hopTo > 0 {
+		wantRedirect = fmt.Sprint(hopTo)
+	}
+	return redirect == wantRedirect
+}
+
+// nftPresent reports whether the live table holds r.
+func nftPresent(r Rule) bool {
+	out, _, err := app.Exec("nft", "-nn", "list", "table", "inet", NftTable)
+	if err != nil {
+		return false
+	}
+	live, redirect := nftLive(out)
+	// The rule may have been merged into a wider element.
+	has := func(set, elem string) bool {
+		want, ok := parseNftElem(elem)
+		for _, e := range live[set] {
+			if e == elem {
+				return true
+			}
+			if iv, eok := parseNftElem(e); ok && eok && iv.covers(want) {
+				return true
+			}
+		}
+		return false
+	}
+	if !has(nftSetFor(r), r.Spec) {
+		return false
+	}
+	if r.Source != "" && !has(nftSourceSet(r.Source), nftAddr(r.Source)) {
+		return false
+	}
+	return r.Redirect == 0 || redirect == fmt.Sprint(r.Redirect)
+}
+
+func ensureNftables(want []Rule, dryRun bool) (string, error) {
+	if out, _, err := app.Exec("nft", "-nn", "list", "table", "inet", NftTable); err == nil && nftUpToDate(out, want) {
+		return "nftables table inet " + NftTable + " already up to date.", nil
+	}
+	rules := nftRuleset(want)
+	if dryRun {
+		return "[dry-run] nft -f - <<EOF\n" + rules + "EOF", nil
+	}
+	f, err := os.CreateTemp("", "hy2mgr-nft-*.conf")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(rules); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if out, _, err := app.Exec("nft", "-f", f.Name()); err != nil {
+		return "", fmt.Errorf("nft -f: %v: %s", err, strings.TrimSpace(out))
+	}
+	return "nftables table inet " + NftTable + " applied.", nil
+}
+
+func removeNftables(dryRun bool) (string, error) {
+	if _, _, err := app.Exec("nft", "list", "table", "inet", NftTable); err != nil {
+		return "nftables table inet " + NftTable + " not present.", nil
+	}
+	if dryRun {
+		return "[dry-run] nft delete table inet " + NftTable, nil
+	}
+	if out, _, err := app.Exec("nft", "delete", "table", "inet", NftTable); err != nil {
+		return "", fmt.Errorf("nft delete table: %v: %s", err, strings.TrimSpace(out))
+	}
+	return "nftables table inet " + NftTable + " removed.", nil
+}
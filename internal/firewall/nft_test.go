@@ -0,0 +1,186 @@
+package firewall
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeNft puts an "nft" on PATH that logs its arguments, copies any -f
+// script to dir/applied.nft and answers "list" from dir/list (exit 1 if
+// the file does not exist, like a missing table).
+func fakeNft(t *testing.T) string {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" >> "` + dir + `/calls"
+case "$1 $2" in
+"-nn list"|"list table") [ -f "` + dir + `/list" ] || exit 1; /bin/cat "` + dir + `/list" ;;
+"-f "*) /bin/cat "$2" > "` + dir + `/applied.nft" ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "nft"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return dir
+}
+
+func readCalls(t *testing.T, dir string) string {
+	b, _ := os.ReadFile(filepath.Join(dir, "calls"))
+	return string(b)
+}
+
+func TestNftablesEnsure(t *testing.T) {
+	dir := fakeNft(t)
+	if b := Detect(); b != BackendNftables {
+		t.Fatalf("Detect() = %s", b)
+	}
+	p := Ports{UDP: []string{"443"}, Hop: []string{"20000-50000"}, HopTo: 443, TCP: []string{"8443"},
+		TCPAllow: []string{"3333"}, Allow: []string{"203.0.113.0/24", "2001:db8::1/128"}}
+	owned, _, err := Sync(Rules(BackendNftables, p), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != 5 {
+		t.Fatalf("owned = %v", owned)
+	}
+	applied, err := os.ReadFile(filepath.Join(dir, "applied.nft"))
+	if err != nil {
+		t.Fatalf("ruleset not applied: %v (calls: %s)", err, readCalls(t, dir))
+	}
+	for _, want := range []string{
+		"delete table inet hy2mgr",
+		"set udp_ports {\n\t\ttype inet_service\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 443 }",
+		"elements = { 20000-50000 }",
+		"set tcp_ports {\n\t\ttype inet_service\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 8443 }",
+		"set tcp_allow_ports {\n\t\ttype inet_service\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 3333 }",
+		"set allow_v6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 2001:db8::1 }",
+		"ip saddr @allow_v4 tcp dport @tcp_allow_ports accept",
+		"udp dport @hop_ports redirect to :443",
+	} {
+		if !strings.Contains(string(applied), want) {
+			t.Fatalf("ruleset lacks %q:\n%s", want, applied)
+		}
+	}
+
+	// What nft prints back for that table: nothing to do.
+	live := `table inet hy2mgr {
+	set udp_ports {
+		type inet_service
+		flags interval
+		elements = { 443 }
+	}
+	set hop_ports {
+		type inet_service
+		flags interval
+		elements = { 20000-50000 }
+	}
+	set tcp_ports {
+		type inet_service
+		flags interval
+		elements = { 8443 }
+	}
+	set tcp_allow_ports {
+		type inet_service
+		flags interval
+		elements = { 3333 }
+	}
+	set allow_v4 {
+		type ipv4_addr
+		flags interval
+		elements = { 203.0.113.0/24 }
+	}
+	set allow_v6 {
+		type ipv6_addr
+		flags interval
+		elements = { 2001:db8::1 }
+	}
+	chain input {
+		type filter hook input priority filter - 1; policy accept;
+		udp dport @udp_ports accept
+		udp dport @hop_ports accept
+		tcp dport @tcp_ports accept
+		ip saddr @allow_v4 tcp dport @tcp_allow_ports accept
+		ip6 saddr @allow_v6 tcp dport @tcp_allow_ports accept
+	}
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		udp dport @hop_ports redirect to :443
+	}
+}
+`
+	os.WriteFile(filepath.Join(dir, "list"), []byte(live), 0644)
+	os.Remove(filepath.Join(dir, "calls"))
+	if !Present(Rule{Backend: BackendNftables, Proto: "udp", Spec: "20000-50000", Redirect: 443}) {
+		t.Fatal("hop rule not reported present")
+	}
+	if Present(Rule{Backend: BackendNftables, Proto: "tcp", Spec: "3333", Source: "198.51.100.0/24"}) {
+		t.Fatal("rule for an unlisted source reported present")
+	}
+	_, msgs, err := Sync(Rules(BackendNftables, p), owned, false)
+	if err != nil || len(msgs) != 1 || !strings.Contains(msgs[0], "already up to date") {
+		t.Fatalf("second Sync = %q, %v", msgs, err)
+	}
+	if calls := readCalls(t, dir); strings.Contains(calls, "-f") {
+		t.Fatalf("up-to-date table re-applied: %s", calls)
+	}
+
+	// A changed listen port is applied again.
+	p.UDP, p.HopTo = []string{"8443"}, 8443
+	os.Remove(filepath.Join(dir, "calls"))
+	if _, _, err := Sync(Rules(BackendNftables, p), owned, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, dir); !strings.Contains(calls, "-f") {
+		t.Fatalf("changed ports not applied: %s", calls)
+	}
+}
+
+func TestNftablesPurge(t *testing.T) {
+	dir := fakeNft(t)
+	if msgs, err := Purge(nil, false); err != nil || !strings.Contains(msgs[0], "not present") {
+		t.Fatalf("Purge without table = %q, %v", msgs, err)
+	}
+	os.WriteFile(filepath.Join(dir, "list"), []byte("table inet hy2mgr {\n}\n"), 0644)
+	if _, err := Purge(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if calls := readCalls(t, dir); !strings.Contains(calls, "delete table inet hy2mgr") {
+		t.Fatalf("table not deleted: %s", calls)
+	}
+}
+
+func TestNftablesMergesOverlappingRanges(t *testing.T) {
+	dir := fakeNft(t)
+	p := Ports{UDP: []string{"443", "444"}, Hop: []string{"25000-40000", "20000-30000", "40001-41000"}, HopTo: 443,
+		TCPAllow: []string{"3333"}, Allow: []string{"203.0.113.0/24", "203.0.113.5/32"}}
+	if _, _, err := Sync(Rules(BackendNftables, p), nil, false); err != nil {
+		t.Fatal(err)
+	}
+	applied, _ := os.ReadFile(filepath.Join(dir, "applied.nft"))
+	for _, want := range []string{
+		"set udp_ports {\n\t\ttype inet_service\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 443-444 }",
+		"set hop_ports {\n\t\ttype inet_service\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 20000-41000 }",
+		"set allow_v4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\tauto-merge\n\t\telements = { 203.0.113.0/24 }",
+	} {
+		if !strings.Contains(string(applied), want) {
+			t.Fatalf("ruleset lacks %q:\n%s", want, applied)
+		}
+	}
+
+	// nft lists the merged elements; each original rule is still present.
+	os.WriteFile(filepath.Join(dir, "list"), applied, 0644)
+	for _, r := range []Rule{
+		{Backend: BackendNftables, Proto: "udp", Spec: "20000-30000", Redirect: 443},
+		{Backend: BackendNftables, Proto: "udp", Spec: "444"},
+		{Backend: BackendNftables, Proto: "tcp", Spec: "3333", Source: "203.0.113.5/32"},
+	} {
+		if !Present(r) {
+			t.Fatalf("%s not reported present", r)
+		}
+	}
+	if Present(Rule{Backend: BackendNftables, Proto: "udp", Spec: "19000-21000", Redirect: 443}) {
+		t.Fatal("range beyond the set reported present")
+	}
+}
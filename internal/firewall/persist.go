@@ -0,0 +1,107 @@
+package firewall
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+)
+
+// Persistence is how iptables rules survive a reboot. The other backends
+// persist their own rules (nftables: hy2mgr-firewall.service as well).
+type Persistence string
+
+const (
+	PersistNetfilter Persistence = "netfilter-persistent" // Debian/Ubuntu
+	PersistServices  Persistence = "iptables-services"    // RHEL family
+	PersistUnit      Persistence = "hy2mgr-firewall.service"
+)
+
+// iptablesInit are the init scripts iptables-services ships; "save" writes
+// /etc/sysconfig/iptables and ip6tables.
+var iptablesInit = []string{"/usr/libexec/iptables/iptables.init", "/usr/libexec/iptables/ip6tables.init"}
+
+func DetectPersistence() Persistence {
+	if app.CommandExists("netfilter-persistent") {
+		return PersistNetfilter
+	}
+	if _, err := os.Stat(iptablesInit[0]); err == nil {
+		return PersistServices
+	}
+	return PersistUnit
+}
+
+// saveIptables saves the live iptables rules where the distribution has a
+// mechanism for it. With PersistUnit nothing is saved: the unit re-applies
+// the rules recorded in state at boot.
+func saveIptables(dryRun bool) (string, error) {
+	switch p := DetectPersistence(); p {
+	case PersistNetfilter:
+		if dryRun {
+			return "[dry-run] netfilter-persistent save", nil
+		}
+		if out, _, err := app.Exec("netfilter-persistent", "save"); err != nil {
+			return "", fmt.Errorf("netfilter-persistent save: %v: %s", err, strings.TrimSpace(out))
+		}
+		return "iptables rules saved with netfilter-persistent.", nil
+	case PersistServices:
+		for _, script := range iptablesInit {
+			if _, err := os.Stat(script); err != nil {
+				continue
+			}
+			if dryRun {
+				continue
+			}
+			if out, _, err := app.Exec(script, "save"); err != nil {
+				return "", fmt.Errorf("%s save: %v: %s", script, err, strings.TrimSpace(out))
+			}
+		}
+		if dryRun {
+			return "[dry-run] " + strings.Join(iptablesInit, " save; ") + " save", nil
+		}
+		return "iptables rules saved to /etc/sysconfig (iptables-services).", nil
+	}
+	return "iptables rules are re-applied at boot by " + string(PersistUnit) + ".", nil
+}
+
+// Restore re-opens every recorded rule, e.g. at boot when the backend does
+// not persist them. Nothing is removed and nothing new is claimed.
+func Restore(have []Rule, dryRun bool) ([]string, error) {
+	var msgs []string
+	var nft []Rule
+	for _, r := range have {
+		if r.Backend == BackendNftables {
+			nft = append(nft, r)
+			continue
+		}
+		_, msg, err := ensure(r, dryRun)
+		if err != nil {
+			return msgs, fmt.Errorf("open %s: %w", r, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(nft) > 0 {
+		msg, err := ensureNftables(nft, dryRun)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Missing returns the rules in have that are not in the live ruleset.
+func Missing(have []Rule) []Rule {
+	var missing []Rule
+	for _, r := range have {
+		if !Present(r) {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+func isIptables(r Rule) bool {
+	return r.Backend == BackendIptables || r.Backend == BackendIp6tables
+}
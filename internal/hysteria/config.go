@@ -7,10 +7,18 @@ import (
 )
 
 type ServerConfig struct {
-	Listen     string     `yaml:"listen,omitempty"`
-	TLS        TLSConfig  `yaml:"tls"`
-	Auth       AuthConfig `yaml:"auth"`
-	Masquerade *Masq      `yaml:"masquerade,omitempty"`
+	Listen       string        `yaml:"listen,omitempty"`
+	TLS          TLSConfig     `yaml:"tls"`
+	Auth         AuthConfig    `yaml:"auth"`
+	Masquerade   *Masq         `yaml:"masquerade,omitempty"`
+	TrafficStats *TrafficStats `yaml:"trafficStats,omitempty"`
+}
+
+// TrafficStats enables hysteria's HTTP stats API (per-user traffic and
+// online counts); Secret goes in the Authorization header.
+type TrafficStats struct {
+	Listen string `yaml:"listen"`
+	Secret string `yaml:"secret,omitempty"`
 }
 
 type TLSConfig struct {
@@ -38,7 +46,7 @@ type MasqProxy struct {
 	Insecure    bool   `yaml:"insecure,omitempty"`
 }
 
-func GenerateYAML(listenPort int, certPath, keyPath string, users map[string]string, masqueradeURL string, rewriteHost bool) ([]byte, error) {
+func GenerateYAML(listenPort int, certPath, keyPath string, users map[string]string, masqueradeURL string, rewriteHost bool, stats *TrafficStats) ([]byte, error) {
 	cfg := ServerConfig{
 		Listen: fmt.Sprintf(":%d", listenPort),
 		TLS: TLSConfig{
@@ -57,6 +65,7 @@ func GenerateYAML(listenPort int, certPath, keyPath string, users map[string]str
 				Insecure:    false,
 			},
 		},
+		TrafficStats: stats,
 	}
 	// schema per official docs citeturn2view1turn4view0
 	return yaml.Marshal(&cfg)
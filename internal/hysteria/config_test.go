@@ -3,7 +3,7 @@ package hysteria
 import "testing"
 
 func TestGenerateAndValidate(t *testing.T) {
-	y, err := GenerateYAML(443, "/etc/hysteria/cert.crt", "/etc/hysteria/cert.key", map[string]string{"u1": "p1"}, "https://www.bing.com", true)
+	y, err := GenerateYAML(443, "/etc/hysteria/cert.crt", "/etc/hysteria/cert.key", map[string]string{"u1": "p1"}, "https://www.bing.com", true, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,56 @@
+package hysteria
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// UserTraffic is one user's byte counters since hysteria started.
+type UserTraffic struct {
+	Tx int64 `json:"tx"` // server -> client
+	Rx int64 `json:"rx"` // client -> server
+}
+
+// StatsClient queries the trafficStats API of a running hysteria server.
+type StatsClient struct {
+	Listen string // host:port of trafficStats.listen
+	Secret string
+	HTTP   *http.Client
+}
+
+func NewStatsClient(listen, secret string) *StatsClient {
+	return &StatsClient{Listen: listen, Secret: secret, HTTP: &http.Client{Timeout: 3 * time.Second}}
+}
+
+// Traffic returns per-user counters keyed by auth username.
+func (c *StatsClient) Traffic() (map[string]UserTraffic, error) {
+	var out map[string]UserTraffic
+	return out, c.get("/traffic", &out)
+}
+
+// Online returns the number of connected client instances per username.
+func (c *StatsClient) Online() (map[string]int, error) {
+	var out map[string]int
+	return out, c.get("/online", &out)
+}
+
+func (c *StatsClient) get(path string, v any) error {
+	req, err := http.NewRequest("GET", "http://"+c.Listen+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.Secret != "" {
+		req.Header.Set("Authorization", c.Secret)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hysteria stats %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
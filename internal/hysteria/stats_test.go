@@ -0,0 +1,46 @@
+package hysteria
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatsClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/traffic":
+			w.Write([]byte(`{"u1":{"tx":514,"rx":4017},"u2":{"tx":0,"rx":0}}`))
+		case "/online":
+			w.Write([]byte(`{"u1":2}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	listen := strings.TrimPrefix(ts.URL, "http://")
+
+	c := NewStatsClient(listen, "s3cret")
+	tr, err := c.Traffic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr["u1"].Tx != 514 || tr["u1"].Rx != 4017 || len(tr) != 2 {
+		t.Fatalf("traffic = %+v", tr)
+	}
+	on, err := c.Online()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on["u1"] != 2 {
+		t.Fatalf("online = %+v", on)
+	}
+	if _, err := NewStatsClient(listen, "wrong").Traffic(); err == nil {
+		t.Fatal("wrong secret accepted")
+	}
+}
@@ -0,0 +1,215 @@
+// Package metrics renders the Prometheus text exposition format and keeps
+// the process-wide counters hy2mgr exports. It has no dependencies so any
+// package can record into it.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the exposition format Writer produces.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Writer accumulates samples. All samples of one metric must be written
+// consecutively; HELP and TYPE are emitted before the first one.
+type Writer struct {
+	buf      bytes.Buffer
+	declared map[string]bool
+}
+
+// Gauge writes one sample; labels are name/value pairs.
+func (w *Writer) Gauge(name, help string, v float64, labels ...string) {
+	w.sample(name, "gauge", help, name, v, labels)
+}
+
+// Counter writes one sample of a monotonically increasing value.
+func (w *Writer) Counter(name, help string, v float64, labels ...string) {
+	w.sample(name, "counter", help, name, v, labels)
+}
+
+func (w *Writer) sample(family, typ, help, name string, v float64, labels []string) {
+	if w.declared == nil {
+		w.declared = map[string]bool{}
+	}
+	if !w.declared[family] {
+		w.declared[family] = true
+		fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", family, strings.ReplaceAll(help, "\n", " "), family, typ)
+	}
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", labels[i], escape(labels[i+1]))
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatValue(v))
+	w.buf.WriteByte('\n')
+}
+
+func (w *Writer) Bytes() []byte { return w.buf.Bytes() }
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu   sync.Mutex
+	vals map[string]float64 // label values joined by "\xff"
+}
+
+// NewCounterVec registers a counter; without labels it is a plain counter
+// that is exported as 0 until incremented.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, vals: map[string]float64{}}
+	if len(labels) == 0 {
+		c.vals[""] = 0
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+
+// Add adds v (>= 0) to the series with the given label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	if len(values) != len(c.labels) {
+		panic("metrics: " + c.name + ": wrong number of label values")
+	}
+	c.mu.Lock()
+	c.vals[strings.Join(values, "\xff")] += v
+	c.mu.Unlock()
+}
+
+// Value returns the current value of one series.
+func (c *CounterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.vals[strings.Join(values, "\xff")]
+}
+
+func (c *CounterVec) write(w *Writer) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.vals))
+	for k := range c.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	vals := make([]float64, len(keys))
+	for i, k := range keys {
+		vals[i] = c.vals[k]
+	}
+	c.mu.Unlock()
+	for i, k := range keys {
+		var labels []string
+		if len(c.labels) > 0 {
+			for j, v := range strings.Split(k, "\xff") {
+				labels = append(labels, c.labels[j], v)
+			}
+		}
+		w.Counter(c.name, c.help, vals[i], labels...)
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	name, help string
+	buckets    []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w *Writer) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+	for i, le := range h.buckets {
+		w.sample(h.name, "histogram", h.help, h.name+"_bucket", float64(counts[i]), []string{"le", formatValue(le)})
+	}
+	w.sample(h.name, "histogram", h.help, h.name+"_bucket", float64(count), []string{"le", "+Inf"})
+	w.sample(h.name, "histogram", h.help, h.name+"_sum", sum, nil)
+	w.sample(h.name, "histogram", h.help, h.name+"_count", float64(count), nil)
+}
+
+type collector interface{ write(w *Writer) }
+
+var (
+	regMu    sync.Mutex
+	registry []collector
+)
+
+func register(c collector) {
+	regMu.Lock()
+	registry = append(registry, c)
+	regMu.Unlock()
+}
+
+// WriteProcess writes every registered counter and histogram.
+func WriteProcess(w *Writer) {
+	regMu.Lock()
+	cs := append([]collector(nil), registry...)
+	regMu.Unlock()
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+// Counters recorded by this process (the web server, or a CLI command).
+var (
+	ApplyTotal          = NewCounterVec("hy2mgr_apply_total", "Apply runs by result (success or failure).", "result")
+	ApplyDuration       = NewHistogram("hy2mgr_apply_duration_seconds", "Time taken by Apply runs.", []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+	LoginFailures       = NewCounterVec("hy2mgr_login_failures_total", "Failed web UI logins.")
+	SubscriptionFetches = NewCounterVec("hy2mgr_subscription_fetches_total", "Subscription and share page fetches by format.", "format")
+	AuditForwarded      = NewCounterVec("hy2mgr_audit_forwarded_total", "Audit entries sent to remote sinks by result (ok, error or dropped).", "result")
+)
+
+func init() {
+	ApplyTotal.Add(0, "success")
+	ApplyTotal.Add(0, "failure")
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var w Writer
+	w.Gauge("up", "Whether it is up.", 1)
+	w.Gauge("node_online", "Online clients.", 2, "node", `a "b"`, "id", "x\\y")
+	w.Gauge("node_online", "Online clients.", 0, "node", "c", "id", "z")
+	want := `# HELP up Whether it is up.
+# TYPE up gauge
+up 1
+# HELP node_online Online clients.
+# TYPE node_online gauge
+node_online{node="a \"b\"",id="x\\y"} 2
+node_online{node="c",id="z"} 0
+`
+	if got := string(w.Bytes()); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCountersAndHistogram(t *testing.T) {
+	c := NewCounterVec("test_fetches_total", "Fetches.", "format")
+	c.Inc("clash")
+	c.Inc("clash")
+	c.Add(3, "uri")
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(3)
+	h.Observe(10)
+
+	var w Writer
+	WriteProcess(&w)
+	out := string(w.Bytes())
+	for _, want := range []string{
+		"# TYPE test_fetches_total counter\ntest_fetches_total{format=\"clash\"} 2\ntest_fetches_total{format=\"uri\"} 3\n",
+		"# TYPE test_duration_seconds histogram\n" +
+			"test_duration_seconds_bucket{le=\"1\"} 1\n" +
+			"test_duration_seconds_bucket{le=\"5\"} 2\n" +
+			"test_duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"test_duration_seconds_sum 13.5\n" +
+			"test_duration_seconds_count 3\n",
+		"hy2mgr_login_failures_total 0\n",
+		"hy2mgr_apply_total{result=\"failure\"} 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+)
+
+var (
+	watchOnce sync.Once
+	loginsMu  sync.Mutex
+	logins    map[string]map[string]bool // user -> IPs seen logging in
+)
+
+// WatchAudit turns audit entries into alerts on Default: a login from an
+// IP that user never logged in from before (the very first login is not
+// reported), and automatic subscription revocations. Known IPs are read
+// from the audit log once.
+func WatchAudit() {
+	watchOnce.Do(func() {
+		logins = loadLogins(audit.Path)
+		audit.OnWrite(auditEvent)
+	})
+}
+
+func loadLogins(path string) map[string]map[string]bool {
+	seen := map[string]map[string]bool{}
+	f, err := os.Open(path)
+	if err != nil {
+		return seen
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e audit.Entry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Action == "login" {
+			rememberLogin(seen, e.User, e.IP)
+		}
+	}
+	return seen
+}
+
+// rememberLogin records ip for user and reports whether it is new while
+// the user has logged in before.
+func rememberLogin(seen map[string]map[string]bool, user, ip string) bool {
+	ips := seen[user]
+	if ips == nil {
+		seen[user] = map[string]bool{ip: true}
+		return false
+	}
+	if ips[ip] {
+		return false
+	}
+	ips[ip] = true
+	return true
+}
+
+func auditEvent(e audit.Entry) {
+	switch e.Action {
+	case "login":
+		loginsMu.Lock()
+		isNew := rememberLogin(logins, e.User, e.IP)
+		loginsMu.Unlock()
+		if isNew {
+			Notify(Event{Kind: LoginNewIP, Title: "Web UI login from a new IP", Text: "user " + e.User + " logged in from " + e.IP, Object: e.User + "@" + e.IP})
+		}
+	case "subscription.revoke":
+		if e.Source != audit.System.Source || e.Result != "ok" {
+			return
+		}
+		Notify(Event{Kind: SubAutoRevoked, Title: "Subscription link revoked automatically", Text: e.Detail, Object: e.Object})
+	}
+}
@@ -0,0 +1,271 @@
+// Package notify delivers alerts to the sinks configured in
+// state.Settings.Notify: JSON webhooks, Telegram and SMTP. Delivery is
+// asynchronous with retries, and identical alerts are suppressed for a
+// while so a flapping service does not flood anyone.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/outbox"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// Event kinds.
+const (
+	ServiceDown    = "service.down"
+	ServiceUp      = "service.up"
+	CertExpiring   = "cert.expiring"
+	ApplyFailed    = "apply.failed"
+	NodeQuota      = "node.quota"
+	LoginNewIP     = "login.new_ip"
+	SubAutoRevoked = "subscription.autorevoke"
+	Test           = "test"
+)
+
+// Kinds lists every kind that Settings.Notify.Events may name.
+var Kinds = []string{ServiceDown, ServiceUp, CertExpiring, ApplyFailed, NodeQuota, LoginNewIP, SubAutoRevoked}
+
+type Event struct {
+	Kind   string    `json:"kind"`
+	Title  string    `json:"title"`
+	Text   string    `json:"text,omitempty"`
+	Object string    `json:"object,omitempty"` // node ID, IP, ...
+	Host   string    `json:"host"`
+	Time   time.Time `json:"time"`
+	// Key identifies "the same alert" for deduplication; defaults to
+	// Kind + Object.
+	Key string `json:"-"`
+	// Until, if set, suppresses the same alert until then once delivered,
+	// instead of for the configured dedupe window.
+	Until time.Time `json:"-"`
+}
+
+func (e Event) key() string {
+	if e.Key != "" {
+		return e.Key
+	}
+	return e.Kind + "/" + e.Object
+}
+
+// Sink delivers one event.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, e Event) error
+}
+
+// permanent marks errors retrying cannot fix (e.g. HTTP 400).
+type permanent struct{ error }
+
+func (p permanent) Unwrap() error { return p.error }
+
+// Notifier queues events and delivers them in the background.
+type Notifier struct {
+	// Config returns the current settings; nil (or a nil result) disables
+	// delivery.
+	Config func() *state.Notify
+	// Sinks builds the sinks for a config; defaults to SinksFor.
+	Sinks func(cfg *state.Notify) []Sink
+	// Attempts per sink and the delay before the first retry, doubled for
+	// each further one. Defaults: 4 and 2s.
+	Attempts int
+	Backoff  time.Duration
+	Logf     outbox.Logf
+	// Group tracks queued events for Flush; nil gives the notifier its own.
+	Group *outbox.Group
+
+	mu     sync.Mutex
+	sent   map[string]time.Time // delivered alert keys, suppressed until
+	queued map[string]bool      // alert keys queued or being delivered
+	queue  *outbox.Queue[Event]
+}
+
+// Default is the process-wide notifier used by Notify.
+var Default = &Notifier{Group: outbox.Background}
+
+// Setup points Default at config; logf (may be nil) reports delivery
+// failures.
+func Setup(config func() *state.Notify, logf func(format string, args ...any)) {
+	Default.mu.Lock()
+	Default.Config, Default.Logf = config, logf
+	Default.mu.Unlock()
+}
+
+// Notify queues e on Default.
+func Notify(e Event) { Default.Notify(e) }
+
+// Notify queues e unless its kind is filtered out, the same alert is
+// already queued, or it was delivered to at least one sink within the
+// dedupe window. It never blocks; with a full queue the event is dropped.
+func (n *Notifier) Notify(e Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cfg := n.config()
+	if cfg == nil || !wants(cfg, e.Kind) {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Host == "" {
+		e.Host, _ = os.Hostname()
+	}
+	window := time.Duration(cfg.DedupeMinutes) * time.Minute
+	if window == 0 {
+		window = time.Hour
+	}
+	if e.Until.IsZero() {
+		e.Until = e.Time.Add(window)
+	}
+	for k, until := range n.sent {
+		if !e.Time.Before(until) {
+			delete(n.sent, k)
+		}
+	}
+	if _, ok := n.sent[e.key()]; ok || n.queued[e.key()] {
+		return
+	}
+	if n.queue == nil {
+		if n.Group == nil {
+			n.Group = &outbox.Group{}
+		}
+		n.sent, n.queued = map[string]time.Time{}, map[string]bool{}
+		n.queue = outbox.New(n.Group, 100, 1, n.run)
+	}
+	if n.queue.Put(e) {
+		n.queued[e.key()] = true
+	} else {
+		n.Logf.Printf("notify: queue full, dropped %s", e.Kind)
+	}
+}
+
+// Flush waits up to timeout for queued events to be delivered (or given
+// up on).
+func (n *Notifier) Flush(timeout time.Duration) {
+	n.mu.Lock()
+	g := n.Group
+	n.mu.Unlock()
+	if g != nil {
+		g.Flush(timeout)
+	}
+}
+
+// SendNow delivers e to every configured sink synchronously, bypassing the
+// kind filter and dedupe, and returns one error per failed sink.
+func (n *Notifier) SendNow(ctx context.Context, e Event) map[string]error {
+	errs, _ := n.send(ctx, e)
+	return errs
+}
+
+// send is SendNow, also returning how many sinks accepted e.
+func (n *Notifier) send(ctx context.Context, e Event) (map[string]error, int) {
+	n.mu.Lock()
+	cfg := n.config()
+	n.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Host == "" {
+		e.Host, _ = os.Hostname()
+	}
+	errs := map[string]error{}
+	if cfg == nil {
+		return errs, 0
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sinks := n.sinks(cfg)
+	for _, s := range sinks {
+		wg.Add(1)
+		go func(s Sink) {
+			defer wg.Done()
+			if err := n.deliver(ctx, s, e); err != nil {
+				mu.Lock()
+				errs[s.Name()] = err
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return errs, len(sinks) - len(errs)
+}
+
+func (n *Notifier) run(events []Event) {
+	for _, e := range events {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		errs, accepted := n.send(ctx, e)
+		for name, err := range errs {
+			n.Logf.Printf("notify: %s via %s: %v", e.Kind, name, err)
+		}
+		cancel()
+		// Only a delivered alert starts the dedupe window; one no sink
+		// took is sent again next time it is raised.
+		n.mu.Lock()
+		delete(n.queued, e.key())
+		if accepted > 0 {
+			n.sent[e.key()] = e.Until
+		}
+		n.mu.Unlock()
+	}
+}
+
+// deliver sends e to s, retrying transient failures with backoff.
+func (n *Notifier) deliver(ctx context.Context, s Sink, e Event) error {
+	attempts, delay := n.Attempts, n.Backoff
+	if attempts <= 0 {
+		attempts = 4
+	}
+	if delay <= 0 {
+		delay = 2 * time.Second
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+			}
+			delay *= 2
+		}
+		sctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		err = s.Send(sctx, e)
+		cancel()
+		var p permanent
+		if err == nil || errors.As(err, &p) {
+			return err
+		}
+	}
+	return err
+}
+
+func (n *Notifier) config() *state.Notify {
+	if n.Config == nil {
+		return nil
+	}
+	return n.Config()
+}
+
+func (n *Notifier) sinks(cfg *state.Notify) []Sink {
+	if n.Sinks != nil {
+		return n.Sinks(cfg)
+	}
+	return SinksFor(cfg)
+}
+
+func wants(cfg *state.Notify, kind string) bool {
+	if len(cfg.Events) == 0 || kind == Test {
+		return true
+	}
+	for _, k := range cfg.Events {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+func TestWebhookSignedWithRetry(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+		got   Event
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Hy2mgr-Signature"); sig != Sign("k3y", body) {
+			t.Errorf("signature %q does not match body", sig)
+		}
+		if r.Header.Get("X-Hy2mgr-Event") != ServiceDown {
+			t.Errorf("X-Hy2mgr-Event = %q", r.Header.Get("X-Hy2mgr-Event"))
+		}
+		_ = json.Unmarshal(body, &got)
+	}))
+	defer ts.Close()
+
+	cfg := &state.Notify{Webhooks: []state.Webhook{{URL: ts.URL, Secret: "k3y"}}}
+	n := &Notifier{Config: func() *state.Notify { return cfg }, Backoff: time.Millisecond}
+	n.Notify(Event{Kind: ServiceDown, Title: "down"})
+	n.Notify(Event{Kind: ServiceDown, Title: "down"}) // deduplicated
+	n.Flush(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("webhook called %d times, want 2 (one failure, one retry)", calls)
+	}
+	if got.Kind != ServiceDown || got.Title != "down" || got.Host == "" || got.Time.IsZero() {
+		t.Fatalf("payload = %+v", got)
+	}
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "bad chat", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	cfg := &state.Notify{Telegram: &state.Telegram{BotToken: "123:SECRET", ChatID: "42", APIBase: ts.URL}}
+	n := &Notifier{Config: func() *state.Notify { return cfg }, Backoff: time.Millisecond}
+	errs := n.SendNow(context.Background(), Event{Kind: Test, Title: "t"})
+	if calls != 1 {
+		t.Fatalf("called %d times, want 1", calls)
+	}
+	err := errs["telegram 42"]
+	if err == nil || strings.Contains(err.Error(), "SECRET") {
+		t.Fatalf("error = %v (must exist and not leak the token)", err)
+	}
+}
+
+func TestEventFilterAndDedupeKey(t *testing.T) {
+	var sent []string
+	var mu sync.Mutex
+	cfg := &state.Notify{Events: []string{CertExpiring}}
+	n := &Notifier{
+		Config: func() *state.Notify { return cfg },
+		Sinks: func(*state.Notify) []Sink {
+			return []Sink{sinkFunc(func(e Event) { mu.Lock(); sent = append(sent, e.Key); mu.Unlock() })}
+		},
+	}
+	n.Notify(Event{Kind: ServiceDown})
+	n.Notify(Event{Kind: CertExpiring, Key: "cert/day1"})
+	n.Notify(Event{Kind: CertExpiring, Key: "cert/day1"})
+	n.Notify(Event{Kind: CertExpiring, Key: "cert/day2"})
+	n.Flush(5 * time.Second)
+	if strings.Join(sent, ",") != "cert/day1,cert/day2" {
+		t.Fatalf("sent %q", sent)
+	}
+}
+
+func TestDedupeOnlyAfterDelivery(t *testing.T) {
+	var mu sync.Mutex
+	calls, failing := 0, true
+	cfg := &state.Notify{DedupeMinutes: 60}
+	n := &Notifier{
+		Config:   func() *state.Notify { return cfg },
+		Attempts: 1,
+		Sinks: func(*state.Notify) []Sink {
+			return []Sink{errSink(func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				if failing {
+					return errors.New("webhook down")
+				}
+				return nil
+			})}
+		},
+	}
+	now := time.Now()
+	raise := func(at time.Time) {
+		n.Notify(Event{Kind: ServiceDown, Time: at})
+		n.Flush(5 * time.Second)
+	}
+	raise(now)
+	raise(now.Add(time.Minute))
+	if calls != 2 {
+		t.Fatalf("failed alert re-sent %d times, want 2", calls)
+	}
+	failing = false
+	raise(now.Add(2 * time.Minute))
+	raise(now.Add(3 * time.Minute))
+	if calls != 3 {
+		t.Fatalf("delivered alert not deduplicated: %d calls, want 3", calls)
+	}
+	n.Notify(Event{Kind: CertExpiring, Time: now.Add(2 * time.Hour)})
+	n.Flush(5 * time.Second)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.sent[ServiceDown+"/"]; ok || len(n.sent) != 1 {
+		t.Fatalf("expired dedupe entries kept: %v", n.sent)
+	}
+}
+
+type errSink func() error
+
+func (f errSink) Name() string                            { return "err" }
+func (f errSink) Send(ctx context.Context, e Event) error { return f() }
+
+type sinkFunc func(Event)
+
+func (f sinkFunc) Name() string                            { return "func" }
+func (f sinkFunc) Send(ctx context.Context, e Event) error { f(e); return nil }
+
+func TestSMTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	msgs := make(chan string, 1)
+	go serveSMTP(ln, msgs)
+
+	m := &SMTP{Addr: ln.Addr().String(), From: "hy2mgr@example.com", To: []string{"ops@example.com"}}
+	if err := m.Send(context.Background(), Event{Kind: NodeQuota, Title: "Node \"phone\" reached its quota", Host: "vps1", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	for _, want := range []string{"To: ops@example.com", "Subject: [hy2mgr vps1] Node \"phone\" reached its quota", "node.quota"} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("message lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
+// serveSMTP is the smallest SMTP server net/smtp will talk to: no
+// extensions, no auth, one message.
+func serveSMTP(ln net.Listener, msgs chan<- string) {
+	c, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(s string) { io.WriteString(c, s+"\r\n") }
+	reply("220 stub")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 stub")
+		case "DATA":
+			reply("354 go ahead")
+			var b strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				b.WriteString(l)
+			}
+			msgs <- b.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestLoginFromNewIP(t *testing.T) {
+	oldPath, oldDefault := audit.Path, Default
+	loginsMu.Lock()
+	oldLogins := logins
+	loginsMu.Unlock()
+	t.Cleanup(func() {
+		audit.Path, Default = oldPath, oldDefault
+		// The audit hook stays registered, so logins must stay non-nil.
+		if oldLogins == nil {
+			oldLogins = map[string]map[string]bool{}
+		}
+		loginsMu.Lock()
+		logins = oldLogins
+		loginsMu.Unlock()
+	})
+	audit.Path = filepath.Join(t.TempDir(), "audit.log")
+	audit.Write(audit.Entry{User: "admin", IP: "198.51.100.1", Action: "login"})
+
+	var got []Event
+	var mu sync.Mutex
+	cfg := &state.Notify{}
+	Default = &Notifier{
+		Config: func() *state.Notify { return cfg },
+		Sinks: func(*state.Notify) []Sink {
+			return []Sink{sinkFunc(func(e Event) { mu.Lock(); got = append(got, e); mu.Unlock() })}
+		},
+	}
+	WatchAudit()
+	loginsMu.Lock()
+	logins = loadLogins(audit.Path) // WatchAudit only loads once per process
+	loginsMu.Unlock()
+	audit.Write(audit.Entry{User: "admin", IP: "198.51.100.1", Action: "login"})
+	audit.Write(audit.Entry{User: "admin", IP: "203.0.113.9", Action: "login"})
+	audit.Write(audit.Entry{User: "admin", IP: "203.0.113.9", Action: "node.add"})
+	Default.Flush(5 * time.Second)
+	if len(got) != 1 || got[0].Kind != LoginNewIP || !strings.Contains(got[0].Text, "203.0.113.9") {
+		t.Fatalf("alerts = %+v", got)
+	}
+}
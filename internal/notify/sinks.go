@@ -0,0 +1,174 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/outbox"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// SinksFor builds one sink per configured destination.
+func SinksFor(cfg *state.Notify) []Sink {
+	var out []Sink
+	for _, w := range cfg.Webhooks {
+		out = append(out, &Webhook{URL: w.URL, Secret: w.Secret})
+	}
+	if t := cfg.Telegram; t != nil {
+		out = append(out, &Telegram{Token: t.BotToken, ChatID: t.ChatID, APIBase: t.APIBase})
+	}
+	if m := cfg.SMTP; m != nil {
+		out = append(out, &SMTP{Addr: m.Addr, Username: m.Username, Password: m.Password, From: m.From, To: m.To})
+	}
+	return out
+}
+
+// post sends body and treats 4xx other than 429 as permanent.
+func post(ctx context.Context, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return permanent{err}
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hy2mgr")
+	resp, err := outbox.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanent{err}
+	}
+	return err
+}
+
+// Webhook POSTs the event as JSON. With a secret, X-Hy2mgr-Signature
+// carries "sha256=" + hex HMAC-SHA256 of the body.
+type Webhook struct {
+	URL    string
+	Secret string
+}
+
+func (w *Webhook) Name() string { return "webhook " + w.URL }
+
+func (w *Webhook) Send(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return permanent{err}
+	}
+	h := http.Header{}
+	h.Set("X-Hy2mgr-Event", e.Kind)
+	if w.Secret != "" {
+		h.Set("X-Hy2mgr-Signature", Sign(w.Secret, body))
+	}
+	return post(ctx, w.URL, body, h)
+}
+
+// Sign is the X-Hy2mgr-Signature value for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Telegram sends a message through the Bot API.
+type Telegram struct {
+	Token   string
+	ChatID  string
+	APIBase string // default https://api.telegram.org
+}
+
+func (t *Telegram) Name() string { return "telegram " + t.ChatID }
+
+func (t *Telegram) Send(ctx context.Context, e Event) error {
+	base := t.APIBase
+	if base == "" {
+		base = "https://api.telegram.org"
+	}
+	body, _ := json.Marshal(map[string]any{"chat_id": t.ChatID, "text": text(e), "disable_web_page_preview": true})
+	err := post(ctx, strings.TrimRight(base, "/")+"/bot"+t.Token+"/sendMessage", body, http.Header{})
+	if err != nil {
+		// The token is part of the URL; keep it out of logs.
+		return redact(err, t.Token)
+	}
+	return nil
+}
+
+// SMTP sends a plain-text mail, upgrading with STARTTLS when the server
+// offers it. Authentication is only attempted with a username.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (m *SMTP) Name() string { return "smtp " + m.Addr }
+
+func (m *SMTP) Send(ctx context.Context, e Event) error {
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return permanent{err}
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject(e)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text(e), "\n", "\r\n") + "\r\n")
+
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(m.Addr, auth, m.From, m.To, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func subject(e Event) string { return fmt.Sprintf("[hy2mgr %s] %s", e.Host, e.Title) }
+
+// text is the human-readable body shared by Telegram and mail.
+func text(e Event) string {
+	s := subject(e)
+	if e.Text != "" {
+		s += "\n" + e.Text
+	}
+	return s + "\n" + e.Time.UTC().Format(time.RFC3339) + " · " + e.Kind
+}
+
+func redact(err error, secret string) error {
+	if secret == "" {
+		return err
+	}
+	msg := strings.ReplaceAll(err.Error(), secret, "***")
+	if _, ok := err.(permanent); ok {
+		return permanent{fmt.Errorf("%s", msg)}
+	}
+	return fmt.Errorf("%s", msg)
+}
@@ -0,0 +1,109 @@
+// Package outbox is the background delivery shared by notify and audit:
+// bounded queues drained on their own goroutine, a Flush that short-lived
+// CLI processes call before exiting, and the HTTP client both use.
+package outbox
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPClient is used for webhooks, Telegram and HTTP audit collectors.
+var HTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// Logf reports delivery problems; a nil Logf discards them.
+type Logf func(format string, args ...any)
+
+func (l Logf) Printf(format string, args ...any) {
+	if l != nil {
+		l(format, args...)
+	}
+}
+
+// Group counts the items queued on its queues until they are handled, so
+// one Flush waits for all of them. The zero value is ready to use.
+type Group struct{ pending sync.WaitGroup }
+
+// Background is the group of the process-wide notifier and forwarder.
+var Background = &Group{}
+
+// Flush waits up to timeout for every queued item to be handled (or given
+// up on) and reports whether they all were.
+func (g *Group) Flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Queue hands items to a handler on its own goroutine, in batches of
+// whatever has queued up, in queue order.
+type Queue[T any] struct {
+	group  *Group
+	ch     chan T
+	done   chan struct{}
+	batch  int
+	handle func([]T)
+}
+
+// New starts a queue holding up to size items in g (nil: a group of its
+// own), handled in batches of up to batch (at least 1).
+func New[T any](g *Group, size, batch int, handle func([]T)) *Queue[T] {
+	if g == nil {
+		g = &Group{}
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	q := &Queue[T]{group: g, ch: make(chan T, size), done: make(chan struct{}), batch: batch, handle: handle}
+	go q.run()
+	return q
+}
+
+// Put queues v and reports whether it fit. It never blocks.
+func (q *Queue[T]) Put(v T) bool {
+	q.group.pending.Add(1)
+	select {
+	case q.ch <- v:
+		return true
+	default:
+		q.group.pending.Done()
+		return false
+	}
+}
+
+// Close stops the queue once what is queued has been handled. Put must
+// not be called afterwards.
+func (q *Queue[T]) Close() { close(q.ch) }
+
+// Done is closed once the queue has stopped after Close.
+func (q *Queue[T]) Done() <-chan struct{} { return q.done }
+
+func (q *Queue[T]) run() {
+	defer close(q.done)
+	for v := range q.ch {
+		batch := []T{v}
+	more:
+		for len(batch) < q.batch {
+			select {
+			case v, ok := <-q.ch:
+				if !ok {
+					break more
+				}
+				batch = append(batch, v)
+			default:
+				break more
+			}
+		}
+		q.handle(batch)
+		q.group.pending.Add(-len(batch))
+	}
+}
@@ -0,0 +1,191 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Card is one printable QR card: a title, a few text lines and the content
+// to encode.
+type Card struct {
+	Title   string
+	Lines   []string
+	Content string
+}
+
+// CardsHTML renders cards as a self-contained HTML sheet laid out for A4
+// printing (use the browser's "Save as PDF" for non-Latin captions).
+func CardsHTML(cards []Card, o Options) ([]byte, error) {
+	o.Caption = nil
+	var buf bytes.Buffer
+	buf.WriteString(`<!doctype html><html><head><meta charset="utf-8"/><title>QR cards</title><style>
+@page{size:A4;margin:12mm}
+body{font:12px system-ui,sans-serif;margin:0}
+.sheet{display:grid;grid-template-columns:repeat(2,1fr);gap:8mm}
+.card{border:1px dashed #999;border-radius:4mm;padding:5mm;text-align:center;break-inside:avoid}
+.card svg{width:55mm;height:55mm}
+.card h2{font-size:15px;margin:2mm 0 1mm}
+.card p{margin:0;color:#444}
+</style></head><body><div class="sheet">`)
+	for _, c := range cards {
+		svg, err := SVGWith(c.Content, o)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Title, err)
+		}
+		buf.WriteString(`<div class="card">`)
+		buf.Write(svg)
+		fmt.Fprintf(&buf, `<h2>%s</h2>`, html.EscapeString(c.Title))
+		for _, l := range c.Lines {
+			fmt.Fprintf(&buf, `<p>%s</p>`, html.EscapeString(l))
+		}
+		buf.WriteString(`</div>`)
+	}
+	buf.WriteString(`</div></body></html>`)
+	return buf.Bytes(), nil
+}
+
+// A4 in PDF points, laid out as 2x3 cards per page.
+const (
+	pageW, pageH   = 595.0, 842.0
+	cardCols       = 2
+	cardRows       = 3
+	cardPad        = 24.0
+	cardQR         = 170.0
+	cardFontSize   = 11.0
+	cardTitleSize  = 14.0
+	cardLineHeight = 15.0
+)
+
+// CardsPDF renders cards as a multi-page A4 PDF with vector QR codes. Text
+// uses the built-in Helvetica font, which only covers Latin-1; cards with
+// other characters are refused, use CardsHTML for them.
+func CardsPDF(cards []Card, o Options) ([]byte, error) {
+	if len(cards) == 0 {
+		return nil, fmt.Errorf("no cards to render")
+	}
+	for _, c := range cards {
+		for _, text := range append([]string{c.Title}, c.Lines...) {
+			if !latin1(text) {
+				return nil, fmt.Errorf("%q has characters the PDF font lacks; write .html instead and print it from a browser", text)
+			}
+		}
+	}
+	fg, bg, err := colours(o)
+	if err != nil {
+		return nil, err
+	}
+	perPage := cardCols * cardRows
+	cellW := (pageW - 2*cardPad) / cardCols
+	cellH := (pageH - 2*cardPad) / cardRows
+	var pages []string
+	for start := 0; start < len(cards); start += perPage {
+		var s strings.Builder
+		for i := start; i < len(cards) && i < start+perPage; i++ {
+			c := cards[i]
+			m, err := Matrix(c.Content, o)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", c.Title, err)
+			}
+			col, row := (i-start)%cardCols, (i-start)/cardCols
+			x0 := cardPad + float64(col)*cellW
+			top := pageH - cardPad - float64(row)*cellH
+			// dashed cut border
+			fmt.Fprintf(&s, "0.6 g 0.6 G [3 3] 0 d 0.5 w %.2f %.2f %.2f %.2f re S [] 0 d\n", x0+4, top-cellH+4, cellW-8, cellH-8)
+			qx, qy := x0+(cellW-cardQR)/2, top-14-cardQR
+			fmt.Fprintf(&s, "%s rg %.2f %.2f %.2f %.2f re f\n", pdfRGB(bg.R, bg.G, bg.B), qx, qy, cardQR, cardQR)
+			fmt.Fprintf(&s, "%s rg\n", pdfRGB(fg.R, fg.G, fg.B))
+			mod := cardQR / float64(len(m))
+			for y, r := range m {
+				for x := 0; x < len(r); {
+					if !r[x] {
+						x++
+						continue
+					}
+					run := x
+					for run < len(r) && r[run] {
+						run++
+					}
+					fmt.Fprintf(&s, "%.3f %.3f %.3f %.3f re\n", qx+float64(x)*mod, qy+cardQR-float64(y+1)*mod, float64(run-x)*mod, mod)
+					x = run
+				}
+			}
+			s.WriteString("f\n0 g\n")
+			ty := qy - 20
+			pdfText(&s, "F2", cardTitleSize, x0+cellW/2, ty, c.Title)
+			for _, l := range c.Lines {
+				ty -= cardLineHeight
+				pdfText(&s, "F1", cardFontSize, x0+cellW/2, ty, l)
+			}
+		}
+		pages = append(pages, s.String())
+	}
+	return writePDF(pages), nil
+}
+
+func pdfRGB(r, g, b uint8) string {
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(r)/255, float64(g)/255, float64(b)/255)
+}
+
+// latin1 reports whether text is printable with the PDF's Helvetica.
+func latin1(text string) bool {
+	for _, r := range text {
+		if (r < 0x20 || r >= 0x7f) && (r < 0xa0 || r > 0xff) {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfText draws text centred on x; text must pass latin1. Widths are estimated (Helvetica averages
+// about half an em per glyph), which is close enough for short captions.
+func pdfText(s *strings.Builder, font string, size, x, y float64, text string) {
+	var esc strings.Builder
+	n := 0
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			esc.WriteByte('\\')
+			esc.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			esc.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&esc, "\\%03o", r)
+		}
+		n++
+	}
+	w := float64(n) * size * 0.5
+	fmt.Fprintf(s, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x-w/2, y, esc.String())
+}
+
+// writePDF assembles a minimal PDF 1.4 document from page content streams.
+func writePDF(pages []string) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// 1 catalog, 2 page tree, 3-4 fonts, then a page and its content per page.
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageW, pageH, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
@@ -3,8 +3,17 @@ package qr
 import (
 	"bytes"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
 
 	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
 )
 
 func PNG(content string, size int) ([]byte, error) {
@@ -35,3 +44,179 @@ func SVG(content string, pixelsPerModule int) ([]byte, error) {
 	buf.WriteString(`</svg>`)
 	return buf.Bytes(), nil
 }
+
+// Options control the rendering of PNGWith, SVGWith, Terminal and cards.
+type Options struct {
+	Level   string   // error correction: L, M, Q or H
+	Size    int      // output width in pixels (PNG, SVG)
+	Margin  int      // quiet zone in modules; scanners want 4
+	FG, BG  string   // colours as #rrggbb
+	Caption []string // lines under the code; ASCII only for PNG
+}
+
+func DefaultOptions() Options {
+	return Options{Level: "M", Size: 256, Margin: 4, FG: "#000000", BG: "#ffffff"}
+}
+
+var levels = map[string]qrcode.RecoveryLevel{"L": qrcode.Low, "M": qrcode.Medium, "Q": qrcode.High, "H": qrcode.Highest}
+
+// Matrix returns the modules of content including a margin of o.Margin.
+func Matrix(content string, o Options) ([][]bool, error) {
+	lvl, ok := levels[strings.ToUpper(o.Level)]
+	if !ok {
+		return nil, fmt.Errorf("error correction level %q: want L, M, Q or H", o.Level)
+	}
+	if o.Margin < 0 {
+		return nil, fmt.Errorf("margin must not be negative")
+	}
+	q, err := qrcode.New(content, lvl)
+	if err != nil {
+		return nil, err
+	}
+	q.DisableBorder = true
+	bm := q.Bitmap()
+	n := len(bm) + 2*o.Margin
+	out := make([][]bool, n)
+	for y := range out {
+		out[y] = make([]bool, n)
+		if y >= o.Margin && y < n-o.Margin {
+			copy(out[y][o.Margin:], bm[y-o.Margin])
+		}
+	}
+	return out, nil
+}
+
+func parseHex(s string) (color.RGBA, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return color.RGBA{}, fmt.Errorf("colour %q: want #rrggbb", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+func colours(o Options) (fg, bg color.RGBA, err error) {
+	if fg, err = parseHex(o.FG); err != nil {
+		return
+	}
+	bg, err = parseHex(o.BG)
+	return
+}
+
+// PNGWith renders content as a PNG at most o.Size pixels wide, using whole
+// pixels per module so the code stays sharp. Caption lines are laid out
+// below the code as in SVGWith, in a built-in bitmap font.
+func PNGWith(content string, o Options) ([]byte, error) {
+	for _, line := range o.Caption {
+		for _, r := range line {
+			if r < 0x20 || r > 0x7e {
+				return nil, fmt.Errorf("PNG captions support ASCII only; use SVG or HTML output for %q", line)
+			}
+		}
+	}
+	m, err := Matrix(content, o)
+	if err != nil {
+		return nil, err
+	}
+	fg, bg, err := colours(o)
+	if err != nil {
+		return nil, err
+	}
+	px := o.Size / len(m)
+	if px < 1 {
+		px = 1
+	}
+	w := px * len(m)
+	// Glyphs are scaled by whole pixels to about the SVG's 1.6 modules, as
+	// far as the longest line still fits.
+	face := basicfont.Face7x13
+	scale := 16 * px / (10 * face.Height)
+	for _, line := range o.Caption {
+		if fit := w / (face.Advance * len(line)); len(line) > 0 && fit < scale {
+			scale = fit
+		}
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	row := 2 * px
+	if row < face.Height*scale {
+		row = face.Height * scale
+	}
+	h := w
+	if len(o.Caption) > 0 {
+		h += row*len(o.Caption) + px
+	}
+	img := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{bg, fg})
+	for y := 0; y < w; y++ {
+		for x := 0; x < w; x++ {
+			if m[y/px][x/px] {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	for i, line := range o.Caption {
+		glyphs := image.NewAlpha(image.Rect(0, 0, face.Advance*len(line), face.Height))
+		d := font.Drawer{Dst: glyphs, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+		d.DrawString(line)
+		x0 := (w - glyphs.Rect.Dx()*scale) / 2
+		y0 := w + px/2 + i*row + (row-face.Height*scale)/2
+		for y := 0; y < h-y0 && y < glyphs.Rect.Dy()*scale; y++ {
+			for x := 0; x < glyphs.Rect.Dx()*scale; x++ {
+				if glyphs.AlphaAt(x/scale, y/scale).A >= 0x80 {
+					img.SetColorIndex(x0+x, y0+y, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVGWith renders content as a scalable SVG o.Size pixels wide, with the
+// caption lines below the code.
+func SVGWith(content string, o Options) ([]byte, error) {
+	m, err := Matrix(content, o)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := colours(o); err != nil {
+		return nil, err
+	}
+	n := len(m)
+	// Caption lines are 2 modules tall, with half a line of padding.
+	h := n
+	if len(o.Caption) > 0 {
+		h += 2*len(o.Caption) + 1
+	}
+	size := o.Size
+	if size <= 0 {
+		size = n * 6
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size*h/n, n, h)
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="%s"/>`, o.BG)
+	fmt.Fprintf(&buf, `<path fill="%s" d="`, o.FG)
+	for y, row := range m {
+		for x := 0; x < n; {
+			if !row[x] {
+				x++
+				continue
+			}
+			run := x
+			for run < n && row[run] {
+				run++
+			}
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", x, y, run-x, run-x)
+			x = run
+		}
+	}
+	buf.WriteString(`"/>`)
+	for i, line := range o.Caption {
+		fmt.Fprintf(&buf, `<text x="%d" y="%d" font-family="sans-serif" font-size="1.6" text-anchor="middle" fill="%s">%s</text>`, n/2, n+2*i+2, o.FG, html.EscapeString(line))
+	}
+	buf.WriteString(`</svg>`)
+	return buf.Bytes(), nil
+}
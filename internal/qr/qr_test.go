@@ -2,6 +2,9 @@ package qr
 
 import (
 	"bytes"
+	"image/png"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +27,128 @@ func TestSVG(t *testing.T) {
 		t.Fatal("not svg")
 	}
 }
+
+func TestMatrixMargin(t *testing.T) {
+	o := DefaultOptions()
+	o.Margin = 0
+	bare, err := Matrix("hello", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Margin = 2
+	m, err := Matrix("hello", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(bare)+4 || m[0][0] || !m[2][2] || m[2][2] != bare[0][0] {
+		t.Fatalf("margin not applied: %d vs %d", len(m), len(bare))
+	}
+	o.Level = "X"
+	if _, err := Matrix("hello", o); err == nil {
+		t.Fatal("bad level accepted")
+	}
+}
+
+func TestPNGWithColours(t *testing.T) {
+	o := DefaultOptions()
+	o.FG, o.BG, o.Size = "#112233", "#ffeedd", 100
+	b, err := PNGWith("hello", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := img.Bounds().Dx(); w > 100 || w < 50 {
+		t.Fatalf("width %d", w)
+	}
+	if r, g, bl, _ := img.At(0, 0).RGBA(); r>>8 != 0xff || g>>8 != 0xee || bl>>8 != 0xdd {
+		t.Fatalf("corner is not background: %v", img.At(0, 0))
+	}
+}
+
+func TestPNGWithCaption(t *testing.T) {
+	o := DefaultOptions()
+	plain, _ := PNGWith("hello", o)
+	o.Caption = []string{"phone", "Expires 2030-01-01"}
+	b, err := PNGWith("hello", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := png.Decode(bytes.NewReader(plain))
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h := code.Bounds().Dx(), img.Bounds().Dy()
+	if img.Bounds().Dx() != w || h <= w {
+		t.Fatalf("size %v for a %dpx code", img.Bounds().Size(), w)
+	}
+	inked := 0
+	for y := w; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r == 0 {
+				inked++
+			}
+		}
+	}
+	if inked < 50 {
+		t.Fatalf("caption area has %d dark pixels", inked)
+	}
+	o.Caption = []string{"我的手机"}
+	if _, err := PNGWith("hello", o); err == nil || !strings.Contains(err.Error(), "SVG or HTML") {
+		t.Fatalf("non-ASCII caption: %v", err)
+	}
+}
+
+func TestSVGWithCaption(t *testing.T) {
+	o := DefaultOptions()
+	o.Caption = []string{"a<b", "Expires 2030-01-01"}
+	b, err := SVGWith("hello", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("a&lt;b")) || !bytes.Contains(b, []byte("Expires 2030-01-01")) {
+		t.Fatalf("caption missing: %s", b)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	o := DefaultOptions()
+	s, err := Terminal("hello", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := Matrix("hello", o)
+	if lines := strings.Count(s, "\n"); lines != (len(m)+1)/2 {
+		t.Fatalf("%d lines for %d modules", lines, len(m))
+	}
+}
+
+func TestCards(t *testing.T) {
+	var cards []Card
+	for i := 0; i < 7; i++ {
+		cards = append(cards, Card{Title: "node (" + strconv.Itoa(i) + ")", Lines: []string{"Expires 2030-01-01"}, Content: "hysteria2://x"})
+	}
+	pdf, err := CardsPDF(cards, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4")) || !bytes.Contains(pdf, []byte("/Count 2")) || !bytes.Contains(pdf, []byte(`(node \(6\)) Tj`)) {
+		t.Fatalf("unexpected pdf:\n%s", pdf)
+	}
+	h, err := CardsHTML(cards, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(h, []byte(`class="card"`)); n != 7 {
+		t.Fatalf("%d cards in html", n)
+	}
+	if pdf, err := CardsPDF([]Card{{Title: "Café", Content: "x"}}, DefaultOptions()); err != nil || !bytes.Contains(pdf, []byte(`(Caf\351) Tj`)) {
+		t.Fatalf("Latin-1 title: %v", err)
+	}
+	if _, err := CardsPDF([]Card{{Title: "我的手机", Content: "x"}}, DefaultOptions()); err == nil || !strings.Contains(err.Error(), ".html") {
+		t.Fatalf("CJK title: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package qr
+
+import "strings"
+
+// Terminal renders content with UTF-8 half blocks, two module rows per line,
+// and forces black-on-white with ANSI colours so it scans on dark themes.
+func Terminal(content string, o Options) (string, error) {
+	m, err := Matrix(content, o)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for y := 0; y < len(m); y += 2 {
+		for x := range m[y] {
+			// "▀" paints the top module in the foreground colour and the
+			// bottom one in the background colour.
+			fg, bg := "97", "107"
+			if m[y][x] {
+				fg = "30"
+			}
+			if y+1 < len(m) && m[y+1][x] {
+				bg = "40"
+			}
+			b.WriteString("\x1b[" + fg + ";" + bg + "m▀")
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String(), nil
+}
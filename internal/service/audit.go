@@ -0,0 +1,134 @@
+package service
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// DefaultActor is recorded for changes made through a Manager that was
+// not given one with As. The CLI sets it to the invoking user.
+var DefaultActor = audit.System
+
+// redacted are fields that are not secrets to the state store but must
+// not end up in the audit log either: hashes of credentials and the
+// secret subscription path.
+var redacted = map[string]bool{
+	"passwordBcrypt":         true,
+	"tokenSha256":            true,
+	"metricsTokenSha256":     true,
+	"subscriptionPathPrefix": true,
+	"encryption":             true,
+}
+
+// Diff lists the fields that differ between a and b, sorted by path.
+// List elements with an "id" are addressed by it ("nodes/<id>/name"),
+// others by index; revision and updatedAt bookkeeping is left out.
+func Diff(a, b *state.State) []audit.Change {
+	before, after := map[string]string{}, map[string]string{}
+	flattenState(a, before)
+	flattenState(b, after)
+	var out []audit.Change
+	for p, old := range before {
+		if nw, ok := after[p]; !ok || nw != old {
+			out = append(out, audit.Change{Path: p, Old: old, New: nw})
+		}
+	}
+	for p, nw := range after {
+		if _, ok := before[p]; !ok {
+			out = append(out, audit.Change{Path: p, New: nw})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	for i, c := range out {
+		key := c.Path[strings.LastIndexByte(c.Path, '/')+1:]
+		if redacted[key] || state.IsSecret(a, c.Path) || state.IsSecret(b, c.Path) {
+			out[i].Old, out[i].New = mask(c.Old), mask(c.New)
+		}
+	}
+	return out
+}
+
+func mask(v string) string {
+	if v == "" {
+		return ""
+	}
+	return "***"
+}
+
+func flattenState(st *state.State, out map[string]string) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	var v map[string]any
+	if json.Unmarshal(b, &v) != nil {
+		return
+	}
+	delete(v, "revision")
+	flatten("", v, out)
+}
+
+func flatten(prefix string, v any, out map[string]string) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "/" + k
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			if k == "updatedAt" {
+				continue
+			}
+			if redacted[k] {
+				b, _ := json.Marshal(x)
+				out[join(k)] = string(b)
+				continue
+			}
+			flatten(join(k), x, out)
+		}
+		return
+	case []any:
+		if len(v) == 0 {
+			return
+		}
+		// Lists of objects are expanded; lists of plain values such as
+		// tags are one value.
+		if _, ok := v[0].(map[string]any); ok {
+			keys, byID := elemIDs(v)
+			for i, x := range v {
+				if byID {
+					flatten(join(keys[i]), x, out)
+				} else {
+					flatten(join(strconv.Itoa(i)), x, out)
+				}
+			}
+			return
+		}
+	case nil:
+		return
+	}
+	b, _ := json.Marshal(v)
+	out[prefix] = string(b)
+}
+
+// elemIDs returns the "id" of every element when all of them have one.
+func elemIDs(v []any) ([]string, bool) {
+	ids := make([]string, len(v))
+	for i, x := range v {
+		m, ok := x.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if ids[i], ok = m["id"].(string); !ok || ids[i] == "" {
+			return nil, false
+		}
+	}
+	return ids, true
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/firewall"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+)
+
+// FirewallPorts is what must be reachable for the current settings:
+// the listen port, plus every advertised endpoint's hop range or alternate
+// port, which the firewall redirects to the listen port. On TCP the web UI
+// is opened only when managePublic is set (limited to manageAllowCidrs if
+// any); a separate subscription listener is meant for everyone.
+func FirewallPorts(st *state.State) firewall.Ports {
+	p := firewall.Ports{UDP: []string{strconv.Itoa(st.Settings.ListenPort)}, HopTo: st.Settings.ListenPort}
+	seen := map[string]bool{}
+	for _, ep := range st.Settings.Endpoints {
+		specs := strings.Split(ep.Ports, ",")
+		if ep.Ports == "" {
+			if ep.Port == 0 || ep.Port == st.Settings.ListenPort {
+				continue
+			}
+			specs = []string{strconv.Itoa(ep.Port)}
+		}
+		for _, spec := range specs {
+			if spec = strings.TrimSpace(spec); spec != "" && !seen[spec] {
+				seen[spec] = true
+				p.Hop = append(p.Hop, spec)
+			}
+		}
+	}
+	if port := exposedPort(st.Settings.ManageListen); port != "" && st.Settings.ManagePublic {
+		if len(st.Settings.ManageAllowCIDRs) > 0 {
+			p.TCPAllow, p.Allow = []string{port}, st.Settings.ManageAllowCIDRs
+		} else {
+			p.TCP = append(p.TCP, port)
+		}
+	}
+	if port := exposedPort(st.Settings.SubscriptionListen); port != "" {
+		p.TCP = append(p.TCP, port)
+	}
+	// An unauthenticated metrics listener stays closed to the outside.
+	if port := exposedPort(st.Settings.MetricsListen); port != "" && st.Settings.MetricsTokenSHA256 != "" {
+		p.TCP = append(p.TCP, port)
+	}
+	return p
+}
+
+// exposedPort is the port of a listen address, "" if it only binds
+// loopback.
+func exposedPort(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || host == "localhost" {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return ""
+	}
+	return port
+}
+
+// FirewallWanted is what the detected backend should hold for st.
+func FirewallWanted(st *state.State) []firewall.Rule {
+	return firewall.Rules(firewall.Detect(), FirewallPorts(st))
+}
+
+// FirewallRecorded returns the rules hy2mgr opened earlier.
+func FirewallRecorded(st *state.State) []firewall.Rule {
+	rules := make([]firewall.Rule, len(st.Firewall))
+	for i, r := range st.Firewall {
+		rules[i] = firewall.Rule{Backend: firewall.Backend(r.Backend), Proto: r.Proto, Spec: r.Spec, Redirect: r.Redirect, Source: r.Source, Comment: r.Comment}
+	}
+	return rules
+}
+
+func recordFirewall(st *state.State, rules []firewall.Rule) {
+	added := map[string]string{}
+	for _, r := range st.Firewall {
+		added[r.Backend+" "+r.Proto+" "+r.Spec+" "+strconv.Itoa(r.Redirect)+" "+r.Source] = r.AddedAt
+	}
+	st.Firewall = nil
+	for _, r := range rules {
+		at := added[string(r.Backend)+" "+r.Proto+" "+r.Spec+" "+strconv.Itoa(r.Redirect)+" "+r.Source]
+		if at == "" {
+			at = app.NowRFC3339()
+		}
+		st.Firewall = append(st.Firewall, state.FirewallRule{Backend: string(r.Backend), Proto: r.Proto, Spec: r.Spec, Redirect: r.Redirect, Source: r.Source, Comment: r.Comment, AddedAt: at})
+	}
+}
+
+// FirewallSync opens what st needs, closes recorded rules it no longer
+// needs and records the result in st (unless dryRun).
+func FirewallSync(st *state.State, dryRun bool) ([]string, error) {
+	owned, msgs, err := firewall.Sync(FirewallWanted(st), FirewallRecorded(st), dryRun)
+	if !dryRun {
+		recordFirewall(st, owned)
+	}
+	msg, uerr := syncFirewallUnit(owned, dryRun)
+	if msg != "" {
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = uerr
+	}
+	return msgs, err
+}
+
+// FirewallPurge closes every recorded rule and forgets them (unless dryRun).
+func FirewallPurge(st *state.State, dryRun bool) ([]string, error) {
+	msgs, err := firewall.Purge(FirewallRecorded(st), dryRun)
+	if !dryRun && err == nil {
+		st.Firewall = nil
+	}
+	msg, uerr := syncFirewallUnit(nil, dryRun)
+	if msg != "" {
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = uerr
+	}
+	return msgs, err
+}
+
+var firewallUnitPath = "/etc/systemd/system/" + app.FirewallService
+
+const firewallUnit = `[Unit]
+Description=HY2 Manager firewall rules
+DefaultDependencies=no
+After=local-fs.target
+Before=network-pre.target ` + app.HysteriaService + `
+Wants=network-pre.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/local/bin/hy2mgr firewall restore
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// needsFirewallUnit reports whether rules vanish on reboot unless
+// hy2mgr-firewall.service re-applies them: the nftables table always,
+// iptables rules when the host has no persistence of its own.
+func needsFirewallUnit(rules []firewall.Rule) bool {
+	for _, r := range rules {
+		switch r.Backend {
+		case firewall.BackendNftables:
+			return true
+		case firewall.BackendIptables, firewall.BackendIp6tables:
+			if firewall.DetectPersistence() == firewall.PersistUnit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// syncFirewallUnit installs the boot-time restore unit when rules need it
+// and removes it otherwise. It returns "" when nothing changed.
+func syncFirewallUnit(rules []firewall.Rule, dryRun bool) (string, error) {
+	_, err := os.Stat(firewallUnitPath)
+	installed := err == nil
+	switch need := needsFirewallUnit(rules); {
+	case need && !installed:
+		if dryRun {
+			return "[dry-run] install and enable " + app.FirewallService, nil
+		}
+		if err := os.WriteFile(firewallUnitPath, []byte(firewallUnit), 0644); err != nil {
+			return "", err
+		}
+		_, _ = systemd.Systemctl("daemon-reload")
+		if _, err := systemd.Systemctl("enable", app.FirewallService); err != nil {
+			return "", err
+		}
+		return "installed " + app.FirewallService + " to re-apply rules at boot.", nil
+	case !need && installed:
+		if dryRun {
+			return "[dry-run] disable and remove " + app.FirewallService, nil
+		}
+		_, _ = systemd.Systemctl("disable", app.FirewallService)
+		if err := os.Remove(firewallUnitPath); err != nil {
+			return "", err
+		}
+		_, _ = systemd.Systemctl("daemon-reload")
+		return "removed " + app.FirewallService + ".", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/firewall"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+func TestFirewallPorts(t *testing.T) {
+	st := state.Default()
+	st.Settings.ListenPort = 8443
+	st.Settings.Endpoints = []state.Endpoint{
+		{Name: "v6", Host: "2001:db8::1"},
+		{Name: "hop", Host: "h.example.com", Ports: "20000-30000,40000"},
+		{Name: "alt", Host: "a.example.com", Port: 443},
+	}
+	st.Settings.SubscriptionListen = "127.0.0.1:8080"
+	want := firewall.Ports{UDP: []string{"8443"}, Hop: []string{"20000-30000", "40000", "443"}, HopTo: 8443}
+	if got := FirewallPorts(st); !reflect.DeepEqual(got, want) {
+		t.Fatalf("private web UI:\n got %+v\nwant %+v", got, want)
+	}
+
+	st.Settings.ManagePublic = true
+	st.Settings.SubscriptionListen = "[::]:8080"
+	got := FirewallPorts(st)
+	if !reflect.DeepEqual(got.TCP, []string{"3333", "8080"}) || got.TCPAllow != nil {
+		t.Fatalf("public web UI: %+v", got)
+	}
+
+	st.Settings.ManageAllowCIDRs = []string{"203.0.113.0/24"}
+	got = FirewallPorts(st)
+	if !reflect.DeepEqual(got.TCP, []string{"8080"}) || !reflect.DeepEqual(got.TCPAllow, []string{"3333"}) || !reflect.DeepEqual(got.Allow, []string{"203.0.113.0/24"}) {
+		t.Fatalf("allowlisted web UI: %+v", got)
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/crypto"
+	"github.com/yuzeguitarist/hy2mgr/internal/hysteria"
+	"github.com/yuzeguitarist/hy2mgr/internal/notify"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+)
+
+// Health runs periodic checks and raises alerts on transitions: hysteria
+// going down or coming back, the certificate nearing expiry, and nodes
+// reaching their quota.
+type Health struct {
+	Mgr *Manager
+	// Probes; tests substitute fakes.
+	Active   func() bool
+	NotAfter func() (time.Time, error)
+	Traffic  func(st *state.State) (map[string]hysteria.UserTraffic, error)
+	Notify   func(notify.Event)
+
+	wasActive *bool
+	overQuota map[string]bool
+}
+
+func NewHealth(m *Manager) *Health {
+	return &Health{
+		Mgr: m,
+		Active: func() bool {
+			ok, _ := systemd.IsActive(app.HysteriaService)
+			return ok
+		},
+		NotAfter: func() (time.Time, error) { return crypto.ParseCertNotAfter(app.HysteriaCertPath) },
+		Traffic: func(st *state.State) (map[string]hysteria.UserTraffic, error) {
+			return hysteria.NewStatsClient(st.Settings.TrafficStatsListen, st.Settings.TrafficStatsSecret).Traffic()
+		},
+		Notify: notify.Notify,
+	}
+}
+
+// Run checks every interval until ctx is done.
+func (h *Health) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		h.Check(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Check runs every probe once.
+func (h *Health) Check(now time.Time) {
+	st := h.Mgr.State()
+
+	active := h.Active()
+	switch {
+	case !active && (h.wasActive == nil || *h.wasActive):
+		h.Notify(notify.Event{Kind: notify.ServiceDown, Title: app.HysteriaService + " is not running", Text: "check: hy2mgr logs --level warning"})
+	case active && h.wasActive != nil && !*h.wasActive:
+		h.Notify(notify.Event{Kind: notify.ServiceUp, Title: app.HysteriaService + " is running again"})
+	}
+	h.wasActive = &active
+
+	warn := 14
+	if n := st.Settings.Notify; n != nil && n.CertWarnDays > 0 {
+		warn = n.CertWarnDays
+	}
+	if notAfter, err := h.NotAfter(); err == nil && notAfter.Sub(now) < time.Duration(warn)*24*time.Hour {
+		left := notAfter.Sub(now).Round(time.Hour)
+		day := now.UTC().Truncate(24 * time.Hour)
+		h.Notify(notify.Event{Kind: notify.CertExpiring, Title: "TLS certificate expires soon", Time: now,
+			Text: fmt.Sprintf("%s expires %s (in %s); rotate with: hy2mgr cert rotate", app.HysteriaCertPath, notAfter.UTC().Format(time.RFC3339), left),
+			// once a UTC day, whatever the dedupe window
+			Key: notify.CertExpiring + "/" + day.Format("2006-01-02"), Until: day.Add(24 * time.Hour)})
+	}
+
+	h.checkQuota(st)
+}
+
+// checkQuota alerts once when a node's traffic since hysteria started
+// reaches its quota, and again only after it dropped below (a restart).
+func (h *Health) checkQuota(st *state.State) {
+	limited := false
+	for _, n := range st.Nodes {
+		limited = limited || n.QuotaBytes > 0
+	}
+	if !limited || st.Settings.TrafficStatsListen == "" {
+		return
+	}
+	traffic, err := h.Traffic(st)
+	if err != nil {
+		return
+	}
+	if h.overQuota == nil {
+		h.overQuota = map[string]bool{}
+	}
+	for _, n := range st.Nodes {
+		t := traffic[n.Username]
+		over := n.QuotaBytes > 0 && t.Tx+t.Rx >= n.QuotaBytes
+		if over && !h.overQuota[n.ID] {
+			h.Notify(notify.Event{Kind: notify.NodeQuota, Title: fmt.Sprintf("Node %q reached its quota", n.Name),
+				Text: fmt.Sprintf("%d of %d bytes used; disable with: hy2mgr node disable --id %s", t.Tx+t.Rx, n.QuotaBytes, n.ID), Object: n.ID})
+		}
+		h.overQuota[n.ID] = over
+	}
+}
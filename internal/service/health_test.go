@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/hysteria"
+	"github.com/yuzeguitarist/hy2mgr/internal/notify"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+func TestHealthAlertsOnTransitions(t *testing.T) {
+	st, err := state.LoadFrom(state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(st)
+	m.ApplyFunc = func(*state.State, bool) error { return nil }
+	n, err := m.NodeAdd("phone", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.NodeSetLimits(n.ID, 1000, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	active, used := true, int64(0)
+	var kinds []string
+	h := NewHealth(m)
+	h.Active = func() bool { return active }
+	h.NotAfter = func() (time.Time, error) { return now.Add(30 * 24 * time.Hour), nil }
+	h.Traffic = func(*state.State) (map[string]hysteria.UserTraffic, error) {
+		return map[string]hysteria.UserTraffic{n.Username: {Tx: used}}, nil
+	}
+	h.Notify = func(e notify.Event) { kinds = append(kinds, e.Kind) }
+
+	h.Check(now) // healthy: nothing to report
+	active, used = false, 1500
+	h.Check(now)
+	h.Check(now) // still down and over quota: no repeats
+	active = true
+	h.Check(now)
+	h.NotAfter = func() (time.Time, error) { return now.Add(3 * 24 * time.Hour), nil }
+	h.Check(now)
+
+	want := []string{notify.ServiceDown, notify.NodeQuota, notify.ServiceUp, notify.CertExpiring}
+	if len(kinds) != len(want) {
+		t.Fatalf("alerts = %q, want %q", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("alerts = %q, want %q", kinds, want)
+		}
+	}
+}
+
+func TestCertAlertOncePerDay(t *testing.T) {
+	st, err := state.LoadFrom(state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	sent := 0
+	n := &notify.Notifier{
+		Config: func() *state.Notify { return &state.Notify{} }, // default 60-minute window
+		Sinks: func(*state.Notify) []notify.Sink {
+			return []notify.Sink{countSink(func() { mu.Lock(); sent++; mu.Unlock() })}
+		},
+	}
+	now := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	h := NewHealth(NewManager(st))
+	h.Active = func() bool { return true }
+	h.NotAfter = func() (time.Time, error) { return now.Add(3 * 24 * time.Hour), nil }
+	h.Notify = n.Notify
+
+	for i, at := range []time.Time{now, now.Add(2 * time.Hour), now.Add(14 * time.Hour), now.Add(24 * time.Hour)} {
+		h.Check(at)
+		n.Flush(5 * time.Second)
+		mu.Lock()
+		got := sent
+		mu.Unlock()
+		if want := []int{1, 1, 1, 2}[i]; got != want {
+			t.Fatalf("check at %s: %d alerts sent, want %d", at.Format(time.Kitchen), got, want)
+		}
+	}
+}
+
+type countSink func()
+
+func (f countSink) Name() string                                   { return "count" }
+func (f countSink) Send(ctx context.Context, e notify.Event) error { f(); return nil }
@@ -0,0 +1,314 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/metrics"
+	"github.com/yuzeguitarist/hy2mgr/internal/notify"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+// Manager serializes all state mutations. Each mutation runs against a clone
+// of the committed state and only replaces it once Apply succeeded, so a
+// failed change never leaves half-applied data in memory.
+//
+// Committed states are never modified again, so the value returned by State
+// can be read without holding any lock.
+//
+// Every mutation is recorded in the audit log with the Manager's actor, the
+// fields it changed and its outcome. Managers returned by As share the
+// state and lock of the one they were derived from.
+type Manager struct {
+	*core
+	actor audit.Actor
+}
+
+type core struct {
+	mu  sync.RWMutex
+	cur *state.State
+
+	// ApplyFunc reconciles the system with st; defaults to ApplyWithLog
+	// reporting to Logf.
+	ApplyFunc func(st *state.State, dryRun bool) error
+	// Logf, if set, receives one line per thing Apply did.
+	Logf func(format string, args ...any)
+}
+
+func NewManager(st *state.State) *Manager {
+	c := &core{cur: st}
+	c.ApplyFunc = func(st *state.State, dryRun bool) error {
+		return ApplyWithLog(st, dryRun, c.Logf)
+	}
+	return &Manager{core: c, actor: DefaultActor}
+}
+
+// As returns a Manager that records changes as made by a.
+func (m *Manager) As(a audit.Actor) *Manager {
+	return &Manager{core: m.core, actor: a}
+}
+
+// State returns the committed state. Callers must treat it as read-only.
+func (m *Manager) State() *state.State {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cur
+}
+
+// Update mutates a clone with fn, applies it to the system and saves it.
+// action and object name the change in the audit log.
+func (m *Manager) Update(action, object string, fn func(st *state.State) error) error {
+	return m.update(action, &object, fn, true)
+}
+
+// UpdateNoApply is Update for changes that do not affect hysteria's config
+// (admin credentials, subscription tokens).
+func (m *Manager) UpdateNoApply(action, object string, fn func(st *state.State) error) error {
+	return m.update(action, &object, fn, false)
+}
+
+// update records the change once it is done; object is read only then,
+// so fn can fill it in.
+func (m *Manager) update(action string, object *string, fn func(st *state.State) error, apply bool) error {
+	prev, next, err := m.commit(fn, apply)
+	// Alert only now that m.mu is released: the notifier's config callback
+	// may read State.
+	var ae applyError
+	if errors.As(err, &ae) {
+		notify.Notify(notify.Event{Kind: notify.ApplyFailed, Title: "Apply failed; the change was rolled back", Text: ae.Error()})
+	}
+	e := m.actor.Entry(action, *object, err)
+	if prev != nil && next != nil {
+		e.Changes = Diff(prev, next)
+	}
+	audit.Write(e)
+	return err
+}
+
+// commit returns the state it started from and the one fn produced, even
+// when applying or saving the latter failed.
+func (m *Manager) commit(fn func(st *state.State) error, apply bool) (prev, next *state.State, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	store := m.cur.Store()
+	if store == nil {
+		return m.updateLocked(fn, apply)
+	}
+	// Hold the file lock across reload/mutate/apply/save so CLI commands and
+	// the web server never interleave, and start from whatever is on disk.
+	unlock, err := store.Lock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+	if err := m.refreshLocked(); err != nil {
+		return nil, nil, err
+	}
+	return m.updateLocked(fn, apply)
+}
+
+func (m *Manager) updateLocked(fn func(st *state.State) error, apply bool) (prev, next *state.State, err error) {
+	prev = m.cur
+	next = prev.Clone()
+	if fn != nil {
+		if err := fn(next); err != nil {
+			return prev, nil, err
+		}
+	}
+	if apply {
+		start := time.Now()
+		err := m.ApplyFunc(next, false)
+		metrics.ApplyDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.ApplyTotal.Inc("failure")
+			return prev, next, applyError{err}
+		}
+		metrics.ApplyTotal.Inc("success")
+	}
+	// The system already runs next; keep memory in line with it even if the
+	// save fails, and report the failure.
+	m.cur = next
+	if err := saveLocked(next); err != nil {
+		return prev, next, fmt.Errorf("applied but failed to save state: %w", err)
+	}
+	return prev, next, nil
+}
+
+// applyError marks a failed apply, which update reports to notify.
+type applyError struct{ error }
+
+func (e applyError) Unwrap() error { return e.error }
+
+func saveLocked(st *state.State) error {
+	if st.Store() == nil {
+		return st.SaveAtomic()
+	}
+	return st.Store().Save(st)
+}
+
+// Reload picks up a newer revision saved by another process.
+func (m *Manager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refreshLocked()
+}
+
+func (m *Manager) refreshLocked() error {
+	store := m.cur.Store()
+	if store == nil {
+		return nil
+	}
+	latest, err := store.Load()
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing saved yet (or the file was removed); the next save recreates it.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if latest.Revision != m.cur.Revision {
+		latest.SetStore(store)
+		m.cur = latest
+	}
+	return nil
+}
+
+// Watch reloads the committed state whenever the store's file changes on
+// disk, until ctx is done.
+func (m *Manager) Watch(ctx context.Context, onError func(error)) error {
+	store := m.State().Store()
+	if store == nil {
+		return nil
+	}
+	return state.Watch(ctx, store.Location(), func() {
+		if err := m.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
+
+// Apply reconciles the system with the committed state. A dry run works on
+// a throwaway clone.
+func (m *Manager) Apply(dryRun bool) error {
+	if dryRun {
+		return m.ApplyFunc(m.State().Clone(), true)
+	}
+	return m.Update("apply", "", nil)
+}
+
+func (m *Manager) NodeAdd(name, username, password string, tags ...string) (*state.Node, error) {
+	var n state.Node
+	err := m.update("node.add", &n.ID, func(st *state.State) error {
+		n = addNode(st, name, username, password, tags...)
+		return nil
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (m *Manager) NodeDelete(id string) error {
+	return m.Update("node.delete", id, func(st *state.State) error {
+		idx := findNode(st, id)
+		if idx < 0 {
+			return ErrNodeNotFound
+		}
+		st.Nodes = append(st.Nodes[:idx], st.Nodes[idx+1:]...)
+		revokeScoped(st, id, "")
+		return nil
+	})
+}
+
+func (m *Manager) NodeSetTags(id string, tags []string) error {
+	return m.UpdateNoApply("node.tags", id, func(st *state.State) error {
+		idx := findNode(st, id)
+		if idx < 0 {
+			return ErrNodeNotFound
+		}
+		st.Nodes[idx].Tags = tags
+		st.Nodes[idx].UpdatedAt = app.NowRFC3339()
+		return nil
+	})
+}
+
+// NodeSetLimits sets the quota and expiry shown to subscription clients.
+func (m *Manager) NodeSetLimits(id string, quotaBytes int64, expiresAt string) error {
+	return m.UpdateNoApply("node.limits", id, func(st *state.State) error {
+		idx := findNode(st, id)
+		if idx < 0 {
+			return ErrNodeNotFound
+		}
+		st.Nodes[idx].QuotaBytes = quotaBytes
+		st.Nodes[idx].ExpiresAt = expiresAt
+		st.Nodes[idx].UpdatedAt = app.NowRFC3339()
+		return nil
+	})
+}
+
+// NodeSetSNI overrides the SNI clients use for one node; "" restores the
+// global one.
+func (m *Manager) NodeSetSNI(id, sni string) error {
+	return m.UpdateNoApply("node.sni", id, func(st *state.State) error {
+		idx := findNode(st, id)
+		if idx < 0 {
+			return ErrNodeNotFound
+		}
+		st.Nodes[idx].SNI = sni
+		st.Nodes[idx].UpdatedAt = app.NowRFC3339()
+		return nil
+	})
+}
+
+func (m *Manager) NodeSetEnabled(id string, enabled bool) error {
+	action := "node.disable"
+	if enabled {
+		action = "node.enable"
+	}
+	return m.Update(action, id, func(st *state.State) error {
+		idx := findNode(st, id)
+		if idx < 0 {
+			return ErrNodeNotFound
+		}
+		st.Nodes[idx].Enabled = enabled
+		st.Nodes[idx].UpdatedAt = app.NowRFC3339()
+		return nil
+	})
+}
+
+func (m *Manager) NodeResetPassword(id string) error {
+	return m.Update("node.reset", id, func(st *state.State) error {
+		idx := findNode(st, id)
+		if idx < 0 {
+			return ErrNodeNotFound
+		}
+		pass, err := app.RandToken(16)
+		if err != nil {
+			return err
+		}
+		st.Nodes[idx].Password = pass
+		st.Nodes[idx].UpdatedAt = app.NowRFC3339()
+		return nil
+	})
+}
+
+// RotateCert writes a new certificate and re-applies under the same lock.
+func (m *Manager) RotateCert() error {
+	return m.Update("cert.rotate", "", func(st *state.State) error {
+		return RotateCert(st, false)
+	})
+}
+
+func (m *Manager) SubscriptionRotate() (token, urlPath string, err error) {
+	err = m.UpdateNoApply("subscription.rotate", "", func(st *state.State) error {
+		token, urlPath, err = rotateSubscription(st)
+		return err
+	})
+	return token, urlPath, err
+}
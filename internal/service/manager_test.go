@@ -0,0 +1,221 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/clientcfg"
+	"github.com/yuzeguitarist/hy2mgr/internal/notify"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "hy2mgr-audit")
+	if err != nil {
+		panic(err)
+	}
+	audit.Path = filepath.Join(dir, "audit.log")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestManagerRollsBackFailedApply(t *testing.T) {
+	st, err := state.LoadFrom(state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(st)
+	fail := false
+	m.ApplyFunc = func(*state.State, bool) error {
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	}
+	n, err := m.NodeAdd("ok", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := m.State()
+
+	fail = true
+	if _, err := m.NodeAdd("broken", "", ""); err == nil {
+		t.Fatal("expected apply error")
+	}
+	if err := m.NodeSetEnabled(n.ID, false); err == nil {
+		t.Fatal("expected apply error")
+	}
+	if m.State() != before || len(before.Nodes) != 1 || !before.Nodes[0].Enabled {
+		t.Fatalf("state changed after failed apply: %+v", m.State().Nodes)
+	}
+	if err := m.NodeDelete("missing"); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("want ErrNodeNotFound, got %v", err)
+	}
+}
+
+// hy2mgr web reads the notify settings through the Manager, so the
+// apply-failed alert must not be raised while the Manager is locked.
+func TestManagerAlertsFailedApplyUnlocked(t *testing.T) {
+	st, err := state.LoadFrom(state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(st)
+	m.ApplyFunc = func(*state.State, bool) error { return errors.New("boom") }
+	oldConfig, oldLogf := notify.Default.Config, notify.Default.Logf
+	t.Cleanup(func() { notify.Setup(oldConfig, oldLogf) })
+	unlocked := make(chan bool, 1)
+	notify.Setup(func() *state.Notify {
+		// Blocking here would hang the test; report the held lock instead.
+		if !m.mu.TryRLock() {
+			unlocked <- false
+			return nil
+		}
+		m.mu.RUnlock()
+		unlocked <- true
+		return m.State().Settings.Notify
+	}, nil)
+
+	if _, err := m.NodeAdd("broken", "", ""); err == nil || err.Error() != "boom" {
+		t.Fatalf("err = %v", err)
+	}
+	select {
+	case ok := <-unlocked:
+		if !ok {
+			t.Fatal("apply-failed alert raised with the Manager locked")
+		}
+	default:
+		t.Fatal("apply-failed alert not raised")
+	}
+}
+
+func TestManagerMergesExternalSave(t *testing.T) {
+	store := state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), "")
+	st, _ := state.LoadFrom(store)
+	m := NewManager(st)
+	m.ApplyFunc = func(*state.State, bool) error { return nil }
+	if _, err := m.NodeAdd("web", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A CLI process loads, modifies and saves on its own.
+	cli, _ := state.LoadFrom(store)
+	cli.Nodes = append(cli.Nodes, state.Node{ID: "cli", Name: "cli"})
+	if err := cli.SaveAtomic(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.NodeAdd("web2", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := store.Load()
+	if len(got.Nodes) != 3 || findNode(got, "cli") < 0 {
+		t.Fatalf("CLI change clobbered: %+v", got.Nodes)
+	}
+}
+
+func TestNodeURIsAdvertisedEndpoints(t *testing.T) {
+	st, _ := state.LoadFrom(state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), ""))
+	m := NewManager(st)
+	m.ApplyFunc = func(*state.State, bool) error { return nil }
+	n, _ := m.NodeAdd("alice", "", "")
+	if err := m.NodeSetSNI(n.ID, "cdn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	err := m.UpdateNoApply("settings.endpoints", "", func(st *state.State) error {
+		st.Settings.ListenHost = "203.0.113.7"
+		st.Settings.Endpoints = []state.Endpoint{
+			{Name: "v6", Host: "2001:db8::1"},
+			{Name: "cdn", Host: "hy.example.com", Port: 8443, Ports: "20000-30000", VerifyTLS: true},
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uris, err := NodeURIs(m.State(), n.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uris) != 3 {
+		t.Fatalf("uris = %v", uris)
+	}
+	var eps []clientcfg.Endpoint
+	for _, u := range uris {
+		ep, err := clientcfg.ParseURI(u)
+		if err != nil {
+			t.Fatalf("%s: %v", u, err)
+		}
+		eps = append(eps, ep)
+	}
+	if eps[0].Name != "alice" || eps[1].Name != "alice-v6" || eps[2].Name != "alice-cdn" {
+		t.Fatalf("names = %q %q %q", eps[0].Name, eps[1].Name, eps[2].Name)
+	}
+	if eps[0].Host != "203.0.113.7" || eps[1].Host != "2001:db8::1" || eps[1].Port != eps[0].Port {
+		t.Fatalf("hosts = %+v %+v", eps[0], eps[1])
+	}
+	if eps[1].SNI != "cdn.example.com" || !eps[1].Insecure {
+		t.Fatalf("v6 endpoint = %+v", eps[1])
+	}
+	if eps[2].Insecure || eps[2].PinSHA256 != "" || eps[2].Ports != "20000-30000" || eps[2].Port != 20000 {
+		t.Fatalf("cdn endpoint = %+v", eps[2])
+	}
+}
+
+func TestManagerAuditsChanges(t *testing.T) {
+	oldPath := audit.Path
+	t.Cleanup(func() { audit.Path = oldPath })
+	audit.Path = filepath.Join(t.TempDir(), "audit.log")
+	st, _ := state.LoadFrom(state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), ""))
+	m := NewManager(st).As(audit.Actor{User: "alice", Source: "cli", UID: "1000"})
+	m.ApplyFunc = func(*state.State, bool) error { return nil }
+	n, err := m.NodeAdd("phone", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.NodeSetEnabled(n.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.NodeDelete("missing"); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("err = %v", err)
+	}
+	entries, _, err := audit.Read(audit.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("entries = %+v", entries)
+	}
+	del, disable, add := entries[0], entries[1], entries[2]
+
+	if add.Action != "node.add" || add.Object != n.ID || add.User != "alice" || add.Source != "cli" || add.UID != "1000" || add.Result != "ok" {
+		t.Fatalf("add = %+v", add)
+	}
+	changes := map[string]audit.Change{}
+	for _, c := range add.Changes {
+		changes[c.Path] = c
+	}
+	if c := changes["nodes/"+n.ID+"/name"]; c.Old != "" || c.New != `"phone"` {
+		t.Fatalf("name change = %+v", c)
+	}
+	if c := changes["nodes/"+n.ID+"/password"]; c.New != "***" {
+		t.Fatalf("password change = %+v", c)
+	}
+	for _, c := range add.Changes {
+		if strings.Contains(c.New, n.Password) {
+			t.Fatalf("password leaked in %+v", c)
+		}
+	}
+
+	if len(disable.Changes) != 1 || disable.Changes[0] != (audit.Change{Path: "nodes/" + n.ID + "/enabled", Old: "true", New: "false"}) {
+		t.Fatalf("disable changes = %+v", disable.Changes)
+	}
+	if del.Action != "node.delete" || del.Result != "error" || del.Error != ErrNodeNotFound.Error() || del.Changes != nil {
+		t.Fatalf("failed delete = %+v", del)
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/crypto"
+	"github.com/yuzeguitarist/hy2mgr/internal/hysteria"
+	"github.com/yuzeguitarist/hy2mgr/internal/metrics"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+)
+
+// MetricsTokenRotate issues a new /metrics bearer token; only its hash is
+// stored, so the token is returned once.
+func (m *Manager) MetricsTokenRotate() (string, error) {
+	token, err := app.RandToken(24)
+	if err != nil {
+		return "", err
+	}
+	return token, m.UpdateNoApply("metrics.token.rotate", "", func(st *state.State) error {
+		st.Settings.MetricsTokenSHA256 = hashToken(token)
+		return nil
+	})
+}
+
+func (m *Manager) MetricsTokenRevoke() error {
+	return m.UpdateNoApply("metrics.token.revoke", "", func(st *state.State) error {
+		st.Settings.MetricsTokenSHA256 = ""
+		return nil
+	})
+}
+
+// MetricsVerify reports whether token is the configured /metrics token.
+func MetricsVerify(st *state.State, token string) bool {
+	h := st.Settings.MetricsTokenSHA256
+	return h != "" && token != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(h)) == 1
+}
+
+// NodeStatus is "enabled", "disabled" or "expired" (enabled but past
+// expiresAt).
+func NodeStatus(n state.Node, now time.Time) string {
+	if !n.Enabled {
+		return "disabled"
+	}
+	if t, err := time.Parse(time.RFC3339, n.ExpiresAt); err == nil && now.After(t) {
+		return "expired"
+	}
+	return "enabled"
+}
+
+// WriteMetrics writes everything /metrics exports: system state read now,
+// then the process counters.
+func WriteMetrics(w *metrics.Writer, st *state.State) {
+	up := 0.0
+	if active, _ := systemd.IsActive(app.HysteriaService); active {
+		up = 1
+	}
+	w.Gauge("hy2mgr_hysteria_up", "Whether "+app.HysteriaService+" is active.", up)
+
+	now := time.Now()
+	count := map[string]int{}
+	for _, n := range st.Nodes {
+		count[NodeStatus(n, now)]++
+	}
+	for _, s := range []string{"enabled", "disabled", "expired"} {
+		w.Gauge("hy2mgr_nodes", "Nodes by status.", float64(count[s]), "status", s)
+	}
+
+	if notAfter, err := crypto.ParseCertNotAfter(app.HysteriaCertPath); err == nil {
+		w.Gauge("hy2mgr_cert_expiry_seconds", "Seconds until the hysteria certificate expires.", notAfter.Sub(now).Seconds())
+	}
+
+	writeTrafficMetrics(w, st)
+	metrics.WriteProcess(w)
+}
+
+// writeTrafficMetrics exports hysteria's per-user counters under node
+// labels. Users hysteria reports that are no longer nodes are skipped.
+func writeTrafficMetrics(w *metrics.Writer, st *state.State) {
+	set := st.Settings
+	if set.TrafficStatsListen == "" {
+		return
+	}
+	c := hysteria.NewStatsClient(set.TrafficStatsListen, set.TrafficStatsSecret)
+	traffic, err := c.Traffic()
+	var online map[string]int
+	if err == nil {
+		online, err = c.Online()
+	}
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	w.Gauge("hy2mgr_stats_api_up", "Whether hysteria's trafficStats API answered.", up)
+	if err != nil {
+		return
+	}
+	for _, n := range st.Nodes {
+		t := traffic[n.Username]
+		w.Counter("hy2mgr_node_traffic_bytes_total", "Bytes relayed per node since hysteria started (tx: to client, rx: from client).", float64(t.Tx), "id", n.ID, "node", n.Name, "direction", "tx")
+		w.Counter("hy2mgr_node_traffic_bytes_total", "Bytes relayed per node since hysteria started (tx: to client, rx: from client).", float64(t.Rx), "id", n.ID, "node", n.Name, "direction", "rx")
+	}
+	for _, n := range st.Nodes {
+		w.Gauge("hy2mgr_node_online_connections", "Connected client instances per node.", float64(online[n.Username]), "id", n.ID, "node", n.Name)
+	}
+}
@@ -1,18 +1,16 @@
 package service
 
 import (
-	"crypto/sha256"
 	"crypto/subtle"
-	"encoding/hex"
-	"fmt"
+	"errors"
 	"net"
-	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/clientcfg"
 	"github.com/yuzeguitarist/hy2mgr/internal/crypto"
 	"github.com/yuzeguitarist/hy2mgr/internal/firewall"
 	"github.com/yuzeguitarist/hy2mgr/internal/hysteria"
@@ -39,24 +37,35 @@ func DesiredPerms() []PermSpec {
 
 // Apply is the idempotent "desired state" reconciler.
 func Apply(st *state.State, dryRun bool) error {
+	return ApplyWithLog(st, dryRun, nil)
+}
+
+// ApplyWithLog is Apply reporting what each step did through logf (may be
+// nil).
+func ApplyWithLog(st *state.State, dryRun bool, logf func(format string, args ...any)) error {
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
 	// 1) ensure cert exists
 	if _, err := os.Stat(app.HysteriaCertPath); err != nil {
 		if err := RotateCert(st, dryRun); err != nil {
 			return err
 		}
+		logf("certificate: generated self-signed %s", app.HysteriaCertPath)
 	}
 
 	// 2) ensure at least one node for auth
 	if len(st.Nodes) == 0 {
-		_, err := NodeAdd(st, "default", "", "")
-		if err != nil {
-			return err
-		}
+		addNode(st, "default", "", "")
+		logf("nodes: added node \"default\"")
 	}
 
 	// 3) choose port if busy (prefer 443) per requirements
 	candidates := []int{443, 8443, 2053, 2083, 2087, 2096, 10443}
-	st.Settings.ListenPort = netutil.ChoosePort(st.Settings.ListenPort, candidates)
+	if port := netutil.ChoosePort(st.Settings.ListenPort, candidates); port != st.Settings.ListenPort {
+		logf("listen port: %d is busy, switched to %d", st.Settings.ListenPort, port)
+		st.Settings.ListenPort = port
+	}
 
 	// 4) build userpass map (enabled only)
 	users := map[string]string{}
@@ -65,7 +74,14 @@ func Apply(st *state.State, dryRun bool) error {
 			users[n.Username] = n.Password
 		}
 	}
-	y, err := hysteria.GenerateYAML(st.Settings.ListenPort, app.HysteriaCertPath, app.HysteriaKeyPath, users, st.Settings.MasqueradeURL, st.Settings.MasqueradeRewrite)
+	if st.Settings.TrafficStatsListen != "" && st.Settings.TrafficStatsSecret == "" {
+		secret, err := app.RandToken(18)
+		if err != nil {
+			return err
+		}
+		st.Settings.TrafficStatsSecret = secret
+	}
+	y, err := hysteria.GenerateYAML(st.Settings.ListenPort, app.HysteriaCertPath, app.HysteriaKeyPath, users, st.Settings.MasqueradeURL, st.Settings.MasqueradeRewrite, trafficStats(st, st.Settings.TrafficStatsSecret))
 	if err != nil {
 		return err
 	}
@@ -81,10 +97,12 @@ func Apply(st *state.State, dryRun bool) error {
 		if _, err := os.Stat(app.HysteriaConfigPath); err == nil {
 			backup := app.HysteriaConfigPath + "." + app.NowRFC3339() + ".bak"
 			_ = app.CopyFile(app.HysteriaConfigPath, backup, 0644)
+			_ = app.PruneFiles(app.HysteriaConfigPath+".*.bak", 20)
 		}
 		if err := app.AtomicWriteFile(app.HysteriaConfigPath, 0640, y); err != nil {
 			return err
 		}
+		logf("config: wrote %s (%d enabled users, UDP/%d)", app.HysteriaConfigPath, len(users), st.Settings.ListenPort)
 	}
 
 	// 6) permission self-heal
@@ -92,13 +110,24 @@ func Apply(st *state.State, dryRun bool) error {
 		return err
 	}
 
-	// 7) firewall open UDP port
-	_, _, _ = firewall.EnsureUDPPortOpen(st.Settings.ListenPort, dryRun)
+	// 7) firewall: open the listen/web ports and hop ranges, close stale rules
+	msgs, err := FirewallSync(st, dryRun)
+	for _, m := range msgs {
+		logf("firewall (%s): %s", firewall.Detect(), m)
+	}
+	if err != nil {
+		// not fatal: the cloud security group may be all that matters
+		logf("firewall: %v", err)
+	}
 
 	// 8) restart hysteria
 	if !dryRun {
 		_ = systemd.EnableNow(app.HysteriaService)
-		_ = systemd.Restart(app.HysteriaService)
+		if err := systemd.Restart(app.HysteriaService); err != nil {
+			logf("restart %s: %v", app.HysteriaService, err)
+		} else {
+			logf("restarted %s", app.HysteriaService)
+		}
 	}
 	return nil
 }
@@ -160,7 +189,9 @@ func applyPerms(gid int, dryRun bool) error {
 	return nil
 }
 
-func NodeAdd(st *state.State, name, username, password string) (*state.Node, error) {
+var ErrNodeNotFound = errors.New("node not found")
+
+func addNode(st *state.State, name, username, password string, tags ...string) state.Node {
 	id, _ := app.RandToken(8)
 	if username == "" {
 		username = "u" + id
@@ -174,113 +205,129 @@ func NodeAdd(st *state.State, name, username, password string) (*state.Node, err
 		Username:  username,
 		Password:  password,
 		Enabled:   true,
+		Tags:      tags,
 		CreatedAt: app.NowRFC3339(),
 		UpdatedAt: app.NowRFC3339(),
 	}
 	st.Nodes = append(st.Nodes, n)
-	if err := Apply(st, false); err != nil {
-		return nil, err
-	}
-	_ = st.SaveAtomic()
-	return &n, nil
+	return n
 }
 
-func NodeDelete(st *state.State, id string) error {
-	idx := -1
+func findNode(st *state.State, id string) int {
 	for i := range st.Nodes {
 		if st.Nodes[i].ID == id {
-			idx = i
-			break
+			return i
 		}
 	}
-	if idx < 0 {
-		return fmt.Errorf("node not found")
-	}
-	st.Nodes = append(st.Nodes[:idx], st.Nodes[idx+1:]...)
-	if err := Apply(st, false); err != nil {
-		return err
+	return -1
+}
+
+// NodeEndpoint collects the client-facing parameters of a node at the
+// primary address (listenHost:listenPort).
+func NodeEndpoint(st *state.State, id string) (clientcfg.Endpoint, error) {
+	eps, err := NodeAdvertised(st, id)
+	if err != nil {
+		return clientcfg.Endpoint{}, err
 	}
-	_ = st.SaveAtomic()
-	return nil
+	return eps[0], nil
 }
 
-func NodeSetEnabled(st *state.State, id string, enabled bool) error {
-	for i := range st.Nodes {
-		if st.Nodes[i].ID == id {
-			st.Nodes[i].Enabled = enabled
-			st.Nodes[i].UpdatedAt = app.NowRFC3339()
-			if err := Apply(st, false); err != nil {
-				return err
-			}
-			_ = st.SaveAtomic()
-			return nil
+// NodeAdvertised returns a node's endpoint at the primary address followed
+// by one per settings.endpoints entry, named "<node>-<endpoint>".
+func NodeAdvertised(st *state.State, id string) ([]clientcfg.Endpoint, error) {
+	idx := findNode(st, id)
+	if idx < 0 {
+		return nil, ErrNodeNotFound
+	}
+	n := st.Nodes[idx]
+	pin, _ := crypto.ParseCertPin(app.HysteriaCertPath)
+	host := st.Settings.ListenHost
+	if host == "" {
+		host = netutil.PublicIP()
+	}
+	sni := st.Settings.SNI
+	if n.SNI != "" {
+		sni = n.SNI
+	}
+	primary := clientcfg.Endpoint{
+		Name:      n.Name,
+		Host:      host,
+		Port:      st.Settings.ListenPort,
+		Auth:      n.Username + ":" + n.Password,
+		SNI:       sni,
+		Insecure:  true,
+		PinSHA256: pin,
+	}
+	eps := []clientcfg.Endpoint{primary}
+	for _, adv := range st.Settings.Endpoints {
+		ep := primary
+		ep.Name = n.Name + "-" + adv.Name
+		ep.Host = adv.Host
+		if adv.Port != 0 {
+			ep.Port = adv.Port
+		}
+		ep.Ports = adv.Ports
+		if adv.SNI != "" {
+			ep.SNI = adv.SNI
+		}
+		if adv.VerifyTLS {
+			ep.Insecure, ep.PinSHA256 = false, ""
 		}
+		eps = append(eps, ep)
 	}
-	return fmt.Errorf("node not found")
+	return eps, nil
 }
 
-func NodeResetPassword(st *state.State, id string) error {
-	for i := range st.Nodes {
-		if st.Nodes[i].ID == id {
-			pass, _ := app.RandToken(16)
-			st.Nodes[i].Password = pass
-			st.Nodes[i].UpdatedAt = app.NowRFC3339()
-			if err := Apply(st, false); err != nil {
-				return err
-			}
-			_ = st.SaveAtomic()
-			return nil
+// NodeEndpoints returns every advertised endpoint of nodes, skipping
+// unknown ids.
+func NodeEndpoints(st *state.State, nodes []state.Node) []clientcfg.Endpoint {
+	var eps []clientcfg.Endpoint
+	for _, n := range nodes {
+		if adv, err := NodeAdvertised(st, n.ID); err == nil {
+			eps = append(eps, adv...)
 		}
 	}
-	return fmt.Errorf("node not found")
+	return eps
 }
 
+// NodeURI is the node's URI at the primary address.
 func NodeURI(st *state.State, id string) (string, error) {
-	var n *state.Node
-	for i := range st.Nodes {
-		if st.Nodes[i].ID == id {
-			n = &st.Nodes[i]
-			break
-		}
-	}
-	if n == nil {
-		return "", fmt.Errorf("node not found")
+	ep, err := NodeEndpoint(st, id)
+	if err != nil {
+		return "", err
 	}
-	pin, _ := crypto.ParseCertPin(app.HysteriaCertPath)
-	host := st.Settings.ListenHost
-	if host == "" {
-		host = netutil.PublicIP()
+	return clientcfg.URI(ep), nil
+}
+
+// NodeURIs returns one URI per advertised endpoint, primary first.
+func NodeURIs(st *state.State, id string) ([]string, error) {
+	eps, err := NodeAdvertised(st, id)
+	if err != nil {
+		return nil, err
 	}
-	auth := url.QueryEscape(n.Username + ":" + n.Password)
-	q := url.Values{}
-	q.Set("insecure", "1")
-	q.Set("sni", st.Settings.SNI)
-	if pin != "" {
-		q.Set("pinSHA256", pin)
+	uris := make([]string, len(eps))
+	for i, ep := range eps {
+		uris[i] = clientcfg.URI(ep)
 	}
-	return fmt.Sprintf("hysteria2://%s@%s:%d/?%s", auth, host, st.Settings.ListenPort, q.Encode()), nil
+	return uris, nil
 }
 
-func SubscriptionRotate(st *state.State) (string, string, error) {
+func rotateSubscription(st *state.State) (string, string, error) {
 	token, err := app.RandToken(18)
 	if err != nil {
 		return "", "", err
 	}
-	sum := sha256.Sum256([]byte(token))
-	st.Subscription.TokenSHA256 = hex.EncodeToString(sum[:])
+	st.Subscription.TokenSHA256 = hashToken(token)
 	st.Subscription.CreatedAt = app.NowRFC3339()
 	st.Subscription.RevokedAt = ""
-	_ = st.SaveAtomic()
-	return token, "/sub/" + token, nil
+	return token, SubscriptionPath(st, token), nil
 }
 
 func SubscriptionVerify(st *state.State, token string) bool {
 	if st.Subscription.TokenSHA256 == "" || st.Subscription.RevokedAt != "" {
 		return false
 	}
-	sum := sha256.Sum256([]byte(token))
-	a := hex.EncodeToString(sum[:])
-	return subtle.ConstantTimeCompare([]byte(a), []byte(st.Subscription.TokenSHA256)) == 1
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(st.Subscription.TokenSHA256)) == 1
 }
 
 func SaveConfigPreview(st *state.State) (string, error) {
@@ -290,13 +337,22 @@ func SaveConfigPreview(st *state.State) (string, error) {
 			users[n.Username] = "***"
 		}
 	}
-	y, err := hysteria.GenerateYAML(st.Settings.ListenPort, app.HysteriaCertPath, app.HysteriaKeyPath, users, st.Settings.MasqueradeURL, st.Settings.MasqueradeRewrite)
+	y, err := hysteria.GenerateYAML(st.Settings.ListenPort, app.HysteriaCertPath, app.HysteriaKeyPath, users, st.Settings.MasqueradeURL, st.Settings.MasqueradeRewrite, trafficStats(st, "***"))
 	if err != nil {
 		return "", err
 	}
 	return string(y), nil
 }
 
+// trafficStats is the stats API section of hysteria's config, nil when
+// disabled.
+func trafficStats(st *state.State, secret string) *hysteria.TrafficStats {
+	if st.Settings.TrafficStatsListen == "" {
+		return nil
+	}
+	return &hysteria.TrafficStats{Listen: st.Settings.TrafficStatsListen, Secret: secret}
+}
+
 func atoi(s string) int {
 	n := 0
 	for _, c := range s {
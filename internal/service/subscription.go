@@ -0,0 +1,248 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/hysteria"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+var ErrNoSubscription = errors.New("no active subscription token for this scope")
+
+// SubscriptionPath is the URL path of token, below the secret prefix.
+func SubscriptionPath(st *state.State, token string) string {
+	return st.Settings.SubscriptionPathPrefix + "/sub/" + token
+}
+
+// SharePath is the URL path of the human-facing share page of token.
+func SharePath(st *state.State, token string) string {
+	return st.Settings.SubscriptionPathPrefix + "/share/" + token
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SubscriptionResolve finds the active token matching token: the global one
+// or a per-node/per-tag one. The returned value is a copy.
+func SubscriptionResolve(st *state.State, token string) (state.Subscription, bool) {
+	h := []byte(hashToken(token))
+	if SubscriptionVerify(st, token) {
+		return st.Subscription, true
+	}
+	for _, sub := range st.Subscriptions {
+		if sub.RevokedAt != "" || sub.TokenSHA256 == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare(h, []byte(sub.TokenSHA256)) == 1 {
+			return sub, true
+		}
+	}
+	return state.Subscription{}, false
+}
+
+// SubscriptionNodes returns the enabled nodes a token grants, oldest first.
+func SubscriptionNodes(st *state.State, sub state.Subscription) []state.Node {
+	var out []state.Node
+	for _, n := range st.NodesSorted() {
+		if !n.Enabled {
+			continue
+		}
+		switch {
+		case sub.NodeID != "":
+			if n.ID != sub.NodeID {
+				continue
+			}
+		case sub.Tag != "":
+			if !hasTag(n, sub.Tag) {
+				continue
+			}
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// Usage is what a subscription advertises in Subscription-Userinfo.
+type Usage struct {
+	Upload, Download int64 // bytes since hysteria started; 0 without its stats API
+	Total            int64 // bytes; 0 = unlimited
+	Expire           int64 // unix seconds; 0 = never
+}
+
+// SubscriptionUsage sums the quotas of nodes (unlimited if any node is),
+// picks the earliest expiry and, when hysteria's trafficStats API is
+// configured, adds up the nodes' traffic. Traffic stays 0 if the API does
+// not answer.
+func SubscriptionUsage(st *state.State, nodes []state.Node) Usage {
+	var u Usage
+	var traffic map[string]hysteria.UserTraffic
+	if set := st.Settings; set.TrafficStatsListen != "" {
+		traffic = subTraffic.get(set.TrafficStatsListen, set.TrafficStatsSecret)
+	}
+	unlimited := false
+	for _, n := range nodes {
+		if n.QuotaBytes <= 0 {
+			unlimited = true
+		}
+		u.Total += n.QuotaBytes
+		if t, err := time.Parse(time.RFC3339, n.ExpiresAt); err == nil {
+			if u.Expire == 0 || t.Unix() < u.Expire {
+				u.Expire = t.Unix()
+			}
+		}
+		// Rx is what the client sent: its upload.
+		u.Upload += traffic[n.Username].Rx
+		u.Download += traffic[n.Username].Tx
+	}
+	if unlimited {
+		u.Total = 0
+	}
+	return u
+}
+
+// subTraffic caches the stats API's answer (or failure) for subscription
+// fetches: /sub is public, so fetches must neither wait on the local API
+// nor make it be called at will.
+var subTraffic = &trafficCache{ttl: 30 * time.Second, timeout: 500 * time.Millisecond}
+
+type trafficCache struct {
+	ttl, timeout time.Duration
+
+	mu      sync.Mutex
+	key     string
+	fetched time.Time
+	traffic map[string]hysteria.UserTraffic
+}
+
+func (c *trafficCache) get(listen, secret string) map[string]hysteria.UserTraffic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := listen + "\x00" + secret
+	if key == c.key && time.Since(c.fetched) < c.ttl {
+		return c.traffic
+	}
+	client := hysteria.NewStatsClient(listen, secret)
+	client.HTTP.Timeout = c.timeout
+	c.traffic, _ = client.Traffic()
+	c.key, c.fetched = key, time.Now()
+	return c.traffic
+}
+
+func hasTag(n state.Node, tag string) bool {
+	for _, t := range n.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// rotateScopedSubscription revokes the active tokens of one scope (a node or
+// a tag) and issues a new one; other scopes are untouched.
+func rotateScopedSubscription(st *state.State, nodeID, tag string) (string, string, error) {
+	if nodeID != "" && findNode(st, nodeID) < 0 {
+		return "", "", ErrNodeNotFound
+	}
+	revokeScoped(st, nodeID, tag)
+	token, err := app.RandToken(18)
+	if err != nil {
+		return "", "", err
+	}
+	id, err := app.RandToken(4)
+	if err != nil {
+		return "", "", err
+	}
+	st.Subscriptions = append(st.Subscriptions, state.Subscription{
+		ID:          id,
+		NodeID:      nodeID,
+		Tag:         tag,
+		TokenSHA256: hashToken(token),
+		CreatedAt:   app.NowRFC3339(),
+	})
+	return token, SubscriptionPath(st, token), nil
+}
+
+func revokeScoped(st *state.State, nodeID, tag string) int {
+	n := 0
+	now := app.NowRFC3339()
+	for i := range st.Subscriptions {
+		sub := &st.Subscriptions[i]
+		if sub.RevokedAt == "" && sub.NodeID == nodeID && sub.Tag == tag {
+			sub.RevokedAt = now
+			n++
+		}
+	}
+	return n
+}
+
+// ScopedSubscriptions returns the active per-node/per-tag tokens.
+func ScopedSubscriptions(st *state.State) []state.Subscription {
+	var out []state.Subscription
+	for _, sub := range st.Subscriptions {
+		if sub.RevokedAt == "" {
+			out = append(out, sub)
+		}
+	}
+	return out
+}
+
+// SubscriptionRevokeID revokes a token by ID; "global" is the global token.
+func (m *Manager) SubscriptionRevokeID(id string) error {
+	return m.UpdateNoApply("subscription.revoke", id, func(st *state.State) error {
+		now := app.NowRFC3339()
+		if id == "global" {
+			if st.Subscription.TokenSHA256 == "" || st.Subscription.RevokedAt != "" {
+				return ErrNoSubscription
+			}
+			st.Subscription.RevokedAt = now
+			return nil
+		}
+		for i := range st.Subscriptions {
+			if st.Subscriptions[i].ID == id && st.Subscriptions[i].RevokedAt == "" {
+				st.Subscriptions[i].RevokedAt = now
+				return nil
+			}
+		}
+		return ErrNoSubscription
+	})
+}
+
+func (m *Manager) ScopedSubscriptionRotate(nodeID, tag string) (token, urlPath string, err error) {
+	if (nodeID == "") == (tag == "") {
+		return "", "", fmt.Errorf("exactly one of node id or tag required")
+	}
+	err = m.UpdateNoApply(scopedAction(nodeID, tag, "rotate"), nodeID+tag, func(st *state.State) error {
+		token, urlPath, err = rotateScopedSubscription(st, nodeID, tag)
+		return err
+	})
+	return token, urlPath, err
+}
+
+func (m *Manager) ScopedSubscriptionRevoke(nodeID, tag string) error {
+	if (nodeID == "") == (tag == "") {
+		return fmt.Errorf("exactly one of node id or tag required")
+	}
+	return m.UpdateNoApply(scopedAction(nodeID, tag, "revoke"), nodeID+tag, func(st *state.State) error {
+		if revokeScoped(st, nodeID, tag) == 0 {
+			return ErrNoSubscription
+		}
+		return nil
+	})
+}
+
+// scopedAction is the audit action for verb on a node or tag token.
+func scopedAction(nodeID, tag, verb string) string {
+	if tag != "" {
+		return "subscription.tag." + verb
+	}
+	return "subscription.node." + verb
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+)
+
+func TestScopedSubscriptions(t *testing.T) {
+	st, _ := state.LoadFrom(state.NewFileStore(filepath.Join(t.TempDir(), "state.json"), ""))
+	m := NewManager(st)
+	m.ApplyFunc = func(*state.State, bool) error { return nil }
+	a, _ := m.NodeAdd("alice", "", "", "team-a")
+	b, _ := m.NodeAdd("bob", "", "", "team-a")
+	c, _ := m.NodeAdd("carol", "", "")
+
+	tokA, _, err := m.ScopedSubscriptionRotate(a.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokC, _, _ := m.ScopedSubscriptionRotate(c.ID, "")
+	tokTeam, _, _ := m.ScopedSubscriptionRotate("", "team-a")
+
+	nodesFor := func(token string) []string {
+		sub, ok := SubscriptionResolve(m.State(), token)
+		if !ok {
+			return nil
+		}
+		var ids []string
+		for _, n := range SubscriptionNodes(m.State(), sub) {
+			ids = append(ids, n.ID)
+		}
+		return ids
+	}
+	if got := nodesFor(tokA); len(got) != 1 || got[0] != a.ID {
+		t.Fatalf("alice token -> %v", got)
+	}
+	if got := nodesFor(tokTeam); len(got) != 2 || got[0] != a.ID || got[1] != b.ID {
+		t.Fatalf("team token -> %v", got)
+	}
+
+	// Rotating alice must not disturb carol or the team link.
+	newA, _, _ := m.ScopedSubscriptionRotate(a.ID, "")
+	if nodesFor(tokA) != nil || len(nodesFor(newA)) != 1 {
+		t.Fatal("alice rotation did not replace her token")
+	}
+	if len(nodesFor(tokC)) != 1 || len(nodesFor(tokTeam)) != 2 {
+		t.Fatal("rotation disturbed other tokens")
+	}
+
+	if err := m.ScopedSubscriptionRevoke(c.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if nodesFor(tokC) != nil || len(nodesFor(newA)) != 1 {
+		t.Fatal("revoke affected the wrong token")
+	}
+
+	if err := m.NodeDelete(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if nodesFor(newA) != nil {
+		t.Fatal("deleting a node must revoke its token")
+	}
+	if _, _, err := m.ScopedSubscriptionRotate("missing", ""); err != ErrNodeNotFound {
+		t.Fatalf("want ErrNodeNotFound, got %v", err)
+	}
+}
+
+func TestSubscriptionUsage(t *testing.T) {
+	nodes := []state.Node{
+		{Username: "a", QuotaBytes: 10, ExpiresAt: "2030-01-02T00:00:00Z"},
+		{Username: "b", QuotaBytes: 5, ExpiresAt: "2030-01-01T00:00:00Z"},
+	}
+	st := state.Default()
+	u := SubscriptionUsage(st, nodes)
+	if u.Total != 15 || u.Expire != 1893456000 || u.Upload != 0 || u.Download != 0 {
+		t.Fatalf("usage = %+v", u)
+	}
+	if u := SubscriptionUsage(st, append(nodes, state.Node{})); u.Total != 0 || u.Expire != 1893456000 {
+		t.Fatalf("one unlimited node must make the total unlimited: %+v", u)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/traffic" || r.Header.Get("Authorization") != "s3" {
+			http.Error(w, "no", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"a":{"tx":100,"rx":7},"b":{"tx":20,"rx":3},"gone":{"tx":1000,"rx":1000}}`)
+	}))
+	defer ts.Close()
+	st.Settings.TrafficStatsListen, st.Settings.TrafficStatsSecret = strings.TrimPrefix(ts.URL, "http://"), "s3"
+	if u := SubscriptionUsage(st, nodes); u.Upload != 10 || u.Download != 120 || u.Total != 15 {
+		t.Fatalf("usage with stats = %+v", u)
+	}
+	st.Settings.TrafficStatsSecret = "wrong"
+	if u := SubscriptionUsage(st, nodes); u.Upload != 0 || u.Download != 0 || u.Total != 15 {
+		t.Fatalf("usage when the API fails = %+v", u)
+	}
+}
+
+func TestSubscriptionTrafficCached(t *testing.T) {
+	var mu sync.Mutex
+	calls, delay := 0, time.Duration(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		d := delay
+		mu.Unlock()
+		time.Sleep(d)
+		io.WriteString(w, `{"a":{"tx":100,"rx":7}}`)
+	}))
+	defer ts.Close()
+	listen := strings.TrimPrefix(ts.URL, "http://")
+	c := &trafficCache{ttl: time.Hour, timeout: 100 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		if got := c.get(listen, ""); got["a"].Tx != 100 {
+			t.Fatalf("traffic = %+v", got)
+		}
+	}
+	mu.Lock()
+	if calls != 1 {
+		t.Fatalf("stats API called %d times, want 1", calls)
+	}
+	delay = time.Second
+	mu.Unlock()
+
+	// A slow API is given up on quickly, and the failure is cached too.
+	c.fetched = time.Time{}
+	start := time.Now()
+	if got := c.get(listen, ""); got != nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("slow API: traffic = %+v after %s", got, time.Since(start))
+	}
+	c.get(listen, "")
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("stats API called %d times, want 2", calls)
+	}
+}
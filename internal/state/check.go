@@ -0,0 +1,193 @@
+package state
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check validates invariants that the rest of hy2mgr relies on and returns
+// one message per violation.
+func (s *State) Check() []string {
+	var problems []string
+	add := func(format string, args ...any) { problems = append(problems, fmt.Sprintf(format, args...)) }
+
+	if s.Version != CurrentVersion {
+		add("version is %d, expected %d", s.Version, CurrentVersion)
+	}
+	if p := s.Settings.ListenPort; p < 1 || p > 65535 {
+		add("settings.listenPort %d out of range 1-65535", p)
+	}
+	if s.Settings.SNI == "" || strings.ContainsAny(s.Settings.SNI, "/: ") {
+		add("settings.sni %q is not a hostname", s.Settings.SNI)
+	}
+	if u, err := url.Parse(s.Settings.MasqueradeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("settings.masqueradeUrl %q is not an absolute http(s) URL", s.Settings.MasqueradeURL)
+	}
+	if s.Settings.ManageListen != "" {
+		_, port, err := net.SplitHostPort(s.Settings.ManageListen)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+			add("settings.manageListen %q is not host:port", s.Settings.ManageListen)
+		}
+	}
+	for _, c := range s.Settings.ManageAllowCIDRs {
+		if _, n, err := net.ParseCIDR(c); err != nil || n.String() != c {
+			add("settings.manageAllowCidrs %q is not a network address like 203.0.113.0/24", c)
+		}
+	}
+	if l := s.Settings.SubscriptionListen; l != "" {
+		_, port, err := net.SplitHostPort(l)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+			add("settings.subscriptionListen %q is not host:port", l)
+		} else if l == s.Settings.ManageListen {
+			add("settings.subscriptionListen equals manageListen")
+		}
+	}
+	if l := s.Settings.TrafficStatsListen; l != "" {
+		_, port, err := net.SplitHostPort(l)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+			add("settings.trafficStatsListen %q is not host:port", l)
+		}
+	}
+	if l := s.Settings.MetricsListen; l != "" {
+		_, port, err := net.SplitHostPort(l)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+			add("settings.metricsListen %q is not host:port", l)
+		} else if l == s.Settings.ManageListen || l == s.Settings.SubscriptionListen {
+			add("settings.metricsListen must differ from manageListen and subscriptionListen")
+		}
+	}
+	if (s.Settings.SubscriptionTLSCert == "") != (s.Settings.SubscriptionTLSKey == "") {
+		add("settings.subscriptionTlsCert and subscriptionTlsKey must be set together")
+	}
+	if p := s.Settings.SubscriptionPathPrefix; p != "" && (!strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") || strings.ContainsAny(p, "?#{} ")) {
+		add("settings.subscriptionPathPrefix %q must look like /secret", p)
+	}
+	if u := s.Settings.PublicBaseURL; u != "" {
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			add("settings.publicBaseUrl %q is not an absolute http(s) URL", u)
+		}
+	}
+	epNames := map[string]bool{}
+	for i, ep := range s.Settings.Endpoints {
+		switch {
+		case ep.Name == "":
+			add("settings.endpoints[%d] has empty name", i)
+		case epNames[ep.Name]:
+			add("endpoint name %q is duplicated", ep.Name)
+		}
+		epNames[ep.Name] = true
+		if ep.Host == "" {
+			add("endpoint %q has empty host", ep.Name)
+		}
+		if ep.Port < 0 || ep.Port > 65535 {
+			add("endpoint %q port %d out of range", ep.Name, ep.Port)
+		}
+		if ep.Ports != "" && !validPortSpec(ep.Ports) {
+			add("endpoint %q ports %q is not a port list like 20000-50000 or 443,8443", ep.Name, ep.Ports)
+		}
+	}
+	if n := s.Settings.Notify; n != nil {
+		for i, w := range n.Webhooks {
+			if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add("settings.notify.webhooks[%d].url %q is not an absolute http(s) URL", i, w.URL)
+			}
+		}
+		if t := n.Telegram; t != nil && (t.BotToken == "" || t.ChatID == "") {
+			add("settings.notify.telegram needs botToken and chatId")
+		}
+		if m := n.SMTP; m != nil {
+			if _, _, err := net.SplitHostPort(m.Addr); err != nil {
+				add("settings.notify.smtp.addr %q is not host:port", m.Addr)
+			}
+			if m.From == "" || len(m.To) == 0 {
+				add("settings.notify.smtp needs from and to")
+			}
+		}
+		if n.DedupeMinutes < 0 || n.CertWarnDays < 0 {
+			add("settings.notify.dedupeMinutes and certWarnDays must not be negative")
+		}
+	}
+	for i, a := range s.Settings.AuditSinks {
+		switch a.Type {
+		case "journald":
+		case "syslog":
+			if a.Network != "" && a.Network != "udp" && a.Network != "tcp" && a.Network != "tls" {
+				add("settings.auditSinks[%d].network %q is not udp, tcp or tls", i, a.Network)
+			}
+			if _, _, err := net.SplitHostPort(a.Addr); err != nil {
+				add("settings.auditSinks[%d].addr %q is not host:port", i, a.Addr)
+			}
+		case "http":
+			if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add("settings.auditSinks[%d].url %q is not an absolute http(s) URL", i, a.URL)
+			}
+		default:
+			add("settings.auditSinks[%d].type %q is not journald, syslog or http", i, a.Type)
+		}
+	}
+	if s.Admin.Username == "" {
+		add("admin.username is empty")
+	}
+
+	ids := map[string]bool{}
+	users := map[string]string{}
+	for i, n := range s.Nodes {
+		if n.ID == "" {
+			add("nodes[%d] has empty id", i)
+		} else if ids[n.ID] {
+			add("node id %s is duplicated", n.ID)
+		}
+		ids[n.ID] = true
+		if n.Username == "" {
+			add("node %s has empty username", n.ID)
+		} else if other, ok := users[n.Username]; ok {
+			add("username %q is used by nodes %s and %s", n.Username, other, n.ID)
+		} else {
+			users[n.Username] = n.ID
+		}
+		if n.Password == "" {
+			add("node %s has empty password", n.ID)
+		}
+		if n.SNI != "" && strings.ContainsAny(n.SNI, "/: ") {
+			add("node %s sni %q is not a hostname", n.ID, n.SNI)
+		}
+		if n.QuotaBytes < 0 {
+			add("node %s has negative quotaBytes", n.ID)
+		}
+		if _, err := time.Parse(time.RFC3339, n.ExpiresAt); n.ExpiresAt != "" && err != nil {
+			add("node %s expiresAt %q is not RFC3339", n.ID, n.ExpiresAt)
+		}
+	}
+	for _, sub := range s.Subscriptions {
+		if sub.RevokedAt == "" && sub.NodeID != "" && !ids[sub.NodeID] {
+			add("subscription %s points at missing node %s", sub.ID, sub.NodeID)
+		}
+	}
+	return problems
+}
+
+// validPortSpec accepts comma-separated ports and inclusive ranges, the
+// form hysteria uses for port hopping and nftables accepts as set elements.
+func validPortSpec(spec string) bool {
+	for _, part := range strings.Split(spec, ",") {
+		if strings.Trim(part, "0123456789-") != "" {
+			return false
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(from)
+		if err != nil || lo < 1 || lo > 65535 {
+			return false
+		}
+		if isRange {
+			hi, err := strconv.Atoi(to)
+			if err != nil || hi < lo || hi > 65535 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+)
+
+// FileStore keeps the whole State in a single JSON file rewritten atomically.
+type FileStore struct {
+	Path      string
+	BackupDir string
+	mu        sync.Mutex
+}
+
+func NewFileStore(path, backupDir string) *FileStore {
+	return &FileStore{Path: path, BackupDir: backupDir}
+}
+
+func (f *FileStore) Kind() string { return KindJSON }
+
+func (f *FileStore) Close() error { return nil }
+
+func (f *FileStore) Location() string { return f.Path }
+
+func (f *FileStore) Lock() (func(), error) { return flockFile(f.Path + ".lock") }
+
+func (f *FileStore) Load() (*State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(b)
+}
+
+func (f *FileStore) Save(st *State) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, err := os.ReadFile(f.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(cur) > 0 {
+		var disk struct {
+			Revision int64 `json:"revision"`
+		}
+		if err := json.Unmarshal(cur, &disk); err != nil {
+			return err
+		}
+		if disk.Revision != st.Revision {
+			return ErrConflict
+		}
+	}
+	st.Revision++
+	disk, err := forDisk(st)
+	if err != nil {
+		st.Revision--
+		return err
+	}
+	b, err := json.MarshalIndent(disk, "", "  ")
+	if err != nil {
+		st.Revision--
+		return err
+	}
+	// back up the content being replaced (as stored, so still encrypted)
+	if len(cur) > 0 && f.BackupDir != "" {
+		backup := filepath.Join(f.BackupDir, filepath.Base(f.Path)+"."+app.NowRFC3339()+".bak")
+		_ = os.WriteFile(backup, cur, 0600)
+		_ = app.PruneFiles(filepath.Join(f.BackupDir, filepath.Base(f.Path)+".*.bak"), 50)
+	}
+	if err := app.AtomicWriteFile(f.Path, 0600, b); err != nil {
+		st.Revision--
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+//go:build !unix
+
+package state
+
+func flockFile(path string) (func(), error) { return func() {}, nil }
@@ -0,0 +1,122 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// migration upgrades a raw state document from version to-1 to version to.
+// Migrations work on the generic JSON form so they keep working after the
+// Go structs have moved on.
+type migration struct {
+	to    int
+	desc  string
+	apply func(doc map[string]any) error
+}
+
+// migrations is the ordered registry; append new steps at the end.
+// CurrentVersion follows from it.
+var migrations = []migration{
+	{to: 1, desc: "initial schema", apply: func(map[string]any) error { return nil }},
+	{to: 2, desc: "add revision counter; backfill node updatedAt and manageListen", apply: migrateV2},
+	{to: 3, desc: "enable hysteria trafficStats on loopback", apply: migrateV3},
+}
+
+// CurrentVersion is the state schema version written by this build.
+var CurrentVersion = migrations[len(migrations)-1].to
+
+// Migrate upgrades raw to CurrentVersion and reports the version it started
+// from. Documents from a newer hy2mgr are refused rather than downgraded.
+func Migrate(raw []byte) ([]byte, int, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+	from := 0
+	if v, ok := doc["version"].(json.Number); ok {
+		n, err := v.Int64()
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid state version %q", v)
+		}
+		from = int(n)
+	}
+	if from > CurrentVersion {
+		return nil, from, fmt.Errorf("state version %d is newer than this hy2mgr supports (%d); upgrade hy2mgr", from, CurrentVersion)
+	}
+	if from == CurrentVersion {
+		return raw, from, nil
+	}
+	for _, m := range migrations {
+		if m.to <= from {
+			continue
+		}
+		if err := m.apply(doc); err != nil {
+			return nil, from, fmt.Errorf("migrate state to v%d (%s): %w", m.to, m.desc, err)
+		}
+		doc["version"] = m.to
+	}
+	out, err := json.Marshal(doc)
+	return out, from, err
+}
+
+func migrateV2(doc map[string]any) error {
+	if _, ok := doc["revision"]; !ok {
+		doc["revision"] = 0
+	}
+	if settings, ok := doc["settings"].(map[string]any); ok {
+		if s, _ := settings["manageListen"].(string); s == "" {
+			settings["manageListen"] = "0.0.0.0:3333"
+		}
+	}
+	nodes, _ := doc["nodes"].([]any)
+	for _, raw := range nodes {
+		n, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("node is not an object")
+		}
+		if s, _ := n["updatedAt"].(string); s == "" {
+			n["updatedAt"] = n["createdAt"]
+		}
+	}
+	return nil
+}
+
+// decodeState migrates raw and decodes it, remembering the original bytes
+// when a migration ran so LoadFrom can back them up.
+func decodeState(raw []byte) (*State, error) { return decodeStateKEK(raw, nil) }
+
+// decodeStateKEK is decodeState with secrets opened by kek instead of the
+// installed key, unless kek is nil.
+func decodeStateKEK(raw, kek []byte) (*State, error) {
+	migrated, from, err := Migrate(raw)
+	if err != nil {
+		return nil, err
+	}
+	var st State
+	if err := json.Unmarshal(migrated, &st); err != nil {
+		return nil, err
+	}
+	st.kek = kek
+	if err := openSecrets(&st); err != nil {
+		return nil, err
+	}
+	if from != CurrentVersion {
+		st.premigration = raw
+		st.migratedFrom = from
+	}
+	return &st, nil
+}
+
+// migrateV3 turns on hysteria's stats API for existing installs, which the
+// metrics endpoint reads; the secret is generated by the next apply.
+func migrateV3(doc map[string]any) error {
+	if settings, ok := doc["settings"].(map[string]any); ok {
+		if _, ok := settings["trafficStatsListen"]; !ok {
+			settings["trafficStatsListen"] = DefaultTrafficStatsListen
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// Each testdata/vN.json is a state file as written by schema version N; its
+// vN.golden.json is what the current build loads it as.
+func TestMigrateGolden(t *testing.T) {
+	inputs, _ := filepath.Glob("testdata/v*.json")
+	for _, in := range inputs {
+		if strings.HasSuffix(in, ".golden.json") {
+			continue
+		}
+		t.Run(filepath.Base(in), func(t *testing.T) {
+			raw, err := os.ReadFile(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st, err := decodeState(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Version != CurrentVersion {
+				t.Fatalf("version = %d", st.Version)
+			}
+			got, _ := json.MarshalIndent(st, "", "  ")
+			got = append(got, '\n')
+			golden := strings.TrimSuffix(in, ".json") + ".golden.json"
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("migrated %s differs from %s (run with -update):\n%s", in, golden, got)
+			}
+			if problems := st.Check(); len(problems) != 0 {
+				t.Fatalf("migrated state fails check: %v", problems)
+			}
+		})
+	}
+}
+
+func TestMigrateRefusesNewerVersion(t *testing.T) {
+	_, _, err := Migrate([]byte(`{"version": 999}`))
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("want newer-version error, got %v", err)
+	}
+}
+
+func TestLoadWritesPremigrationBackup(t *testing.T) {
+	dir := t.TempDir()
+	raw, _ := os.ReadFile("testdata/v1.json")
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFrom(NewFileStore(path, "")); err != nil {
+		t.Fatal(err)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "backups", "state.json.v1.*.premigrate"))
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v", backups)
+	}
+	if b, _ := os.ReadFile(backups[0]); !bytes.Equal(b, raw) {
+		t.Fatal("backup does not hold the original document")
+	}
+	st, err := NewFileStore(path, "").Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Version != CurrentVersion || st.premigration != nil {
+		t.Fatalf("migrated state was not saved: version %d", st.Version)
+	}
+}
+
+func TestCheckFindsProblems(t *testing.T) {
+	st := Default()
+	st.Settings.ListenPort = 70000
+	st.Settings.MasqueradeURL = "bing.com"
+	st.Nodes = []Node{
+		{ID: "a", Username: "u", Password: "p"},
+		{ID: "a", Username: "u", Password: ""},
+	}
+	got := strings.Join(st.Check(), "\n")
+	for _, want := range []string{"listenPort", "masqueradeUrl", "id a is duplicated", `username "u"`, "empty password"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
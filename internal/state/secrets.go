@@ -0,0 +1,304 @@
+package state
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+)
+
+// KeyPath is the key-encryption key file; overridable for tests. When run
+// under systemd with LoadCredential=state.key:..., the credential wins, and
+// HY2MGR_STATE_KEY_FILE overrides both.
+var KeyPath = app.StateKeyPath
+
+const (
+	encPrefix   = "enc:v1:"
+	envelopeAlg = "aes-256-gcm"
+)
+
+// Envelope describes how secret fields are encrypted at rest: a random data
+// key (DEK) encrypts each field, and the DEK itself is stored wrapped with
+// the key file (KEK). Rekeying replaces both.
+type Envelope struct {
+	Alg        string `json:"alg"`
+	KeyID      string `json:"keyId"`      // first 8 bytes of sha256(KEK), hex
+	WrappedKey string `json:"wrappedKey"` // DEK sealed with the KEK, base64
+}
+
+// secretFields lists every secret string in st together with the AAD that
+// binds its ciphertext to its position. New secret fields go here.
+func secretFields(st *State) map[string]*string {
+	f := map[string]*string{"admin/totpSecret": &st.Admin.TOTPSecret, "settings/trafficStatsSecret": &st.Settings.TrafficStatsSecret}
+	for i := range st.Nodes {
+		f["nodes/"+st.Nodes[i].ID+"/password"] = &st.Nodes[i].Password
+	}
+	if n := st.Settings.Notify; n != nil {
+		for i := range n.Webhooks {
+			f[fmt.Sprintf("settings/notify/webhooks/%d/secret", i)] = &n.Webhooks[i].Secret
+		}
+		if n.Telegram != nil {
+			f["settings/notify/telegram/botToken"] = &n.Telegram.BotToken
+		}
+		if n.SMTP != nil {
+			f["settings/notify/smtp/password"] = &n.SMTP.Password
+		}
+	}
+	for i := range st.Settings.AuditSinks {
+		f[fmt.Sprintf("settings/auditSinks/%d/token", i)] = &st.Settings.AuditSinks[i].Token
+	}
+	return f
+}
+
+// IsSecret reports whether path, in the notation of secretFields
+// ("nodes/<id>/password"), is a secret of st.
+func IsSecret(st *State, path string) bool {
+	_, ok := secretFields(st)[path]
+	return ok
+}
+
+func keyFilePath() string {
+	if p := os.Getenv("HY2MGR_STATE_KEY_FILE"); p != "" {
+		return p
+	}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		p := filepath.Join(dir, "state.key")
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return KeyPath
+}
+
+func loadKEK() ([]byte, error) {
+	path := keyFilePath()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		// Not %w: a missing key must never look like a missing state file.
+		return nil, fmt.Errorf("state secrets are encrypted but the key is unavailable: %v", err)
+	}
+	return parseKEK(b, path)
+}
+
+func parseKEK(b []byte, path string) ([]byte, error) {
+	kek, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(kek) != 32 {
+		return nil, fmt.Errorf("%s: expected 64 hex characters", path)
+	}
+	return kek, nil
+}
+
+func keyID(kek []byte) string {
+	sum := sha256.Sum256(kek)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newEnvelope(kek []byte) (*Envelope, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(kek, dek, []byte("dek"))
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{Alg: envelopeAlg, KeyID: keyID(kek), WrappedKey: base64.StdEncoding.EncodeToString(wrapped)}, nil
+}
+
+func (e *Envelope) dataKey(kek []byte) ([]byte, error) {
+	if e.Alg != envelopeAlg {
+		return nil, fmt.Errorf("unsupported state encryption %q", e.Alg)
+	}
+	if id := keyID(kek); id != e.KeyID {
+		return nil, fmt.Errorf("state key mismatch: state wants key %s, key file is %s", e.KeyID, id)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(e.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(kek, wrapped, []byte("dek"))
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// forDisk returns st itself, or a copy with secret fields encrypted when
+// encryption is enabled.
+func forDisk(st *State) (*State, error) {
+	if st.Encryption == nil {
+		return st, nil
+	}
+	kek := st.kek
+	if kek == nil {
+		var err error
+		if kek, err = loadKEK(); err != nil {
+			return nil, err
+		}
+	}
+	dek, err := st.Encryption.dataKey(kek)
+	if err != nil {
+		return nil, err
+	}
+	cp := st.clone()
+	for aad, p := range secretFields(cp) {
+		if *p == "" {
+			continue
+		}
+		ct, err := seal(dek, []byte(*p), []byte(aad))
+		if err != nil {
+			return nil, err
+		}
+		*p = encPrefix + base64.StdEncoding.EncodeToString(ct)
+	}
+	return cp, nil
+}
+
+// openSecrets decrypts secret fields in place after load, with st.kek if
+// set and the key file otherwise.
+func openSecrets(st *State) error {
+	if st.Encryption == nil {
+		return nil
+	}
+	kek := st.kek
+	if kek == nil {
+		var err error
+		if kek, err = loadKEK(); err != nil {
+			return err
+		}
+	}
+	dek, err := st.Encryption.dataKey(kek)
+	if err != nil {
+		return err
+	}
+	for aad, p := range secretFields(st) {
+		if !strings.HasPrefix(*p, encPrefix) {
+			continue
+		}
+		ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(*p, encPrefix))
+		if err != nil {
+			return fmt.Errorf("decrypt %s: %w", aad, err)
+		}
+		pt, err := open(dek, ct, []byte(aad))
+		if err != nil {
+			return fmt.Errorf("decrypt %s: %w", aad, err)
+		}
+		*p = string(pt)
+	}
+	return nil
+}
+
+// Export is st as the JSON store writes it: secrets stay encrypted when
+// encryption is enabled.
+func Export(st *State) ([]byte, error) {
+	disk, err := forDisk(st)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(disk, "", "  ")
+}
+
+// Import decodes a document written by Export, migrating it if it is
+// older. keyFile is the content of the key file its secrets are encrypted
+// with; nil uses the installed key.
+func Import(raw, keyFile []byte) (*State, error) {
+	var kek []byte
+	if keyFile != nil {
+		var err error
+		if kek, err = parseKEK(keyFile, "key file"); err != nil {
+			return nil, err
+		}
+	}
+	return decodeStateKEK(raw, kek)
+}
+
+// compact drops superseded data from stores that keep it around.
+func compact(store Store) {
+	if c, ok := store.(interface{ Compact() error }); ok {
+		_ = c.Compact()
+	}
+}
+
+// Rekey generates a new key file and data key and saves st encrypted with
+// them; with plaintext it turns encryption off instead. The new key is only
+// moved into place after the state was saved with it, and the previous key
+// is kept in the backups dir so older backups stay readable. It refuses to
+// run while the key is read from elsewhere (HY2MGR_STATE_KEY_FILE or systemd
+// credentials), since later loads would not see the new key.
+func Rekey(st *State, plaintext bool) error {
+	if plaintext {
+		st.Encryption = nil
+		return st.SaveAtomic()
+	}
+	if p := keyFilePath(); p != KeyPath {
+		return fmt.Errorf("the state key is read from %s (HY2MGR_STATE_KEY_FILE or systemd credentials), not %s; rekey without the override and then provide the new %s there", p, KeyPath, KeyPath)
+	}
+	defer compact(st.store)
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		return err
+	}
+	env, err := newEnvelope(kek)
+	if err != nil {
+		return err
+	}
+	staged := KeyPath + ".new"
+	if err := app.AtomicWriteFile(staged, 0600, []byte(hex.EncodeToString(kek)+"\n")); err != nil {
+		return err
+	}
+	prevEnv := st.Encryption
+	st.Encryption, st.kek = env, kek
+	err = st.SaveAtomic()
+	st.kek = nil
+	if err != nil {
+		st.Encryption = prevEnv
+		_ = os.Remove(staged)
+		return err
+	}
+	if _, err := os.Stat(KeyPath); err == nil {
+		dir := filepath.Join(filepath.Dir(KeyPath), "backups")
+		_ = app.EnsureDir(dir, 0700)
+		_ = os.Rename(KeyPath, filepath.Join(dir, filepath.Base(KeyPath)+"."+app.NowRFC3339()+".retired"))
+	}
+	if err := os.Rename(staged, KeyPath); err != nil {
+		return fmt.Errorf("state saved with new key but it could not be moved from %s to %s: %w", staged, KeyPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRekeyEncryptsSecretsAtRest(t *testing.T) {
+	dir := t.TempDir()
+	old := KeyPath
+	KeyPath = filepath.Join(dir, "state.key")
+	t.Cleanup(func() { KeyPath = old })
+
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			st, _ := LoadFrom(store)
+			st.Admin.TOTPSecret = "JBSWY3DPEHPK3PXP"
+			st.Nodes = []Node{{ID: "n1", Username: "u1", Password: "node-secret-1"}}
+			if err := st.SaveAtomic(); err != nil {
+				t.Fatal(err)
+			}
+			if err := Rekey(st, false); err != nil {
+				t.Fatal(err)
+			}
+			firstKey := st.Encryption.KeyID
+			if err := Rekey(st, false); err != nil {
+				t.Fatal(err)
+			}
+			if st.Encryption.KeyID == firstKey {
+				t.Fatal("rekey kept the old key")
+			}
+
+			raw := rawStore(t, store)
+			for _, secret := range []string{"node-secret-1", "JBSWY3DPEHPK3PXP"} {
+				if bytes.Contains(raw, []byte(secret)) {
+					t.Fatalf("%q stored in plaintext", secret)
+				}
+			}
+
+			got, err := LoadFrom(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Nodes[0].Password != "node-secret-1" || got.Admin.TOTPSecret != "JBSWY3DPEHPK3PXP" {
+				t.Fatalf("secrets not decrypted: %+v %+v", got.Admin, got.Nodes)
+			}
+
+			if err := Rekey(got, true); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(rawStore(t, store), []byte("node-secret-1")) {
+				t.Fatal("--plaintext did not decrypt")
+			}
+		})
+	}
+}
+
+func TestLoadWithoutKeyFails(t *testing.T) {
+	dir := t.TempDir()
+	old := KeyPath
+	KeyPath = filepath.Join(dir, "state.key")
+	t.Cleanup(func() { KeyPath = old })
+	store := NewFileStore(filepath.Join(dir, "state.json"), "")
+	st, _ := LoadFrom(store)
+	st.Nodes = []Node{{ID: "n1", Password: "pw"}}
+	if err := Rekey(st, false); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(KeyPath)
+	if _, err := LoadFrom(store); err == nil || !strings.Contains(err.Error(), "key is unavailable") {
+		t.Fatalf("want missing-key error, got %v", err)
+	}
+}
+
+func TestRekeyRefusesKeyOverride(t *testing.T) {
+	dir := t.TempDir()
+	old := KeyPath
+	KeyPath = filepath.Join(dir, "state.key")
+	t.Cleanup(func() { KeyPath = old })
+	st, _ := LoadFrom(NewFileStore(filepath.Join(dir, "state.json"), ""))
+	st.Nodes = []Node{{ID: "n1", Password: "pw"}}
+
+	creds := filepath.Join(dir, "creds")
+	_ = os.MkdirAll(creds, 0700)
+	_ = os.WriteFile(filepath.Join(creds, "state.key"), []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	for _, env := range [][2]string{
+		{"HY2MGR_STATE_KEY_FILE", filepath.Join(dir, "other.key")},
+		{"CREDENTIALS_DIRECTORY", creds},
+	} {
+		t.Run(env[0], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			if err := Rekey(st, false); err == nil || !strings.Contains(err.Error(), "rekey without the override") {
+				t.Fatalf("Rekey = %v", err)
+			}
+			if st.Encryption != nil {
+				t.Fatal("state encrypted under a key later loads would not read")
+			}
+			if _, err := os.Stat(KeyPath); !os.IsNotExist(err) {
+				t.Fatalf("key written to %s: %v", KeyPath, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreBackupHoldsPreviousContent(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(filepath.Join(dir, "state.json"), dir)
+	st, _ := LoadFrom(store)
+	st.Settings.SNI = "first.example"
+	_ = st.SaveAtomic()
+	st.Settings.SNI = "second.example"
+	_ = st.SaveAtomic()
+	backups, _ := filepath.Glob(filepath.Join(dir, "state.json.*.bak"))
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v", backups)
+	}
+	b, _ := os.ReadFile(backups[0])
+	if !bytes.Contains(b, []byte("first.example")) || bytes.Contains(b, []byte("second.example")) {
+		t.Fatalf("backup should hold the replaced content:\n%s", b)
+	}
+}
+
+// rawStore returns everything a store persisted, for plaintext checks.
+func rawStore(t *testing.T, store Store) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	matches, _ := filepath.Glob(store.Location() + "*")
+	for _, m := range matches {
+		b, _ := os.ReadFile(m)
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
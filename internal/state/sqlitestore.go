@@ -0,0 +1,227 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore keeps nodes as individual rows and everything else as one JSON
+// document, so new State fields need no schema change. Every Save runs in a
+// single transaction and only touches node rows that actually changed.
+type SQLiteStore struct {
+	Path string
+	db   *sql.DB
+	mu   sync.Mutex
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS nodes (
+	id   TEXT PRIMARY KEY,
+	seq  INTEGER NOT NULL,
+	data TEXT NOT NULL
+);
+`
+
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_pragma=secure_delete(1)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// database/sql pools connections; SQLite only has one writer anyway.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("init sqlite schema: %w", err)
+	}
+	_ = os.Chmod(path, 0600)
+	return &SQLiteStore{Path: path, db: db}, nil
+}
+
+func (s *SQLiteStore) Kind() string { return KindSQLite }
+
+func (s *SQLiteStore) Close() error { return s.db.Close() }
+
+func (s *SQLiteStore) Location() string { return s.Path }
+
+// Compact rewrites the database and truncates the WAL so no superseded page
+// (for example plaintext secrets from before a rekey) lingers on disk.
+func (s *SQLiteStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+func (s *SQLiteStore) Lock() (func(), error) { return flockFile(s.Path + ".lock") }
+
+func (s *SQLiteStore) Load() (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var doc string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = 'state'`).Scan(&doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", s.Path, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(doc), &m); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT data FROM nodes ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	nodes := []json.RawMessage{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, json.RawMessage(data))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Reassemble the full document so migrations see the same shape as the
+	// JSON backend.
+	m["nodes"], err = json.Marshal(nodes)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(raw)
+}
+
+func (s *SQLiteStore) Save(st *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var cur string
+	err = tx.QueryRow(`SELECT value FROM meta WHERE key = 'state'`).Scan(&cur)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if cur != "" {
+		var disk struct {
+			Revision int64 `json:"revision"`
+		}
+		if err := json.Unmarshal([]byte(cur), &disk); err != nil {
+			return err
+		}
+		if disk.Revision != st.Revision {
+			return ErrConflict
+		}
+	}
+	st.Revision++
+	committed := false
+	defer func() {
+		if !committed {
+			st.Revision--
+		}
+	}()
+	disk, err := forDisk(st)
+	if err != nil {
+		return err
+	}
+	doc, err := documentWithoutNodes(disk)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO meta(key, value) VALUES('state', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, string(doc)); err != nil {
+		return err
+	}
+
+	existing := map[string]string{}
+	rows, err := tx.Query(`SELECT id, data FROM nodes`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[id] = data
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, n := range disk.Nodes {
+		b, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if old, ok := existing[n.ID]; ok {
+			delete(existing, n.ID)
+			if old == string(b) {
+				if _, err := tx.Exec(`UPDATE nodes SET seq = ? WHERE id = ? AND seq != ?`, i, n.ID, i); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO nodes(id, seq, data) VALUES(?, ?, ?)
+			ON CONFLICT(id) DO UPDATE SET seq = excluded.seq, data = excluded.data`, n.ID, i, string(b)); err != nil {
+			return err
+		}
+	}
+	for id := range existing {
+		if _, err := tx.Exec(`DELETE FROM nodes WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// documentWithoutNodes marshals st with the nodes array stripped; nodes live
+// in their own table.
+func documentWithoutNodes(st *State) ([]byte, error) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "nodes")
+	return json.Marshal(m)
+}
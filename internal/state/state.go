@@ -3,6 +3,7 @@ package state
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
@@ -11,6 +12,9 @@ import (
 	"github.com/yuzeguitarist/hy2mgr/internal/app"
 )
 
+// DefaultTrafficStatsListen is where hysteria serves its stats API.
+const DefaultTrafficStatsListen = "127.0.0.1:25413"
+
 type Settings struct {
 	ListenHost        string `json:"listenHost"`        // server public host/IP (for URI), empty -> auto detect
 	ListenPort        int    `json:"listenPort"`        // UDP port
@@ -19,6 +23,90 @@ type Settings struct {
 	MasqueradeRewrite bool   `json:"masqueradeRewrite"` // rewriteHost
 	ManageListen      string `json:"manageListen"`      // web UI bind, default 0.0.0.0:3333
 	ManagePublic      bool   `json:"managePublic"`      // if true, bind to 0.0.0.0 (explicit)
+	// Sources allowed to reach the web UI port through the local firewall
+	// when ManagePublic is set; empty means anyone.
+	ManageAllowCIDRs []string `json:"manageAllowCidrs,omitempty"`
+	// Auto-revoke a subscription token fetched from more than SubRevokeSubnets
+	// distinct /24 (/48) networks within SubRevokeWindowHours; 0 disables.
+	SubRevokeSubnets     int `json:"subRevokeSubnets,omitempty"`
+	SubRevokeWindowHours int `json:"subRevokeWindowHours,omitempty"` // default 24
+	// Optional public listener that serves only subscriptions, so the admin
+	// UI can stay on a private address.
+	SubscriptionListen     string `json:"subscriptionListen,omitempty"`
+	SubscriptionTLSCert    string `json:"subscriptionTlsCert,omitempty"` // PEM paths; both set -> HTTPS
+	SubscriptionTLSKey     string `json:"subscriptionTlsKey,omitempty"`
+	SubscriptionPathPrefix string `json:"subscriptionPathPrefix,omitempty"` // secret prefix before /sub/
+	PublicBaseURL          string `json:"publicBaseUrl,omitempty"`          // printed subscription URLs start with this
+	// Hysteria's trafficStats API (per-user traffic, online counts) for
+	// /metrics; "" disables it. The secret is generated on apply.
+	TrafficStatsListen string `json:"trafficStatsListen,omitempty"`
+	TrafficStatsSecret string `json:"trafficStatsSecret,omitempty"`
+	// Optional separate listener for /metrics; scrapes authenticate with a
+	// bearer token whose hash is kept here.
+	MetricsListen      string `json:"metricsListen,omitempty"`
+	MetricsTokenSHA256 string `json:"metricsTokenSha256,omitempty"`
+	// Extra addresses advertised to clients besides listenHost:listenPort;
+	// every node gets one URI per endpoint.
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+	// Alert delivery; nil sends nothing.
+	Notify *Notify `json:"notify,omitempty"`
+	// Remote copies of the audit log; the local file is always written.
+	AuditSinks []AuditSink `json:"auditSinks,omitempty"`
+}
+
+// AuditSink forwards audit entries to journald, a syslog server or an
+// HTTP collector.
+type AuditSink struct {
+	Type     string `json:"type"`               // journald, syslog or http
+	Network  string `json:"network,omitempty"`  // syslog: udp (default), tcp or tls
+	Addr     string `json:"addr,omitempty"`     // syslog: host:port
+	Facility string `json:"facility,omitempty"` // syslog: default authpriv
+	CAFile   string `json:"caFile,omitempty"`   // syslog over tls: CA bundle instead of the system roots
+	URL      string `json:"url,omitempty"`      // http: receives JSON lines by POST
+	Token    string `json:"token,omitempty"`    // http: sent as a bearer token
+}
+
+// Notify configures where alerts (service down, cert expiring, failed
+// apply, node over quota, login from a new IP) are sent.
+type Notify struct {
+	Events        []string  `json:"events,omitempty"`        // kinds to send, e.g. "service.down"; empty = all
+	DedupeMinutes int       `json:"dedupeMinutes,omitempty"` // identical alerts suppressed this long; default 60
+	CertWarnDays  int       `json:"certWarnDays,omitempty"`  // warn this long before expiry; default 14
+	Webhooks      []Webhook `json:"webhooks,omitempty"`
+	Telegram      *Telegram `json:"telegram,omitempty"`
+	SMTP          *SMTP     `json:"smtp,omitempty"`
+}
+
+// Webhook receives alerts as a JSON POST; with a secret the body is signed
+// in X-Hy2mgr-Signature: sha256=<hex HMAC>.
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+type Telegram struct {
+	BotToken string `json:"botToken"`
+	ChatID   string `json:"chatId"`
+	APIBase  string `json:"apiBase,omitempty"` // default https://api.telegram.org
+}
+
+type SMTP struct {
+	Addr     string   `json:"addr"` // host:port; STARTTLS is used when offered
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Endpoint is an additional address of this server, e.g. its IPv6 address,
+// a domain or an alternative (forwarded) port.
+type Endpoint struct {
+	Name      string `json:"name"` // suffix of the URI fragment, e.g. "v6"
+	Host      string `json:"host"`
+	Port      int    `json:"port,omitempty"`      // 0 -> settings.listenPort
+	Ports     string `json:"ports,omitempty"`     // port hopping range, e.g. "20000-50000"
+	SNI       string `json:"sni,omitempty"`       // overrides node/global SNI
+	VerifyTLS bool   `json:"verifyTls,omitempty"` // host serves a publicly trusted cert: no insecure=1, no pin
 }
 
 type Admin struct {
@@ -29,13 +117,17 @@ type Admin struct {
 }
 
 type Node struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Username  string `json:"username"` // used for hysteria userpass map key
-	Password  string `json:"password"` // stored root-only; never log
-	Enabled   bool   `json:"enabled"`
-	CreatedAt string `json:"createdAt"`
-	UpdatedAt string `json:"updatedAt"`
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Username   string   `json:"username"` // used for hysteria userpass map key
+	Password   string   `json:"password"` // stored root-only; never log
+	Enabled    bool     `json:"enabled"`
+	Tags       []string `json:"tags,omitempty"`
+	SNI        string   `json:"sni,omitempty"`        // overrides settings.sni for this node
+	QuotaBytes int64    `json:"quotaBytes,omitempty"` // advertised to clients only; 0 = unlimited
+	ExpiresAt  string   `json:"expiresAt,omitempty"`  // RFC3339, advertised to clients only
+	CreatedAt  string   `json:"createdAt"`
+	UpdatedAt  string   `json:"updatedAt"`
 }
 
 type Subscription struct {
@@ -43,27 +135,53 @@ type Subscription struct {
 	TokenSHA256 string `json:"tokenSha256"`
 	CreatedAt   string `json:"createdAt"`
 	RevokedAt   string `json:"revokedAt,omitempty"`
+	// Scoped tokens (State.Subscriptions) only; the global one covers all nodes.
+	ID     string `json:"id,omitempty"`
+	NodeID string `json:"nodeId,omitempty"` // only this node
+	Tag    string `json:"tag,omitempty"`    // only nodes carrying this tag
+}
+
+// FirewallRule records a port hy2mgr opened through a firewall backend.
+type FirewallRule struct {
+	Backend  string `json:"backend"`            // ufw, firewalld, nftables, iptables
+	Proto    string `json:"proto"`              // udp or tcp
+	Spec     string `json:"spec"`               // "443" or "20000-50000"
+	Redirect int    `json:"redirect,omitempty"` // hop range redirected to this port
+	Source   string `json:"source,omitempty"`   // CIDR allowed to connect; "" = anyone
+	Comment  string `json:"comment,omitempty"`
+	AddedAt  string `json:"addedAt"`
 }
 
 type State struct {
-	Version      int          `json:"version"`
-	Settings     Settings     `json:"settings"`
-	Admin        Admin        `json:"admin"`
-	Nodes        []Node       `json:"nodes"`
-	Subscription Subscription `json:"subscription"`
-	mu           sync.Mutex   `json:"-"`
+	Version       int            `json:"version"`
+	Revision      int64          `json:"revision"` // bumped on every save; stale saves fail with ErrConflict
+	Settings      Settings       `json:"settings"`
+	Admin         Admin          `json:"admin"`
+	Nodes         []Node         `json:"nodes"`
+	Subscription  Subscription   `json:"subscription"`            // global token, all nodes
+	Subscriptions []Subscription `json:"subscriptions,omitempty"` // per-node/per-tag tokens; revoked ones kept
+	Firewall      []FirewallRule `json:"firewall,omitempty"`      // rules hy2mgr opened, closed again when unneeded
+	Encryption    *Envelope      `json:"encryption,omitempty"`    // nil: secrets stored in plaintext
+	mu            sync.Mutex     `json:"-"`
+	store         Store
+	kek           []byte // key to seal with during Rekey
+
+	// set by decodeState when the loaded document was migrated
+	premigration []byte
+	migratedFrom int
 }
 
 func Default() *State {
 	return &State{
-		Version: 1,
+		Version: CurrentVersion,
 		Settings: Settings{
-			ListenPort:        443,
-			SNI:               "www.bing.com",
-			MasqueradeURL:     "https://www.bing.com",
-			MasqueradeRewrite: true,
-			ManageListen:      "0.0.0.0:3333",
-			ManagePublic:      false,
+			ListenPort:         443,
+			SNI:                "www.bing.com",
+			MasqueradeURL:      "https://www.bing.com",
+			MasqueradeRewrite:  true,
+			ManageListen:       "0.0.0.0:3333",
+			ManagePublic:       false,
+			TrafficStatsListen: DefaultTrafficStatsListen,
 		},
 		Admin: Admin{
 			Username: "admin",
@@ -75,37 +193,89 @@ func LoadOrInit() (*State, error) {
 	_ = app.EnsureDir(app.StateDir, 0700)
 	_ = app.EnsureDir(app.StateBackups, 0700)
 
-	if _, err := os.Stat(app.StatePath); errors.Is(err, os.ErrNotExist) {
-		st := Default()
-		return st, nil
-	}
-	b, err := os.ReadFile(app.StatePath)
+	store, err := OpenStore()
 	if err != nil {
 		return nil, err
 	}
-	var st State
-	if err := json.Unmarshal(b, &st); err != nil {
+	return LoadFrom(store)
+}
+
+// LoadFrom loads state from store (or defaults if it is empty) and binds the
+// result to it so SaveAtomic writes back to the same backend.
+func LoadFrom(store Store) (*State, error) {
+	st, err := store.Load()
+	if errors.Is(err, os.ErrNotExist) {
+		st = Default()
+	} else if err != nil {
 		return nil, err
 	}
-	if st.Version == 0 {
-		st.Version = 1
+	st.store = store
+	if st.premigration != nil {
+		if err := st.persistMigration(); err != nil {
+			return nil, err
+		}
 	}
-	return &st, nil
+	return st, nil
 }
 
+// persistMigration keeps the pre-migration document in the backups dir next
+// to the store and saves the upgraded state.
+func (s *State) persistMigration() error {
+	dir := filepath.Join(filepath.Dir(s.store.Location()), "backups")
+	if err := app.EnsureDir(dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s.v%d.%s.premigrate", filepath.Base(s.store.Location()), s.migratedFrom, app.NowRFC3339())
+	if err := os.WriteFile(filepath.Join(dir, name), s.premigration, 0600); err != nil {
+		return fmt.Errorf("write pre-migration backup: %w", err)
+	}
+	if err := s.SaveAtomic(); err != nil {
+		return fmt.Errorf("save migrated state: %w", err)
+	}
+	s.premigration = nil
+	return nil
+}
+
+// Store returns the backend this state was loaded from.
+func (s *State) Store() Store { return s.store }
+
+// SetStore rebinds the state to another backend (used by migrations).
+func (s *State) SetStore(store Store) { s.store = store }
+
+// SaveAtomic saves under the store's cross-process lock. It fails with
+// ErrConflict if someone else saved since this state was loaded.
 func (s *State) SaveAtomic() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	b, err := json.MarshalIndent(s, "", "  ")
+	if s.store == nil {
+		s.store = NewFileStore(app.StatePath, app.StateBackups)
+	}
+	unlock, err := s.store.Lock()
 	if err != nil {
 		return err
 	}
-	// backup
-	if _, err := os.Stat(app.StatePath); err == nil {
-		backup := filepath.Join(app.StateBackups, filepath.Base(app.StatePath)+"."+app.NowRFC3339()+".bak")
-		_ = os.WriteFile(backup, b, 0600)
+	defer unlock()
+	return s.store.Save(s)
+}
+
+// Clone returns a deep copy bound to the same store.
+func (s *State) Clone() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clone()
+}
+
+func (s *State) clone() *State {
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic("state: clone: " + err.Error())
+	}
+	var cp State
+	if err := json.Unmarshal(b, &cp); err != nil {
+		panic("state: clone: " + err.Error())
 	}
-	return app.AtomicWriteFile(app.StatePath, 0600, b)
+	cp.store = s.store
+	return &cp
 }
 
 func (s *State) NodesSorted() []Node {
@@ -0,0 +1,56 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+)
+
+// ErrConflict is returned by Save when the stored revision moved on since
+// the state being saved was loaded.
+var ErrConflict = errors.New("state was changed by another process; reload and retry")
+
+// Store persists a State. Implementations serialize their own writes and are
+// safe for concurrent use; callers still own locking of the in-memory State.
+type Store interface {
+	// Load returns os.ErrNotExist (wrapped) when nothing has been saved yet.
+	Load() (*State, error)
+	// Save writes st if its Revision matches the stored one and bumps it,
+	// otherwise returns ErrConflict. Callers hold Lock for load/modify/save
+	// sequences that must not interleave with other processes.
+	Save(st *State) error
+	// Lock takes an exclusive cross-process lock (flock) on the store.
+	Lock() (unlock func(), err error)
+	// Location is the file to watch for external changes.
+	Location() string
+	Kind() string
+	Close() error
+}
+
+const (
+	KindJSON   = "json"
+	KindSQLite = "sqlite"
+)
+
+// OpenStore picks the backend in use on this host: the SQLite database if it
+// exists, otherwise the JSON file.
+func OpenStore() (Store, error) {
+	if _, err := os.Stat(app.StateDBPath); err == nil {
+		return OpenSQLiteStore(app.StateDBPath)
+	}
+	return NewFileStore(app.StatePath, app.StateBackups), nil
+}
+
+// OpenStoreKind opens the named backend at its default location.
+func OpenStoreKind(kind string) (Store, error) {
+	switch kind {
+	case KindJSON:
+		return NewFileStore(app.StatePath, app.StateBackups), nil
+	case KindSQLite:
+		return OpenSQLiteStore(app.StateDBPath)
+	default:
+		return nil, fmt.Errorf("unknown state backend %q (want %s or %s)", kind, KindJSON, KindSQLite)
+	}
+}
@@ -0,0 +1,155 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	dir := t.TempDir()
+	sq, err := OpenSQLiteStore(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sq.Close() })
+	return map[string]Store{
+		KindJSON:   NewFileStore(filepath.Join(dir, "state.json"), filepath.Join(dir, "backups")),
+		KindSQLite: sq,
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			if _, err := store.Load(); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("empty store: want ErrNotExist, got %v", err)
+			}
+			st, err := LoadFrom(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st.Settings.ListenPort = 8443
+			st.Nodes = []Node{{ID: "a", Name: "one", Enabled: true}, {ID: "b", Name: "two"}}
+			if err := st.SaveAtomic(); err != nil {
+				t.Fatal(err)
+			}
+
+			st.Nodes = []Node{{ID: "b", Name: "two-renamed"}, {ID: "c", Name: "three"}}
+			if err := st.SaveAtomic(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Settings.ListenPort != 8443 {
+				t.Fatalf("port = %d", got.Settings.ListenPort)
+			}
+			if len(got.Nodes) != 2 || got.Nodes[0].Name != "two-renamed" || got.Nodes[1].ID != "c" {
+				t.Fatalf("nodes = %+v", got.Nodes)
+			}
+		})
+	}
+}
+
+func TestStoreConcurrentSave(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			won := 0
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					st := Default()
+					st.Nodes = []Node{{ID: string(rune('a' + i))}}
+					err := store.Save(st)
+					if err != nil && !errors.Is(err, ErrConflict) {
+						t.Error(err)
+					}
+					mu.Lock()
+					if err == nil {
+						won++
+					}
+					mu.Unlock()
+				}(i)
+			}
+			wg.Wait()
+			if won != 1 {
+				t.Fatalf("want exactly one writer to win, got %d", won)
+			}
+			got, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Nodes) != 1 || got.Revision != 1 {
+				t.Fatalf("got revision %d nodes %+v", got.Revision, got.Nodes)
+			}
+		})
+	}
+}
+
+func TestStoreRejectsStaleSave(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			a, _ := LoadFrom(store)
+			if err := a.SaveAtomic(); err != nil {
+				t.Fatal(err)
+			}
+			b, _ := LoadFrom(store)
+			c, _ := LoadFrom(store)
+			b.Nodes = []Node{{ID: "b"}}
+			if err := b.SaveAtomic(); err != nil {
+				t.Fatal(err)
+			}
+			c.Nodes = []Node{{ID: "c"}}
+			if err := c.SaveAtomic(); !errors.Is(err, ErrConflict) {
+				t.Fatalf("want ErrConflict, got %v", err)
+			}
+			if c.Revision != b.Revision-1 {
+				t.Fatalf("failed save must not bump revision: %d vs %d", c.Revision, b.Revision)
+			}
+			got, _ := store.Load()
+			if len(got.Nodes) != 1 || got.Nodes[0].ID != "b" {
+				t.Fatalf("stale save clobbered state: %+v", got.Nodes)
+			}
+		})
+	}
+}
+
+func TestWatchSeesAtomicReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, path, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	st, _ := LoadFrom(NewFileStore(path, ""))
+	if err := st.SaveAtomic(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change notification")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
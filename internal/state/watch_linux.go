@@ -0,0 +1,63 @@
+package state
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Watch calls onChange (debounced) whenever path, or a sibling sharing its
+// name as prefix such as SQLite's -wal file, is written or replaced. It
+// watches the directory because saves replace the file via rename.
+func Watch(ctx context.Context, path string, onChange func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// A non-blocking fd wrapped in os.File uses the runtime poller, so Close
+	// unblocks the pending Read.
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MODIFY | syscall.IN_CREATE)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = f.Close()
+	}()
+
+	var timer *time.Timer
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		hit := false
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+int(ev.Len)]), "\x00")
+			if strings.HasPrefix(name, base) && !strings.HasSuffix(name, ".lock") {
+				hit = true
+			}
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+		}
+		if !hit {
+			continue
+		}
+		if timer == nil {
+			timer = time.AfterFunc(200*time.Millisecond, onChange)
+		} else {
+			timer.Reset(200 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package state
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls path's modification time where inotify is unavailable.
+func Watch(ctx context.Context, path string, onChange func()) error {
+	var last time.Time
+	if fi, err := os.Stat(path); err == nil {
+		last = fi.ModTime()
+	}
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if fi, err := os.Stat(path); err == nil && !fi.ModTime().Equal(last) {
+				last = fi.ModTime()
+				onChange()
+			}
+		}
+	}
+}
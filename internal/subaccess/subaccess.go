@@ -0,0 +1,157 @@
+// Package subaccess keeps a bounded log of subscription fetches so the web
+// UI can show who uses a token and abusive tokens can be spotted.
+package subaccess
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+)
+
+// Path is the access log location; overridable for tests.
+var Path = app.SubAccessPath
+
+// GlobalID identifies the global subscription token, which has no ID.
+const GlobalID = "global"
+
+type Fetch struct {
+	Time      string `json:"time"`
+	TokenID   string `json:"tokenId"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"ua,omitempty"`
+	Format    string `json:"format"`
+}
+
+// Stats summarises the fetches of one token still held by the log.
+type Stats struct {
+	Fetches     int    `json:"fetches"`
+	LastFetch   string `json:"lastFetch,omitempty"`
+	LastIP      string `json:"lastIp,omitempty"`
+	DistinctIPs int    `json:"distinctIps"`
+}
+
+// Log holds the most recent fetches in memory and appends them to a JSON
+// lines file that is compacted once it grows to twice the limit.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	max     int
+	entries []Fetch
+	lines   int
+}
+
+// Open loads the newest max entries from path. A missing or unreadable file
+// starts an empty log.
+func Open(path string, max int) *Log {
+	l := &Log{path: path, max: max}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return l
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		var f Fetch
+		if json.Unmarshal(sc.Bytes(), &f) == nil {
+			l.entries = append(l.entries, f)
+		}
+		l.lines++
+	}
+	if len(l.entries) > max {
+		l.entries = l.entries[len(l.entries)-max:]
+	}
+	return l
+}
+
+func (l *Log) Record(f Fetch) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f.Time == "" {
+		f.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	l.entries = append(l.entries, f)
+	if len(l.entries) > l.max {
+		l.entries = l.entries[len(l.entries)-l.max:]
+	}
+	if l.path == "" {
+		return
+	}
+	dir := filepath.Dir(l.path)
+	_ = app.EnsureDir(dir, 0750)
+	if l.lines+1 > 2*l.max {
+		var buf bytes.Buffer
+		for _, e := range l.entries {
+			b, _ := json.Marshal(e)
+			buf.Write(append(b, '\n'))
+		}
+		if app.AtomicWriteFile(l.path, 0640, buf.Bytes()) == nil {
+			l.lines = len(l.entries)
+		}
+		return
+	}
+	b, _ := json.Marshal(f)
+	fh, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	if _, err := fh.Write(append(b, '\n')); err == nil {
+		l.lines++
+	}
+}
+
+// Stats returns per-token statistics keyed by token ID.
+func (l *Log) Stats() map[string]Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := map[string]Stats{}
+	ips := map[string]map[string]bool{}
+	for _, f := range l.entries {
+		s := out[f.TokenID]
+		s.Fetches++
+		s.LastFetch, s.LastIP = f.Time, f.IP
+		if ips[f.TokenID] == nil {
+			ips[f.TokenID] = map[string]bool{}
+		}
+		ips[f.TokenID][f.IP] = true
+		s.DistinctIPs = len(ips[f.TokenID])
+		out[f.TokenID] = s
+	}
+	return out
+}
+
+// Subnets counts the distinct /24 (IPv4) or /48 (IPv6) networks a token was
+// fetched from since the given time. Subnets stand in for ASNs, which would
+// need a GeoIP database.
+func (l *Log) Subnets(tokenID string, since time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := map[string]bool{}
+	for _, f := range l.entries {
+		if f.TokenID != tokenID {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, f.Time); err != nil || t.Before(since) {
+			continue
+		}
+		seen[subnet(f.IP)] = true
+	}
+	return len(seen)
+}
+
+func subnet(ip string) string {
+	p := net.ParseIP(ip)
+	if p == nil {
+		return ip
+	}
+	if v4 := p.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return p.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,51 @@
+package subaccess
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogBoundedAndReloaded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l := Open(path, 3)
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "203.0.113.9", "2001:db8:1::1", "2001:db8:1:2::1", "2001:db8:2::1", "203.0.113.10"} {
+		l.Record(Fetch{TokenID: "a", IP: ip, Format: "uri"})
+	}
+	l.Record(Fetch{TokenID: "b", IP: "192.0.2.1", Format: "clash"})
+
+	re := Open(path, 3)
+	st := re.Stats()
+	if st["a"].Fetches != 2 || st["a"].LastIP != "203.0.113.10" || st["b"].Fetches != 1 {
+		t.Fatalf("stats after reload = %+v", st)
+	}
+	if re.lines > 6 {
+		t.Fatalf("file not compacted: %d lines", re.lines)
+	}
+}
+
+func TestSubnets(t *testing.T) {
+	l := Open("", 100)
+	for _, ip := range []string{"198.51.100.1", "198.51.100.200", "203.0.113.9", "2001:db8:1::1", "2001:db8:1:2::1", "2001:db8:2::1"} {
+		l.Record(Fetch{TokenID: "a", IP: ip})
+	}
+	l.Record(Fetch{TokenID: "a", IP: "192.0.2.1", Time: time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)})
+	if n := l.Subnets("a", time.Now().Add(-24*time.Hour)); n != 4 {
+		t.Fatalf("subnets = %d, want 4", n)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(60, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("request %d within burst refused", i)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("burst exceeded but allowed")
+	}
+	if !l.Allow("b") {
+		t.Fatal("other IP limited")
+	}
+}
@@ -0,0 +1,283 @@
+package systemd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Journal runs journalctl; tests substitute a fake.
+type Journal interface {
+	// Open starts journalctl with args and returns its stdout. Closing the
+	// reader stops the process.
+	Open(ctx context.Context, args []string) (io.ReadCloser, error)
+}
+
+// Journalctl is the real journal.
+type Journalctl struct{}
+
+func (Journalctl) Open(ctx context.Context, args []string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &procReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+type procReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (p *procReader) Close() error {
+	p.ReadCloser.Close()
+	if p.cmd.Process != nil {
+		_ = p.cmd.Process.Kill()
+	}
+	_ = p.cmd.Wait()
+	return nil
+}
+
+// DefaultJournal is what JournalEntries and JournalFollow read from.
+var DefaultJournal Journal = Journalctl{}
+
+// Syslog priorities, most severe first; the index is the priority.
+var levels = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// ParseLevel maps a level name (or its usual aliases) to a syslog priority.
+func ParseLevel(s string) (int, error) {
+	switch s = strings.ToLower(s); s {
+	case "error", "fatal":
+		return 3, nil
+	case "warn":
+		return 4, nil
+	}
+	for i, l := range levels {
+		if s == l || s == strconv.Itoa(i) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (want one of %s)", s, strings.Join(levels, ", "))
+}
+
+// Entry is one journal record.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Priority int       `json:"priority"`
+	Level    string    `json:"level"`
+	Unit     string    `json:"unit,omitempty"`
+	Message  string    `json:"message"`
+
+	cursor string
+}
+
+// String renders e the way "hy2mgr logs" prints it.
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %-7s %s", e.Time.Local().Format("2006-01-02 15:04:05"), e.Level, e.Message)
+}
+
+// JournalQuery selects entries of one unit. Zero values mean no filter,
+// except for MaxPriority where that is -1.
+type JournalQuery struct {
+	Unit        string
+	Lines       int // last N matching entries; 0 -> 200
+	MaxPriority int // keep entries at least this severe; -1 -> all
+	Since       time.Time
+	Until       time.Time
+	Grep        string // case-insensitive substring of the message
+}
+
+// scanLines is how far back filtered queries look, since journalctl's -n
+// counts entries before our level/text filters run.
+const scanLines = 5000
+
+func (q JournalQuery) lines() int {
+	if q.Lines <= 0 {
+		return 200
+	}
+	return q.Lines
+}
+
+// args is the journalctl command line for q. Following starts after
+// cursor, or at the end of the journal without one.
+func (q JournalQuery) args(follow bool, cursor string) []string {
+	args := []string{"--no-pager", "-o", "json", "-u", q.Unit}
+	switch {
+	case follow && cursor != "":
+		return append(args, "--after-cursor", cursor, "-f")
+	case follow:
+		return append(args, "-n", "0", "-f")
+	}
+	n := q.lines()
+	if q.MaxPriority >= 0 || q.Grep != "" {
+		n = max(n, scanLines)
+	}
+	args = append(args, "-n", strconv.Itoa(n))
+	if !q.Since.IsZero() {
+		args = append(args, "--since", fmt.Sprintf("@%d", q.Since.Unix()))
+	}
+	if !q.Until.IsZero() {
+		args = append(args, "--until", fmt.Sprintf("@%d", q.Until.Unix()))
+	}
+	return args
+}
+
+// Match reports whether e passes the level and text filters.
+func (q JournalQuery) Match(e Entry) bool {
+	if q.MaxPriority >= 0 && e.Priority > q.MaxPriority {
+		return false
+	}
+	return q.Grep == "" || strings.Contains(strings.ToLower(e.Message), strings.ToLower(q.Grep))
+}
+
+// JournalEntries returns the last q.Lines matching entries, oldest first.
+func JournalEntries(ctx context.Context, j Journal, q JournalQuery) ([]Entry, error) {
+	entries, _, err := entries(ctx, j, q)
+	return entries, err
+}
+
+func entries(ctx context.Context, j Journal, q JournalQuery) ([]Entry, string, error) {
+	var out []Entry
+	cursor, err := scan(ctx, j, q.args(false, ""), func(e Entry) {
+		if !q.Match(e) {
+			return
+		}
+		out = append(out, e)
+		if len(out) > 2*q.lines() {
+			out = append(out[:0], out[len(out)-q.lines():]...)
+		}
+	})
+	if len(out) > q.lines() {
+		out = out[len(out)-q.lines():]
+	}
+	return out, cursor, err
+}
+
+// JournalFollow calls fn for the last q.Lines matching entries and then
+// for every new one until ctx is done or journalctl exits. q.Until is
+// ignored once the backlog has been sent.
+func JournalFollow(ctx context.Context, j Journal, q JournalQuery, fn func(Entry)) error {
+	backlog, cursor, err := entries(ctx, j, q)
+	if err != nil {
+		return err
+	}
+	for _, e := range backlog {
+		fn(e)
+	}
+	_, err = scan(ctx, j, q.args(true, cursor), func(e Entry) {
+		if q.Match(e) {
+			fn(e)
+		}
+	})
+	return err
+}
+
+// scan runs journalctl with args, calls fn for every entry and returns the
+// cursor of the last one read.
+func scan(ctx context.Context, j Journal, args []string, fn func(Entry)) (string, error) {
+	r, err := j.Open(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	cursor := ""
+	for sc.Scan() {
+		e, err := ParseEntry(sc.Bytes())
+		if err != nil {
+			continue
+		}
+		cursor = e.cursor
+		fn(e)
+	}
+	if ctx.Err() != nil {
+		return cursor, nil
+	}
+	return cursor, sc.Err()
+}
+
+// ParseEntry decodes one line of "journalctl -o json".
+func ParseEntry(line []byte) (Entry, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return Entry{}, err
+	}
+	field := func(k string) string {
+		var s string
+		if json.Unmarshal(raw[k], &s) == nil {
+			return s
+		}
+		// Non-UTF-8 fields are emitted as byte arrays.
+		var b []byte
+		var ints []int
+		if json.Unmarshal(raw[k], &ints) == nil {
+			for _, c := range ints {
+				b = append(b, byte(c))
+			}
+		}
+		return string(b)
+	}
+	e := Entry{Message: field("MESSAGE"), Unit: field("_SYSTEMD_UNIT"), Priority: 6, cursor: field("__CURSOR")}
+	if us, err := strconv.ParseInt(field("__REALTIME_TIMESTAMP"), 10, 64); err == nil {
+		e.Time = time.UnixMicro(us).UTC()
+	}
+	if p, err := strconv.Atoi(field("PRIORITY")); err == nil && p >= 0 && p < len(levels) {
+		e.Priority = p
+	}
+	// Services logging to stdout all get the default priority; hysteria
+	// puts its own level in the message ("2024-01-01T00:00:00Z\tERROR\t...").
+	if e.Priority == 6 {
+		if p, ok := messageLevel(e.Message); ok {
+			e.Priority = p
+		}
+	}
+	e.Level = levels[e.Priority]
+	return e, nil
+}
+
+func messageLevel(msg string) (int, bool) {
+	fields := strings.Fields(msg)
+	for _, f := range fields[:min(len(fields), 3)] {
+		switch strings.Trim(strings.ToUpper(f), "[]:") {
+		case "DEBUG":
+			return 7, true
+		case "INFO":
+			return 6, true
+		case "WARN", "WARNING":
+			return 4, true
+		case "ERROR":
+			return 3, true
+		case "FATAL", "PANIC", "DPANIC":
+			return 2, true
+		}
+	}
+	return 0, false
+}
+
+// ParseTime accepts RFC 3339, "2006-01-02 15:04[:05]" and "2006-01-02" in
+// local time, or a duration such as "90m" meaning that long before now.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time %q (use RFC 3339, \"2006-01-02 15:04\" or a duration like 2h)", s)
+}
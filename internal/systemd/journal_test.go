@@ -0,0 +1,117 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeJournal serves canned "journalctl -o json" output per call and
+// records the arguments it was started with.
+type fakeJournal struct {
+	outputs []string
+	calls   [][]string
+}
+
+func (f *fakeJournal) Open(ctx context.Context, args []string) (io.ReadCloser, error) {
+	f.calls = append(f.calls, args)
+	out := ""
+	if len(f.calls) <= len(f.outputs) {
+		out = f.outputs[len(f.calls)-1]
+	}
+	return io.NopCloser(strings.NewReader(out)), nil
+}
+
+func line(sec int64, prio int, msg string) string {
+	return fmt.Sprintf(`{"__CURSOR":"c%d","__REALTIME_TIMESTAMP":"%d","PRIORITY":"%d","_SYSTEMD_UNIT":"hysteria-server.service","MESSAGE":%q}`+"\n", sec, sec*1e6, prio, msg)
+}
+
+func TestParseEntry(t *testing.T) {
+	e, err := ParseEntry([]byte(line(1700000000, 6, "2023-11-14T22:13:20Z\tERROR\tTCP error\t{\"addr\": \"1.2.3.4\"}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Level != "err" || e.Priority != 3 || !e.Time.Equal(time.Unix(1700000000, 0)) || e.Unit != "hysteria-server.service" {
+		t.Fatalf("entry = %+v", e)
+	}
+	e, err = ParseEntry([]byte(`{"__REALTIME_TIMESTAMP":"1","PRIORITY":"4","MESSAGE":[104,105,255]}`))
+	if err != nil || e.Message != "hi\xff" || e.Level != "warning" {
+		t.Fatalf("byte-array message: %+v, %v", e, err)
+	}
+}
+
+func TestJournalEntriesFilters(t *testing.T) {
+	j := &fakeJournal{outputs: []string{
+		line(1, 6, "server up") + line(2, 3, "listen failed") + "not json\n" + line(3, 4, "WARN slow auth") + line(4, 3, "auth error for u1"),
+	}}
+	q := JournalQuery{Unit: "hysteria-server.service", Lines: 2, MaxPriority: 4, Since: time.Unix(100, 0)}
+	got, err := JournalEntries(context.Background(), j, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, e := range got {
+		msgs = append(msgs, e.Message)
+	}
+	if want := []string{"WARN slow auth", "auth error for u1"}; !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("messages = %q, want %q", msgs, want)
+	}
+	want := []string{"--no-pager", "-o", "json", "-u", "hysteria-server.service", "-n", "5000", "--since", "@100"}
+	if !reflect.DeepEqual(j.calls[0], want) {
+		t.Fatalf("args = %q, want %q", j.calls[0], want)
+	}
+
+	q = JournalQuery{Unit: "x", MaxPriority: -1, Grep: "AUTH"}
+	got, _ = JournalEntries(context.Background(), &fakeJournal{outputs: j.outputs}, q)
+	if len(got) != 2 {
+		t.Fatalf("grep matched %d entries, want 2", len(got))
+	}
+}
+
+func TestJournalFollowResumesAfterCursor(t *testing.T) {
+	j := &fakeJournal{outputs: []string{line(1, 6, "a") + line(2, 6, "b"), line(3, 6, "c")}}
+	var msgs []string
+	err := JournalFollow(context.Background(), j, JournalQuery{Unit: "x", Lines: 1, MaxPriority: -1}, func(e Entry) {
+		msgs = append(msgs, e.Message)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("messages = %q, want %q", msgs, want)
+	}
+	if want := []string{"--no-pager", "-o", "json", "-u", "x", "--after-cursor", "c2", "-f"}; !reflect.DeepEqual(j.calls[1], want) {
+		t.Fatalf("follow args = %q", j.calls[1])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, want := range map[string]int{"error": 3, "err": 3, "WARN": 4, "warning": 4, "info": 6, "7": 7} {
+		if got, err := ParseLevel(in); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("ParseLevel accepted an unknown level")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if got, err := ParseTime("2h", now); err != nil || !got.Equal(now.Add(-2*time.Hour)) {
+		t.Fatalf("2h: %v, %v", got, err)
+	}
+	if got, err := ParseTime("2024-05-01T00:00:00Z", now); err != nil || !got.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("RFC 3339: %v, %v", got, err)
+	}
+	if got, err := ParseTime("2024-05-01 08:30", now); err != nil || got.Hour() != 8 || got.Minute() != 30 {
+		t.Fatalf("local time: %v, %v", got, err)
+	}
+	if _, err := ParseTime("yesterday-ish", now); err == nil {
+		t.Fatal("accepted garbage")
+	}
+}
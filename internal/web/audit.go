@@ -0,0 +1,45 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+)
+
+// apiAudit pages through the audit log, newest first:
+// ?action=&user=&since=&until=&offset=&limit= (limit 1-500, default 50).
+func (s *Server) apiAudit(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := audit.Query{Action: v.Get("action"), User: v.Get("user")}
+	q.Offset, _ = strconv.Atoi(v.Get("offset"))
+	q.Limit, _ = strconv.Atoi(v.Get("limit"))
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	if q.Limit <= 0 || q.Limit > 500 {
+		q.Limit = 50
+	}
+	now := time.Now()
+	for _, f := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := v.Get(f.name); s != "" {
+			t, err := systemd.ParseTime(s, now)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			*f.dst = t
+		}
+	}
+	entries, total, err := audit.Read(q)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, map[string]any{"total": total, "offset": q.Offset, "limit": q.Limit, "entries": entries})
+}
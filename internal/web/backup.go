@@ -0,0 +1,39 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/backup"
+)
+
+// apiBackup streams a full backup archive as a download, encrypted when
+// the body carries {"passphrase": "..."}. Nothing is written to disk.
+func (s *Server) apiBackup(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Passphrase string `json:"passphrase"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&in)
+	a, err := backup.Collect(s.Svc.State())
+	var buf bytes.Buffer
+	if err == nil {
+		err = a.Write(&buf, in.Passphrase)
+	}
+	name := ""
+	if err == nil {
+		name = backup.Name(a.Manifest.Host, time.Now(), in.Passphrase != "")
+	}
+	audit.Write(s.actor(r).Entry("backup.download", name, err))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("content-type", "application/octet-stream")
+	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("cache-control", "no-store")
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,128 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/app"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+)
+
+// logQuery reads ?lines=&level=&since=&until=&q= for hysteria's journal.
+func logQuery(r *http.Request) (systemd.JournalQuery, error) {
+	v := r.URL.Query()
+	q := systemd.JournalQuery{Unit: app.HysteriaService, MaxPriority: -1, Grep: v.Get("q")}
+	q.Lines, _ = strconv.Atoi(v.Get("lines"))
+	if q.Lines <= 0 || q.Lines > 2000 {
+		q.Lines = 200
+	}
+	if l := v.Get("level"); l != "" {
+		p, err := systemd.ParseLevel(l)
+		if err != nil {
+			return q, err
+		}
+		q.MaxPriority = p
+	}
+	now := time.Now()
+	for _, f := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := v.Get(f.name); s != "" {
+			t, err := systemd.ParseTime(s, now)
+			if err != nil {
+				return q, err
+			}
+			*f.dst = t
+		}
+	}
+	return q, nil
+}
+
+func (s *Server) apiLogs(w http.ResponseWriter, r *http.Request) {
+	q, err := logQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	entries, err := systemd.JournalEntries(r.Context(), s.Journal, q)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if entries == nil {
+		entries = []systemd.Entry{}
+	}
+	writeJSON(w, entries)
+}
+
+// apiLogsStream tails the journal as Server-Sent Events, one JSON entry
+// per "data:" line, starting with the last ?lines= matching entries.
+func (s *Server) apiLogsStream(w http.ResponseWriter, r *http.Request) {
+	q, err := logQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx: don't buffer the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := make(chan systemd.Entry, 64)
+	done := make(chan error, 1)
+	go func() {
+		done <- systemd.JournalFollow(r.Context(), s.Journal, q, func(e systemd.Entry) {
+			select {
+			case events <- e:
+			case <-r.Context().Done():
+			}
+		})
+	}()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-events:
+			b, _ := json.Marshal(e)
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case err := <-done:
+			// Drain what the follower queued before it returned.
+			for len(events) > 0 {
+				b, _ := json.Marshal(<-events)
+				fmt.Fprintf(w, "data: %s\n\n", b)
+			}
+			if err != nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+			}
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// recentErrors is the dashboard's excerpt: the last error-level entries.
+func (s *Server) recentErrors(r *http.Request) string {
+	q := systemd.JournalQuery{Unit: app.HysteriaService, Lines: 30, MaxPriority: 3}
+	entries, _ := systemd.JournalEntries(r.Context(), s.Journal, q)
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.String()
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,45 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/metrics"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/gorilla/mux"
+)
+
+// MetricsRouter serves only /metrics, for the separate MetricsListen
+// listener. Without a configured token it is open; bind it accordingly.
+func (s *Server) MetricsRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/metrics", s.metrics(false)).Methods("GET")
+	return r
+}
+
+// metrics serves the Prometheus exposition. A bearer token is required
+// when configured; on the web UI listener a logged-in session also works
+// and, without a token, is the only way in.
+func (s *Server) metrics(session bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := s.Svc.State()
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		ok := service.MetricsVerify(st, token)
+		if !ok && session {
+			sess, _ := s.Store.Get(r, "hy2mgr")
+			ok, _ = sess.Values["auth"].(bool)
+		}
+		if !ok && !session && st.Settings.MetricsTokenSHA256 == "" {
+			ok = true
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hy2mgr metrics"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var mw metrics.Writer
+		service.WriteMetrics(&mw, st)
+		w.Header().Set("content-type", metrics.ContentType)
+		_, _ = w.Write(mw.Bytes())
+	}
+}
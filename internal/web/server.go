@@ -1,18 +1,24 @@
 package web
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net"
 	"net/http"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/clientcfg"
 	"github.com/yuzeguitarist/hy2mgr/internal/crypto"
+	"github.com/yuzeguitarist/hy2mgr/internal/metrics"
 	"github.com/yuzeguitarist/hy2mgr/internal/service"
 	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/yuzeguitarist/hy2mgr/internal/subaccess"
 	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
@@ -21,8 +27,13 @@ import (
 )
 
 type Server struct {
-	Store *sessions.CookieStore
-	State *state.State
+	Store  *sessions.CookieStore
+	Svc    *service.Manager
+	Access *subaccess.Log
+	// Journal reads hysteria's logs; tests substitute a fake.
+	Journal systemd.Journal
+
+	subLimit *subaccess.Limiter
 }
 
 func NewServer(st *state.State, sessionKey []byte) *Server {
@@ -33,7 +44,13 @@ func NewServer(st *state.State, sessionKey []byte) *Server {
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 	}
-	return &Server{Store: cs, State: st}
+	return &Server{
+		Store:    cs,
+		Svc:      service.NewManager(st),
+		Access:   subaccess.Open(subaccess.Path, 5000),
+		Journal:  systemd.DefaultJournal,
+		subLimit: subaccess.NewLimiter(30, 10),
+	}
 }
 
 func (s *Server) Router() http.Handler {
@@ -43,14 +60,21 @@ func (s *Server) Router() http.Handler {
 	r.HandleFunc("/login", s.loginPost).Methods("POST")
 	r.HandleFunc("/logout", s.logout).Methods("GET")
 
-	// public subscription (token protected)
-	r.HandleFunc("/sub/{token}", s.subscription).Methods("GET")
+	// public subscription (token protected), unless it has its own listener
+	if s.Svc.State().Settings.SubscriptionListen == "" {
+		s.mountSubscription(r)
+	}
+	if s.Svc.State().Settings.MetricsListen == "" {
+		r.HandleFunc("/metrics", s.metrics(true)).Methods("GET")
+	}
 
 	authed := r.NewRoute().Subrouter()
 	authed.Use(s.requireLogin)
 	authed.HandleFunc("/", s.appShell).Methods("GET")
 	authed.HandleFunc("/api/dashboard", s.apiDashboard).Methods("GET")
 	authed.HandleFunc("/api/logs", s.apiLogs).Methods("GET")
+	authed.HandleFunc("/api/logs/stream", s.apiLogsStream).Methods("GET")
+	authed.HandleFunc("/api/audit", s.apiAudit).Methods("GET")
 	authed.HandleFunc("/api/nodes", s.apiNodes).Methods("GET")
 	authed.HandleFunc("/api/nodes", s.apiNodesCreate).Methods("POST")
 	authed.HandleFunc("/api/nodes/{id}", s.apiNodesDelete).Methods("DELETE")
@@ -60,12 +84,15 @@ func (s *Server) Router() http.Handler {
 	authed.HandleFunc("/api/nodes/{id}/uri", s.apiNodeURI).Methods("GET")
 	authed.HandleFunc("/api/nodes/{id}/qrcode.png", s.apiNodeQRPNG).Methods("GET")
 	authed.HandleFunc("/api/nodes/{id}/qrcode.svg", s.apiNodeQRSVG).Methods("GET")
+	authed.HandleFunc("/api/nodes/{id}/subscription/rotate", s.apiNodeSubscriptionRotate).Methods("POST")
+	authed.HandleFunc("/api/nodes/{id}/subscription", s.apiNodeSubscriptionRevoke).Methods("DELETE")
 	authed.HandleFunc("/api/subscription", s.apiSubscriptionInfo).Methods("GET")
 	authed.HandleFunc("/api/subscription/rotate", s.apiSubscriptionRotate).Methods("POST")
 	authed.HandleFunc("/api/settings", s.apiSettings).Methods("GET")
 	authed.HandleFunc("/api/settings", s.apiSettingsSave).Methods("POST")
 	authed.HandleFunc("/api/cert/rotate", s.apiCertRotate).Methods("POST")
 	authed.HandleFunc("/api/admin/password", s.apiAdminPassword).Methods("POST")
+	authed.HandleFunc("/api/backup", s.apiBackup).Methods("POST")
 
 	// CSRF for all POSTs
 	return csrf.Protect(
@@ -75,6 +102,59 @@ func (s *Server) Router() http.Handler {
 	)(r)
 }
 
+// SubscriptionRouter serves only subscriptions, for the separate
+// SubscriptionListen listener.
+func (s *Server) SubscriptionRouter() http.Handler {
+	r := mux.NewRouter()
+	s.mountSubscription(r)
+	return r
+}
+
+// mountSubscription routes subscriptions and share pages. The path prefix
+// is read from the current state on each request, so a prefix changed by
+// the CLI works as soon as the state is reloaded.
+func (s *Server) mountSubscription(r *mux.Router) {
+	r.MatcherFunc(s.tokenPath(service.SubscriptionPath)).Methods("GET").HandlerFunc(s.subscription)
+	r.MatcherFunc(s.tokenPath(service.SharePath)).Methods("GET").HandlerFunc(s.share)
+}
+
+// tokenPath matches path(state, token) for the current state and passes
+// the token on as the "token" route variable.
+func (s *Server) tokenPath(path func(*state.State, string) string) mux.MatcherFunc {
+	return func(r *http.Request, m *mux.RouteMatch) bool {
+		token, ok := strings.CutPrefix(r.URL.Path, path(s.Svc.State(), ""))
+		if !ok || token == "" || strings.Contains(token, "/") {
+			return false
+		}
+		if m.Vars == nil {
+			m.Vars = map[string]string{}
+		}
+		m.Vars["token"] = token
+		return true
+	}
+}
+
+// subscriptionBase is the origin clients fetch subscriptions from, as seen
+// by an admin on r; empty means the admin UI's own origin.
+func subscriptionBase(r *http.Request, st *state.State) string {
+	if u := st.Settings.PublicBaseURL; u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	if st.Settings.SubscriptionListen == "" {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(st.Settings.SubscriptionListen)
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	scheme := "http"
+	if st.Settings.SubscriptionTLSCert != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
 func (s *Server) appShell(w http.ResponseWriter, r *http.Request) {
 	b, _ := FS.ReadFile("templates/layout.html")
 	html := string(b)
@@ -87,7 +167,7 @@ func (s *Server) loginPage(w http.ResponseWriter, r *http.Request) {
 	b, _ := FS.ReadFile("templates/login.html")
 	html := string(b)
 	html = strings.ReplaceAll(html, "{{.CSRFToken}}", csrf.Token(r))
-	if s.State.Admin.TOTPEnabled {
+	if s.Svc.State().Admin.TOTPEnabled {
 		html = strings.ReplaceAll(html, "{{if .TOTPEnabled}}", "")
 	} else {
 		html = strings.ReplaceAll(html, "{{if .TOTPEnabled}}", "")
@@ -107,12 +187,13 @@ func (s *Server) loginPost(w http.ResponseWriter, r *http.Request) {
 	u := r.FormValue("username")
 	p := r.FormValue("password")
 	totp := r.FormValue("totp")
+	admin := s.Svc.State().Admin
 
-	if u != s.State.Admin.Username || bcrypt.CompareHashAndPassword([]byte(s.State.Admin.PasswordBcrypt), []byte(p)) != nil {
+	if u != admin.Username || bcrypt.CompareHashAndPassword([]byte(admin.PasswordBcrypt), []byte(p)) != nil {
 		s.loginFail(w, r, "invalid credentials")
 		return
 	}
-	if s.State.Admin.TOTPEnabled && !verifyTOTP(s.State.Admin.TOTPSecret, totp) {
+	if admin.TOTPEnabled && !verifyTOTP(admin.TOTPSecret, totp) {
 		s.loginFail(w, r, "invalid totp")
 		return
 	}
@@ -126,10 +207,11 @@ func (s *Server) loginPost(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) loginFail(w http.ResponseWriter, r *http.Request, msg string) {
+	metrics.LoginFailures.Inc()
 	b, _ := FS.ReadFile("templates/login.html")
 	html := string(b)
 	html = strings.ReplaceAll(html, "{{.CSRFToken}}", csrf.Token(r))
-	if s.State.Admin.TOTPEnabled {
+	if s.Svc.State().Admin.TOTPEnabled {
 		html = strings.ReplaceAll(html, "{{if .TOTPEnabled}}", "")
 	} else {
 		html = strings.ReplaceAll(html, "{{if .TOTPEnabled}}", "")
@@ -169,29 +251,19 @@ func (s *Server) requireLogin(next http.Handler) http.Handler {
 func (s *Server) apiDashboard(w http.ResponseWriter, r *http.Request) {
 	active, _ := systemd.IsActive("hysteria-server.service")
 	pin, _ := crypto.ParseCertPin("/etc/hysteria/cert.crt")
-	logs, _ := systemd.JournalTail("hysteria-server.service", 200)
-	recent := filterErrors(logs)
+	recent := s.recentErrors(r)
+	st := s.Svc.State()
 	resp := map[string]any{
 		"hysteriaStatus": map[bool]string{true: "active", false: "inactive"}[active],
-		"listen":         fmt.Sprintf(":%d", s.State.Settings.ListenPort),
-		"port":           s.State.Settings.ListenPort,
+		"listen":         fmt.Sprintf(":%d", st.Settings.ListenPort),
+		"port":           st.Settings.ListenPort,
 		"pin":            pin,
 		"recentErrors":   recent,
 	}
 	writeJSON(w, resp)
 }
 
-func (s *Server) apiLogs(w http.ResponseWriter, r *http.Request) {
-	lines, _ := strconv.Atoi(r.URL.Query().Get("lines"))
-	if lines <= 0 || lines > 2000 {
-		lines = 200
-	}
-	logs, _ := systemd.JournalTail("hysteria-server.service", lines)
-	w.Header().Set("content-type", "text/plain; charset=utf-8")
-	_, _ = w.Write([]byte(logs))
-}
-
-func (s *Server) apiSettings(w http.ResponseWriter, r *http.Request) { writeJSON(w, s.State.Settings) }
+func (s *Server) apiSettings(w http.ResponseWriter, r *http.Request) { writeJSON(w, s.Svc.State().Settings) }
 
 func (s *Server) apiSettingsSave(w http.ResponseWriter, r *http.Request) {
 	var in struct {
@@ -199,41 +271,74 @@ func (s *Server) apiSettingsSave(w http.ResponseWriter, r *http.Request) {
 		SNI               string `json:"sni"`
 		MasqueradeURL     string `json:"masqueradeUrl"`
 		MasqueradeRewrite bool   `json:"masqueradeRewrite"`
+		// optional; left unchanged when absent
+		SubRevokeSubnets     *int `json:"subRevokeSubnets"`
+		SubRevokeWindowHours *int `json:"subRevokeWindowHours"`
 	}
 	_ = json.NewDecoder(r.Body).Decode(&in)
 	if in.ListenPort <= 0 || in.ListenPort > 65535 {
 		http.Error(w, "invalid port", 400)
 		return
 	}
+	if (in.SubRevokeSubnets != nil && *in.SubRevokeSubnets < 0) || (in.SubRevokeWindowHours != nil && *in.SubRevokeWindowHours < 0) {
+		http.Error(w, "invalid auto-revoke settings", 400)
+		return
+	}
 	if in.SNI == "" {
 		in.SNI = "www.bing.com"
 	}
 	if in.MasqueradeURL == "" {
 		in.MasqueradeURL = "https://www.bing.com"
 	}
-	s.State.Settings.ListenPort = in.ListenPort
-	s.State.Settings.SNI = in.SNI
-	s.State.Settings.MasqueradeURL = in.MasqueradeURL
-	s.State.Settings.MasqueradeRewrite = in.MasqueradeRewrite
-
-	if err := service.Apply(s.State, false); err != nil {
-		http.Error(w, err.Error(), 500)
+	err := s.svc(r).Update("settings.save", "", func(st *state.State) error {
+		st.Settings.ListenPort = in.ListenPort
+		st.Settings.SNI = in.SNI
+		st.Settings.MasqueradeURL = in.MasqueradeURL
+		st.Settings.MasqueradeRewrite = in.MasqueradeRewrite
+		if in.SubRevokeSubnets != nil {
+			st.Settings.SubRevokeSubnets = *in.SubRevokeSubnets
+		}
+		if in.SubRevokeWindowHours != nil {
+			st.Settings.SubRevokeWindowHours = *in.SubRevokeWindowHours
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
 		return
 	}
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "settings.save"})
-	writeJSON(w, map[string]any{"ok": true, "port": s.State.Settings.ListenPort})
+	st := s.Svc.State()
+	writeJSON(w, map[string]any{"ok": true, "port": st.Settings.ListenPort})
 }
 
 func (s *Server) apiNodes(w http.ResponseWriter, r *http.Request) {
 	type nodeOut struct {
-		ID       string `json:"id"`
-		Name     string `json:"name"`
-		Username string `json:"username"`
-		Enabled  bool   `json:"enabled"`
+		ID           string           `json:"id"`
+		Name         string           `json:"name"`
+		Username     string           `json:"username"`
+		Enabled      bool             `json:"enabled"`
+		Tags         []string         `json:"tags"`
+		Subscription bool             `json:"subscription"` // has an active per-node token
+		Access       *subaccess.Stats `json:"access,omitempty"`
+	}
+	st := s.Svc.State()
+	stats := s.Access.Stats()
+	scoped := map[string]string{}
+	for _, sub := range service.ScopedSubscriptions(st) {
+		if sub.NodeID != "" {
+			scoped[sub.NodeID] = sub.ID
+		}
 	}
 	var out []nodeOut
-	for _, n := range s.State.NodesSorted() {
-		out = append(out, nodeOut{ID: n.ID, Name: n.Name, Username: n.Username, Enabled: n.Enabled})
+	for _, n := range st.NodesSorted() {
+		o := nodeOut{ID: n.ID, Name: n.Name, Username: n.Username, Enabled: n.Enabled, Tags: n.Tags}
+		if id, ok := scoped[n.ID]; ok {
+			o.Subscription = true
+			if a, ok := stats[id]; ok {
+				o.Access = &a
+			}
+		}
+		out = append(out, o)
 	}
 	writeJSON(w, map[string]any{"nodes": out})
 }
@@ -245,66 +350,61 @@ func (s *Server) apiNodesCreate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "name required", 400)
 		return
 	}
-	n, err := service.NodeAdd(s.State, in.Name, "", "")
+	n, err := s.svc(r).NodeAdd(in.Name, "", "")
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		http.Error(w, err.Error(), errStatus(err))
 		return
 	}
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "node.add", Object: n.ID})
 	writeJSON(w, map[string]any{"ok": true, "id": n.ID})
 }
 
 func (s *Server) apiNodesDelete(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	if err := service.NodeDelete(s.State, id); err != nil {
-		http.Error(w, err.Error(), 404)
+	if err := s.svc(r).NodeDelete(id); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
 		return
 	}
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "node.delete", Object: id})
 	writeJSON(w, map[string]any{"ok": true})
 }
 
 func (s *Server) apiNodeDisable(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	if err := service.NodeSetEnabled(s.State, id, false); err != nil {
-		http.Error(w, err.Error(), 404)
+	if err := s.svc(r).NodeSetEnabled(id, false); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
 		return
 	}
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "node.disable", Object: id})
 	writeJSON(w, map[string]any{"ok": true})
 }
 func (s *Server) apiNodeEnable(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	if err := service.NodeSetEnabled(s.State, id, true); err != nil {
-		http.Error(w, err.Error(), 404)
+	if err := s.svc(r).NodeSetEnabled(id, true); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
 		return
 	}
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "node.enable", Object: id})
 	writeJSON(w, map[string]any{"ok": true})
 }
 func (s *Server) apiNodeReset(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	if err := service.NodeResetPassword(s.State, id); err != nil {
-		http.Error(w, err.Error(), 404)
+	if err := s.svc(r).NodeResetPassword(id); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
 		return
 	}
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "node.reset", Object: id})
 	writeJSON(w, map[string]any{"ok": true})
 }
 
 func (s *Server) apiNodeURI(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	uri, err := service.NodeURI(s.State, id)
+	uris, err := service.NodeURIs(s.Svc.State(), id)
 	if err != nil {
 		http.Error(w, err.Error(), 404)
 		return
 	}
-	writeJSON(w, map[string]any{"uri": uri})
+	writeJSON(w, map[string]any{"uri": uris[0], "uris": uris})
 }
 
 func (s *Server) apiNodeQRPNG(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	uri, err := service.NodeURI(s.State, id)
+	uri, err := service.NodeURI(s.Svc.State(), id)
 	if err != nil {
 		http.Error(w, err.Error(), 404)
 		return
@@ -319,7 +419,7 @@ func (s *Server) apiNodeQRPNG(w http.ResponseWriter, r *http.Request) {
 }
 func (s *Server) apiNodeQRSVG(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	uri, err := service.NodeURI(s.State, id)
+	uri, err := service.NodeURI(s.Svc.State(), id)
 	if err != nil {
 		http.Error(w, err.Error(), 404)
 		return
@@ -334,49 +434,225 @@ func (s *Server) apiNodeQRSVG(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) apiSubscriptionInfo(w http.ResponseWriter, r *http.Request) {
+	type tokenOut struct {
+		ID     string          `json:"id"`
+		Scope  string          `json:"scope"`
+		Access subaccess.Stats `json:"access"`
+	}
+	st := s.Svc.State()
+	stats := s.Access.Stats()
+	var tokens []tokenOut
+	if st.Subscription.TokenSHA256 != "" && st.Subscription.RevokedAt == "" {
+		tokens = append(tokens, tokenOut{ID: subaccess.GlobalID, Scope: "all nodes", Access: stats[subaccess.GlobalID]})
+	}
+	for _, sub := range service.ScopedSubscriptions(st) {
+		scope := "node " + sub.NodeID
+		if sub.Tag != "" {
+			scope = "tag " + sub.Tag
+		}
+		tokens = append(tokens, tokenOut{ID: sub.ID, Scope: scope, Access: stats[sub.ID]})
+	}
 	writeJSON(w, map[string]any{
-		"url":  "/sub/<token>",
-		"note": "Token is sensitive; view via CLI: `hy2mgr export subscription`",
+		"base":   subscriptionBase(r, st),
+		"url":    service.SubscriptionPath(st, "<token>"),
+		"note":   "Token is sensitive; view via CLI: `hy2mgr export subscription`",
+		"tokens": tokens,
 	})
 }
 
 func (s *Server) apiSubscriptionRotate(w http.ResponseWriter, r *http.Request) {
-	token, urlPath, err := service.SubscriptionRotate(s.State)
+	token, urlPath, err := s.svc(r).SubscriptionRotate()
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "subscription.rotate"})
-	writeJSON(w, map[string]any{"ok": true, "token": token, "url": urlPath})
+	st := s.Svc.State()
+	writeJSON(w, map[string]any{"ok": true, "token": token, "url": urlPath, "share": service.SharePath(st, token), "base": subscriptionBase(r, st)})
+}
+
+func (s *Server) apiNodeSubscriptionRotate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	token, urlPath, err := s.svc(r).ScopedSubscriptionRotate(id, "")
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	st := s.Svc.State()
+	writeJSON(w, map[string]any{"ok": true, "token": token, "url": urlPath, "share": service.SharePath(st, token), "base": subscriptionBase(r, st)})
+}
+
+func (s *Server) apiNodeSubscriptionRevoke(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.svc(r).ScopedSubscriptionRevoke(id, ""); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	writeJSON(w, map[string]any{"ok": true})
 }
 
 func (s *Server) subscription(w http.ResponseWriter, r *http.Request) {
-	token := mux.Vars(r)["token"]
-	if !service.SubscriptionVerify(s.State, token) {
-		w.WriteHeader(http.StatusNotFound)
+	format := subscriptionFormat(r)
+	if !slices.Contains(subscriptionFormats, format) {
+		http.Error(w, fmt.Sprintf("unknown format %q; supported: %s", format, strings.Join(subscriptionFormats, ", ")), 400)
+		return
+	}
+	st, sub, ok := s.resolveToken(w, r, format)
+	if !ok {
+		return
+	}
+	nodes := service.SubscriptionNodes(st, sub)
+	var (
+		body        []byte
+		err         error
+		contentType = "text/yaml; charset=utf-8"
+		ext         = ".yaml"
+	)
+	eps := service.NodeEndpoints(st, nodes)
+	switch format {
+	case "clash":
+		body, err = clientcfg.Clash(eps)
+	case "singbox":
+		body, err = clientcfg.SingBox(eps, clientcfg.ClientOptions{})
+		contentType, ext = "application/json", ".json"
+	case "hysteria":
+		// config.yaml holds exactly one server/auth pair.
+		// Extra endpoints are left out; the primary address is used.
+		if len(nodes) != 1 {
+			http.Error(w, "format=hysteria needs a subscription with exactly one enabled node", 400)
+			return
+		}
+		var ep clientcfg.Endpoint
+		if ep, err = service.NodeEndpoint(st, nodes[0].ID); err == nil {
+			body, err = clientcfg.Hysteria(ep, clientcfg.ClientOptions{})
+		}
+	default:
+		lines := []string{}
+		for _, ep := range eps {
+			lines = append(lines, clientcfg.URI(ep))
+		}
+		body = []byte(strings.Join(lines, "\n") + "\n")
+		if format == "base64" {
+			body = []byte(base64.StdEncoding.EncodeToString(body))
+		}
+		contentType, ext = "text/plain; charset=utf-8", ".txt"
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
 		return
 	}
-	lines := []string{}
-	for _, n := range s.State.NodesSorted() {
-		if !n.Enabled {
-			continue
+	u := service.SubscriptionUsage(st, nodes)
+	w.Header().Set("content-type", contentType)
+	w.Header().Set("Subscription-Userinfo", fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", u.Upload, u.Download, u.Total, u.Expire))
+	w.Header().Set("Profile-Update-Interval", "24")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": subscriptionName(sub, nodes) + ext}))
+	_, _ = w.Write(body)
+}
+
+// resolveToken rate-limits, resolves and logs a public token request. On
+// failure it has already written the response.
+func (s *Server) resolveToken(w http.ResponseWriter, r *http.Request, format string) (*state.State, state.Subscription, bool) {
+	if !s.subLimit.Allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return nil, state.Subscription{}, false
+	}
+	st := s.Svc.State()
+	sub, ok := service.SubscriptionResolve(st, mux.Vars(r)["token"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, state.Subscription{}, false
+	}
+	tokenID := sub.ID
+	if tokenID == "" {
+		tokenID = subaccess.GlobalID
+	}
+	s.Access.Record(subaccess.Fetch{TokenID: tokenID, IP: clientIP(r), UserAgent: r.UserAgent(), Format: format})
+	metrics.SubscriptionFetches.Inc(fetchFormat(format))
+	if s.autoRevoke(r, st, tokenID) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, state.Subscription{}, false
+	}
+	return st, sub, true
+}
+
+// autoRevoke revokes tokenID once it has been fetched from more networks
+// than the settings allow, and reports whether the token is now revoked.
+func (s *Server) autoRevoke(r *http.Request, st *state.State, tokenID string) bool {
+	limit := st.Settings.SubRevokeSubnets
+	if limit <= 0 {
+		return false
+	}
+	hours := st.Settings.SubRevokeWindowHours
+	if hours <= 0 {
+		hours = 24
+	}
+	n := s.Access.Subnets(tokenID, time.Now().Add(-time.Duration(hours)*time.Hour))
+	if n <= limit {
+		return false
+	}
+	actor := audit.System
+	actor.IP = clientIP(r)
+	actor.Detail = fmt.Sprintf("auto-revoked: fetched from %d networks within %dh (limit %d)", n, hours, limit)
+	err := s.Svc.As(actor).SubscriptionRevokeID(tokenID)
+	if errors.Is(err, service.ErrNoSubscription) {
+		return true // revoked concurrently
+	}
+	return err == nil
+}
+
+// subscriptionName is the profile name clients show: the node name for a
+// single-node link, otherwise the tag or "hy2mgr".
+func subscriptionName(sub state.Subscription, nodes []state.Node) string {
+	switch {
+	case sub.NodeID != "" && len(nodes) == 1 && nodes[0].Name != "":
+		return nodes[0].Name
+	case sub.Tag != "":
+		return sub.Tag
+	}
+	return "hy2mgr"
+}
+
+// fetchFormat bounds the metrics label to the formats served; anything
+// else gets the URI list.
+func fetchFormat(format string) string {
+	switch format {
+	case "clash", "singbox", "hysteria", "base64", "share":
+		return format
+	}
+	return "uri"
+}
+
+// subscriptionFormats are the values ?format= accepts.
+var subscriptionFormats = []string{"uri", "base64", "clash", "singbox", "hysteria"}
+
+// subscriptionFormat honours ?format= and otherwise guesses from the client's
+// User-Agent; unknown clients get the plain URI list.
+func subscriptionFormat(r *http.Request) string {
+	if f := strings.ToLower(r.URL.Query().Get("format")); f != "" {
+		return f
+	}
+	ua := strings.ToLower(r.UserAgent())
+	for _, k := range []string{"clash", "mihomo", "stash"} {
+		if strings.Contains(ua, k) {
+			return "clash"
 		}
-		uri, err := service.NodeURI(s.State, n.ID)
-		if err == nil {
-			lines = append(lines, uri)
+	}
+	if strings.Contains(ua, "sing-box") {
+		return "singbox"
+	}
+	for _, k := range []string{"v2rayn", "shadowrocket", "quantumult"} {
+		if strings.Contains(ua, k) {
+			return "base64"
 		}
 	}
-	w.Header().Set("content-type", "text/plain; charset=utf-8")
-	_, _ = w.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	return "uri"
 }
 
 func (s *Server) apiCertRotate(w http.ResponseWriter, r *http.Request) {
-	if err := service.RotateCert(s.State, false); err != nil {
+	if err := s.svc(r).RotateCert(); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	_ = service.Apply(s.State, false)
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "cert.rotate"})
 	writeJSON(w, map[string]any{"ok": true})
 }
 
@@ -388,14 +664,39 @@ func (s *Server) apiAdminPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	h, _ := bcrypt.GenerateFromPassword([]byte(in.Password), bcrypt.DefaultCost)
-	s.State.Admin.PasswordBcrypt = string(h)
-	_ = s.State.SaveAtomic()
-	audit.Write(audit.Entry{Time: time.Now().UTC().Format(time.RFC3339), IP: clientIP(r), User: s.State.Admin.Username, Action: "admin.password.rotate"})
+	err := s.svc(r).UpdateNoApply("admin.password.rotate", "", func(st *state.State) error {
+		st.Admin.PasswordBcrypt = string(h)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 	writeJSON(w, map[string]any{"ok": true})
 }
 
 // ---- helpers ----
 
+func (s *Server) adminName() string { return s.Svc.State().Admin.Username }
+
+// actor is the admin behind r.
+func (s *Server) actor(r *http.Request) audit.Actor {
+	return audit.Actor{User: s.adminName(), Source: "web", IP: clientIP(r)}
+}
+
+// svc is the manager acting for the admin behind r.
+func (s *Server) svc(r *http.Request) *service.Manager { return s.Svc.As(s.actor(r)) }
+
+func errStatus(err error) int {
+	if errors.Is(err, service.ErrNodeNotFound) || errors.Is(err, service.ErrNoSubscription) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, state.ErrConflict) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("content-type", "application/json")
 	_ = json.NewEncoder(w).Encode(v)
@@ -408,21 +709,3 @@ func clientIP(r *http.Request) string {
 	}
 	return host
 }
-
-func filterErrors(logs string) string {
-	lines := strings.Split(logs, "\n")
-	var out []string
-	for _, l := range lines {
-		low := strings.ToLower(l)
-		if strings.Contains(low, "error") || strings.Contains(low, "failed") || strings.Contains(low, "permission denied") {
-			out = append(out, l)
-		}
-	}
-	if len(out) == 0 {
-		return ""
-	}
-	if len(out) > 30 {
-		out = out[len(out)-30:]
-	}
-	return strings.Join(out, "\n")
-}
@@ -0,0 +1,542 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/audit"
+	"github.com/yuzeguitarist/hy2mgr/internal/backup"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/yuzeguitarist/hy2mgr/internal/subaccess"
+	"github.com/yuzeguitarist/hy2mgr/internal/systemd"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var csrfRe = regexp.MustCompile(`name="csrf[-_]token" (?:value|content)="([^"]+)"`)
+
+type testClient struct {
+	t    *testing.T
+	base string
+	http *http.Client
+	csrf string
+}
+
+// newTestServer starts the router over a temp-dir state with a fake Apply
+// that rejects any node whose name starts with "fail".
+func newTestServer(t *testing.T) (*Server, *testClient) {
+	t.Helper()
+	dir := t.TempDir()
+	oldAudit, oldAccess := audit.Path, subaccess.Path
+	t.Cleanup(func() { audit.Path, subaccess.Path = oldAudit, oldAccess })
+	audit.Path = filepath.Join(dir, "audit.log")
+	subaccess.Path = filepath.Join(dir, "subscription-access.log")
+
+	st, err := state.LoadFrom(state.NewFileStore(filepath.Join(dir, "state.json"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Settings.ListenHost = "203.0.113.1"
+	h, _ := bcrypt.GenerateFromPassword([]byte("secret-pass"), bcrypt.MinCost)
+	st.Admin.PasswordBcrypt = string(h)
+
+	srv := NewServer(st, []byte("test-session-key-0123456789abcdef"))
+	srv.Svc.ApplyFunc = func(st *state.State, dryRun bool) error {
+		for _, n := range st.Nodes {
+			if strings.HasPrefix(n.Name, "fail") {
+				return errors.New("apply rejected")
+			}
+		}
+		return nil
+	}
+	ts := httptest.NewServer(srv.Router())
+	t.Cleanup(ts.Close)
+
+	jar, _ := cookiejar.New(nil)
+	c := &testClient{t: t, base: ts.URL, http: &http.Client{Jar: jar}}
+	c.login()
+	return srv, c
+}
+
+func (c *testClient) login() {
+	page := c.get("/login")
+	m := csrfRe.FindStringSubmatch(page)
+	if m == nil {
+		c.t.Fatal("no csrf token on login page")
+	}
+	resp, err := c.http.PostForm(c.base+"/login", url.Values{
+		"csrf_token": {m[1]}, "username": {"admin"}, "password": {"secret-pass"},
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp.Body.Close()
+	m = csrfRe.FindStringSubmatch(c.get("/"))
+	if m == nil {
+		c.t.Fatal("login failed: no csrf token on app shell")
+	}
+	c.csrf = m[1]
+}
+
+func (c *testClient) get(path string) string {
+	code, body := c.do("GET", path, nil)
+	if code != 200 {
+		c.t.Errorf("GET %s: %d %s", path, code, body)
+	}
+	return body
+}
+
+func (c *testClient) do(method, path string, in any) (int, string) {
+	var body io.Reader
+	if in != nil {
+		b, _ := json.Marshal(in)
+		body = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, c.base+path, body)
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("X-CSRF-Token", c.csrf)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Error(err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestParallelNodeMutations(t *testing.T) {
+	srv, c := newTestServer(t)
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				code, body := c.do("POST", "/api/nodes", map[string]string{"name": fmt.Sprintf("n-%d-%d", w, i)})
+				if code != 200 {
+					t.Errorf("create: %d %s", code, body)
+					return
+				}
+				var out struct{ ID string }
+				_ = json.Unmarshal([]byte(body), &out)
+
+				if code, _ := c.do("POST", "/api/nodes", map[string]string{"name": "fail-" + out.ID}); code != 500 {
+					t.Errorf("failing create: want 500, got %d", code)
+				}
+				c.do("POST", "/api/nodes/"+out.ID+"/disable", nil)
+				c.do("POST", "/api/nodes/"+out.ID+"/reset", nil)
+				c.get("/api/nodes")
+				c.get("/api/nodes/" + out.ID + "/uri")
+				c.do("POST", "/api/settings", map[string]any{"listenPort": 10000 + w, "sni": "example.com"})
+				if i%2 == 1 {
+					if code, _ := c.do("DELETE", "/api/nodes/"+out.ID, nil); code != 200 {
+						t.Errorf("delete: %d", code)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	st := srv.Svc.State()
+	ids := map[string]bool{}
+	for _, n := range st.Nodes {
+		if strings.HasPrefix(n.Name, "fail") {
+			t.Fatalf("rolled back node leaked into state: %+v", n)
+		}
+		if ids[n.ID] {
+			t.Fatalf("duplicate node %s", n.ID)
+		}
+		ids[n.ID] = true
+		if n.Enabled {
+			t.Fatalf("node %s should be disabled", n.ID)
+		}
+	}
+	// 5 creates per worker, 2 of them deleted again.
+	if want := workers * 3; len(st.Nodes) != want {
+		t.Fatalf("nodes = %d, want %d", len(st.Nodes), want)
+	}
+
+	saved, err := st.Store().Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Nodes) != len(st.Nodes) {
+		t.Fatalf("saved nodes = %d, in memory %d", len(saved.Nodes), len(st.Nodes))
+	}
+}
+
+func TestUnknownNodeIs404(t *testing.T) {
+	_, c := newTestServer(t)
+	if code, _ := c.do("POST", "/api/nodes/nope/disable", nil); code != 404 {
+		t.Fatalf("want 404, got %d", code)
+	}
+}
+
+func TestSubscriptionFormats(t *testing.T) {
+	srv, c := newTestServer(t)
+	if _, err := srv.Svc.NodeAdd("phone", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	_, path, err := srv.Svc.SubscriptionRotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ query, ua, want string }{
+		{"", "", "hysteria2://"},
+		{"?format=clash", "", "type: hysteria2"},
+		{"", "clash.meta/1.18", "type: hysteria2"},
+		{"?format=uri", "mihomo/1.18", "hysteria2://"},
+		{"?format=singbox", "", `"type": "hysteria2"`},
+		{"", "sing-box 1.10", `"server_port"`},
+		{"?format=hysteria", "", "socks5:"},
+		{"?format=clsah", "clash.meta/1.18", `unknown format "clsah"; supported: uri, base64, clash, singbox, hysteria`},
+	} {
+		req, _ := http.NewRequest("GET", c.base+path+tc.query, nil)
+		req.Header.Set("User-Agent", tc.ua)
+		resp, err := c.http.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(b), tc.want) {
+			t.Errorf("%s ua=%q: want %q in %s", tc.query, tc.ua, tc.want, b)
+		}
+	}
+}
+
+func TestSubscriptionHeaders(t *testing.T) {
+	srv, c := newTestServer(t)
+	n, err := srv.Svc.NodeAdd("我的手机", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Svc.NodeSetLimits(n.ID, 100<<30, "2030-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	_, path, err := srv.Svc.ScopedSubscriptionRotate(n.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.http.Get(c.base + path + "?format=base64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, want := resp.Header.Get("Subscription-Userinfo"), "upload=0; download=0; total=107374182400; expire=1893456000"; got != want {
+		t.Errorf("Subscription-Userinfo = %q, want %q", got, want)
+	}
+	if resp.Header.Get("Profile-Update-Interval") == "" {
+		t.Error("no Profile-Update-Interval")
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] != "我的手机.txt" {
+		t.Errorf("Content-Disposition = %q (%v)", resp.Header.Get("Content-Disposition"), err)
+	}
+	dec, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil || !strings.HasPrefix(string(dec), "hysteria2://") {
+		t.Errorf("base64 body = %q (%v)", b, err)
+	}
+}
+
+func TestSubscriptionAutoRevoke(t *testing.T) {
+	srv, c := newTestServer(t)
+	if _, err := srv.Svc.NodeAdd("phone", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := c.do("POST", "/api/settings", map[string]any{"listenPort": 443, "subRevokeSubnets": 2}); code != 200 {
+		t.Fatalf("settings: %d %s", code, body)
+	}
+	_, path, err := srv.Svc.SubscriptionRotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := c.do("GET", path, nil); code != 200 {
+		t.Fatalf("first fetch: %d", code)
+	}
+	srv.Access.Record(subaccess.Fetch{TokenID: subaccess.GlobalID, IP: "198.51.100.1"})
+	srv.Access.Record(subaccess.Fetch{TokenID: subaccess.GlobalID, IP: "203.0.113.7"})
+	if code, _ := c.do("GET", path, nil); code != 404 {
+		t.Fatalf("fetch from a third network: want 404, got %d", code)
+	}
+	if srv.Svc.State().Subscription.RevokedAt == "" {
+		t.Fatal("token not revoked")
+	}
+	if a := srv.Access.Stats()[subaccess.GlobalID]; a.Fetches != 4 || a.DistinctIPs != 3 {
+		t.Fatalf("stats = %+v", a)
+	}
+	entries, _, _ := audit.Read(audit.Query{Action: "subscription.revoke"})
+	if len(entries) != 1 || entries[0].User != "system" || entries[0].Object != subaccess.GlobalID || !strings.Contains(entries[0].Detail, "3 networks") {
+		t.Fatalf("audit entries = %+v", entries)
+	}
+}
+
+func TestSubscriptionRateLimit(t *testing.T) {
+	_, c := newTestServer(t)
+	limited := false
+	for i := 0; i < 20 && !limited; i++ {
+		code, _ := c.do("GET", "/sub/unknown-token", nil)
+		limited = code == http.StatusTooManyRequests
+	}
+	if !limited {
+		t.Fatal("no 429 after 20 rapid fetches")
+	}
+}
+
+func TestSeparateSubscriptionListener(t *testing.T) {
+	srv, _ := newTestServer(t)
+	if _, err := srv.Svc.NodeAdd("phone", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	err := srv.Svc.UpdateNoApply("settings.set", "", func(st *state.State) error {
+		st.Settings.SubscriptionListen = "0.0.0.0:8443"
+		st.Settings.SubscriptionPathPrefix = "/s3cret"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, path, err := srv.Svc.SubscriptionRotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(path, "/s3cret/sub/") {
+		t.Fatalf("path = %s", path)
+	}
+	get := func(h http.Handler, path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	sub, admin := srv.SubscriptionRouter(), srv.Router()
+	if code := get(sub, path); code != 200 {
+		t.Fatalf("subscription listener: %d", code)
+	}
+	if code := get(sub, strings.TrimPrefix(path, "/s3cret")); code != 404 {
+		t.Fatalf("path without prefix: want 404, got %d", code)
+	}
+	if code := get(sub, "/login"); code != 404 {
+		t.Fatalf("admin page on subscription listener: want 404, got %d", code)
+	}
+	if code := get(admin, path); code != 404 {
+		t.Fatalf("subscription on admin listener: want 404, got %d", code)
+	}
+
+	// A prefix changed after the routers were built applies right away.
+	err = srv.Svc.UpdateNoApply("settings.set", "", func(st *state.State) error {
+		st.Settings.SubscriptionPathPrefix = "/n3w"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := "/n3w" + strings.TrimPrefix(path, "/s3cret")
+	if code := get(sub, moved); code != 200 {
+		t.Fatalf("new prefix: %d", code)
+	}
+	if code := get(sub, path); code != 404 {
+		t.Fatalf("old prefix: want 404, got %d", code)
+	}
+}
+
+func TestSharePage(t *testing.T) {
+	srv, c := newTestServer(t)
+	n, err := srv.Svc.NodeAdd("<b>phone</b>", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := srv.Svc.ScopedSubscriptionRotate(n.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.http.Get(c.base + "/share/" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	page := string(b)
+	if resp.StatusCode != 200 || resp.Header.Get("Referrer-Policy") != "no-referrer" {
+		t.Fatalf("%d %v", resp.StatusCode, resp.Header)
+	}
+	for _, want := range []string{"<svg", "hysteria2://", "clash://install-config?url=", "/sub/" + token + "?format=hysteria", "&lt;b&gt;phone&lt;/b&gt;"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("share page lacks %q", want)
+		}
+	}
+	if strings.Contains(page, "<b>phone") {
+		t.Error("node name not escaped")
+	}
+	if code, _ := c.do("GET", "/share/not-a-token", nil); code != 404 {
+		t.Errorf("unknown token: want 404, got %d", code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv, c := newTestServer(t)
+	if _, err := srv.Svc.NodeAdd("phone", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	body := c.get("/metrics")
+	for _, want := range []string{
+		"# TYPE hy2mgr_nodes gauge\n",
+		`hy2mgr_nodes{status="enabled"} 1`,
+		`hy2mgr_apply_total{result="success"}`,
+		"# TYPE hy2mgr_apply_duration_seconds histogram\n",
+		"hy2mgr_login_failures_total",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics lacks %q:\n%s", want, body)
+		}
+	}
+
+	get := func(h http.Handler, token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := get(srv.Router(), ""); code != 401 {
+		t.Fatalf("anonymous scrape: want 401, got %d", code)
+	}
+	if code := get(srv.MetricsRouter(), ""); code != 200 {
+		t.Fatalf("separate listener without token: want 200, got %d", code)
+	}
+	token, err := srv.Svc.MetricsTokenRotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []http.Handler{srv.Router(), srv.MetricsRouter()} {
+		if code := get(h, "wrong"); code != 401 {
+			t.Fatalf("wrong token: want 401, got %d", code)
+		}
+		if code := get(h, token); code != 200 {
+			t.Fatalf("valid token: want 200, got %d", code)
+		}
+	}
+}
+
+// fakeJournal replays canned "journalctl -o json" output; follow
+// invocations get followOut.
+type fakeJournal struct{ out, followOut string }
+
+func (f fakeJournal) Open(ctx context.Context, args []string) (io.ReadCloser, error) {
+	if args[len(args)-1] == "-f" {
+		return io.NopCloser(strings.NewReader(f.followOut)), nil
+	}
+	return io.NopCloser(strings.NewReader(f.out)), nil
+}
+
+func journalLine(sec int64, msg string) string {
+	return fmt.Sprintf(`{"__CURSOR":"c%d","__REALTIME_TIMESTAMP":"%d","PRIORITY":"6","MESSAGE":%q}`+"\n", sec, sec*1e6, msg)
+}
+
+func TestLogs(t *testing.T) {
+	srv, c := newTestServer(t)
+	srv.Journal = fakeJournal{
+		out:       journalLine(1, "2024-06-01T00:00:00Z\tINFO\tserver up") + journalLine(2, "2024-06-01T00:00:01Z\tERROR\tauth failed"),
+		followOut: journalLine(3, "2024-06-01T00:00:02Z\tERROR\tudp error"),
+	}
+	var entries []systemd.Entry
+	if err := json.Unmarshal([]byte(c.get("/api/logs?level=err")), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Level != "err" || !strings.Contains(entries[0].Message, "auth failed") {
+		t.Fatalf("entries = %+v", entries)
+	}
+	if code, _ := c.do("GET", "/api/logs?level=loud", nil); code != 400 {
+		t.Fatalf("bad level: want 400, got %d", code)
+	}
+
+	code, body := c.do("GET", "/api/logs/stream?q=error", nil)
+	if code != 200 {
+		t.Fatalf("stream: %d %s", code, body)
+	}
+	var msgs []string
+	for _, l := range strings.Split(body, "\n") {
+		if data, ok := strings.CutPrefix(l, "data: "); ok {
+			var e systemd.Entry
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, e.Message)
+		}
+	}
+	if len(msgs) != 2 || !strings.Contains(msgs[0], "auth failed") || !strings.Contains(msgs[1], "udp error") {
+		t.Fatalf("streamed %q", msgs)
+	}
+}
+
+func TestAuditAPI(t *testing.T) {
+	_, c := newTestServer(t)
+	for _, name := range []string{"a", "b", "c"} {
+		if code, body := c.do("POST", "/api/nodes", map[string]string{"name": name}); code != 200 {
+			t.Fatalf("add node: %d %s", code, body)
+		}
+	}
+	var page struct {
+		Total   int           `json:"total"`
+		Entries []audit.Entry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(c.get("/api/audit?action=node&limit=2&offset=1")), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Entries) != 2 || page.Entries[0].Action != "node.add" || page.Entries[0].Hash == "" ||
+		page.Entries[0].Source != "web" || page.Entries[0].User != "admin" || page.Entries[0].Result != "ok" {
+		t.Fatalf("page = %+v", page)
+	}
+	if code, _ := c.do("GET", "/api/audit?since=someday", nil); code != 400 {
+		t.Fatalf("bad since: want 400, got %d", code)
+	}
+	if r, err := audit.Verify(); err != nil || len(r.Problems) > 0 || r.Entries != 4 {
+		t.Fatalf("verify: %+v, %v", r, err)
+	}
+}
+
+func TestBackupDownload(t *testing.T) {
+	_, c := newTestServer(t)
+	oldSources := backup.Sources
+	t.Cleanup(func() { backup.Sources = oldSources })
+	backup.Sources = nil
+	if code, body := c.do("POST", "/api/nodes", map[string]string{"name": "phone"}); code != 200 {
+		t.Fatalf("add node: %d %s", code, body)
+	}
+	code, body := c.do("POST", "/api/backup", map[string]string{"passphrase": "correct horse"})
+	if code != 200 {
+		t.Fatalf("backup: %d %s", code, body)
+	}
+	a, err := backup.Open([]byte(body), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := a.Check()
+	if err != nil || len(st.Nodes) != 1 || st.Nodes[0].Name != "phone" {
+		t.Fatalf("restored state: %+v, %v", st, err)
+	}
+	entries, _, _ := audit.Read(audit.Query{Action: "backup.download"})
+	if len(entries) != 1 || entries[0].Source != "web" || !strings.HasSuffix(entries[0].Object, ".tar.gz.enc") {
+		t.Fatalf("audit = %+v", entries)
+	}
+}
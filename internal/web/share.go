@@ -0,0 +1,90 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/yuzeguitarist/hy2mgr/internal/clientcfg"
+	"github.com/yuzeguitarist/hy2mgr/internal/qr"
+	"github.com/yuzeguitarist/hy2mgr/internal/service"
+	"github.com/yuzeguitarist/hy2mgr/internal/state"
+	"github.com/gorilla/mux"
+)
+
+var shareTmpl = template.Must(template.ParseFS(FS, "templates/share.html"))
+
+type shareNode struct {
+	Name string
+	URI  string
+	Open template.URL // the URI as a link; html/template rejects unknown schemes
+	QR   template.HTML
+}
+
+type sharePage struct {
+	Title        string
+	Nodes        []shareNode
+	SubURL       string
+	ClashURL     string
+	SingBoxURL   string
+	HysteriaURL  string // only for single-node links
+	ClashImport  template.URL
+	RocketImport template.URL
+}
+
+// share renders a customer-facing page for a subscription token: QR code
+// and URI per node, config downloads and app import links.
+func (s *Server) share(w http.ResponseWriter, r *http.Request) {
+	st, sub, ok := s.resolveToken(w, r, "share")
+	if !ok {
+		return
+	}
+	nodes := service.SubscriptionNodes(st, sub)
+	p := sharePage{Title: subscriptionName(sub, nodes)}
+	for _, ep := range service.NodeEndpoints(st, nodes) {
+		uri := clientcfg.URI(ep)
+		svg, err := qr.SVG(uri, 4)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		p.Nodes = append(p.Nodes, shareNode{Name: ep.Name, URI: uri, Open: template.URL(uri), QR: template.HTML(svg)})
+	}
+
+	p.SubURL = publicOrigin(r, st) + service.SubscriptionPath(st, mux.Vars(r)["token"])
+	p.ClashURL = p.SubURL + "?format=clash"
+	p.SingBoxURL = p.SubURL + "?format=singbox"
+	if len(p.Nodes) == 1 {
+		p.HysteriaURL = p.SubURL + "?format=hysteria"
+	}
+	p.ClashImport = template.URL("clash://install-config?url=" + url.QueryEscape(p.ClashURL) + "&name=" + url.QueryEscape(p.Title))
+	p.RocketImport = template.URL("sub://" + base64.URLEncoding.EncodeToString([]byte(p.SubURL)) + "#" + url.PathEscape(p.Title))
+
+	var buf bytes.Buffer
+	if err := shareTmpl.Execute(&buf, p); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// The token is in the URL: keep it out of caches, referrers and indexes.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// publicOrigin is the scheme://host customers reach this server at.
+func publicOrigin(r *http.Request, st *state.State) string {
+	if u := st.Settings.PublicBaseURL; u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -28,6 +28,7 @@ function nav(){
     el('a',{href:'#dashboard'},['Dashboard']),
     el('a',{href:'#nodes'},['Nodes']),
     el('a',{href:'#logs'},['Logs']),
+    el('a',{href:'#audit'},['Audit']),
     el('a',{href:'#settings'},['Settings']),
     el('a',{href:'/logout'},['Logout']),
   ]);
@@ -63,10 +64,14 @@ async function renderNodes(root){
   const body = el('div',{},[]);
   const actions = el('div',{class:'row'},[
     el('button',{class:'btn primary',id:'addNode'},['+ Add node']),
-    el('a',{class:'btn',href:sub.url, target:'_blank'},['Open subscription URL']),
+    el('a',{class:'btn',href:(sub.base||'')+sub.url, target:'_blank'},['Open subscription URL']),
     el('button',{class:'btn',id:'rotateToken'},['Rotate subscription token']),
   ]);
   body.appendChild(actions);
+  (sub.tokens||[]).filter(tk=>!tk.scope.startsWith('node ')).forEach(tk=>{
+    const a = tk.access;
+    body.appendChild(el('div',{class:'small'},['Link for '+tk.scope+': '+(a.fetches?('last fetched '+a.lastFetch+' from '+a.lastIp+' ('+a.distinctIps+' IPs, '+a.fetches+' fetches)'):'never fetched')]));
+  });
 
   const t = el('table',{},[]);
   t.appendChild(el('tr',{},[
@@ -78,7 +83,8 @@ async function renderNodes(root){
     const row = el('tr',{},[]);
     row.appendChild(el('td',{},[
       el('div',{},[n.name]),
-      el('div',{class:'small'},['ID: '+n.id+'  User: '+n.username]),
+      el('div',{class:'small'},['ID: '+n.id+'  User: '+n.username+(n.tags&&n.tags.length?'  Tags: '+n.tags.join(','):'')]),
+      n.access?el('div',{class:'small'},['Link last fetched '+n.access.lastFetch+' from '+n.access.lastIp+' ('+n.access.distinctIps+' IPs, '+n.access.fetches+' fetches)']):'',
     ]));
     row.appendChild(el('td',{},[n.enabled?'✅':'⛔']));
     const act = el('td',{},[]);
@@ -101,13 +107,30 @@ async function renderNodes(root){
       const r = await api('/api/nodes/'+n.id+'/reset', {method:'POST'});
       alert('New password generated. Copy new URI now.');
     };
+    const btnSub = el('button',{class:'btn'},[n.subscription?'Rotate link':'Create link']);
+    btnSub.onclick=async()=>{
+      if(n.subscription && !confirm('Rotate this node\'s subscription link? Only this node\'s old link stops working.')) return;
+      const r = await api('/api/nodes/'+n.id+'/subscription/rotate', {method:'POST'});
+      prompt('Share page for '+n.name+' (shown once; QR, URI and subscription URL are on the page):', (r.base||location.origin)+r.share);
+      route();
+    };
+    const actions = [btnCopy, btnQR, btnSub];
+    if(n.subscription){
+      const btnRevoke = el('button',{class:'btn'},['Revoke link']);
+      btnRevoke.onclick=async()=>{
+        if(!confirm('Revoke this node\'s subscription link?')) return;
+        await api('/api/nodes/'+n.id+'/subscription', {method:'DELETE'});
+        route();
+      };
+      actions.push(btnRevoke);
+    }
     const btnDel = el('button',{class:'btn danger'},['Delete']);
     btnDel.onclick=async()=>{
       if(!confirm('Delete node?')) return;
       await api('/api/nodes/'+n.id, {method:'DELETE'});
       route();
     };
-    act.appendChild(el('div',{class:'row'},[btnCopy, btnQR, btnDis, btnReset, btnDel]));
+    act.appendChild(el('div',{class:'row'},[...actions, btnDis, btnReset, btnDel]));
     row.appendChild(act);
     t.appendChild(row);
   });
@@ -158,9 +181,105 @@ async function renderNodes(root){
   root.appendChild(card('Nodes', body));
 }
 
+let logStream = null;
+
+function logLine(e){
+  const t = new Date(e.time).toLocaleString();
+  return el('div',{class:'log log-'+e.level},[t+'  '+e.level.padEnd(7)+' '+e.message]);
+}
+
 async function renderLogs(root){
-  const t = await api('/api/logs?lines=200');
-  root.appendChild(card('Logs (journalctl -u hysteria-server.service)', el('pre',{},[t])));
+  const level = el('select',{id:'level'},
+    ['','err','warning','notice','info','debug'].map(l=>el('option',{value:l},[l||'all levels'])));
+  const form = el('div',{class:'row'},[
+    level,
+    el('input',{id:'since',placeholder:'since (1h, 2024-06-01 08:00)'}),
+    el('input',{id:'until',placeholder:'until'}),
+    el('input',{id:'q',placeholder:'text'}),
+    el('button',{class:'btn primary',id:'search'},['Search']),
+    el('button',{class:'btn',id:'follow'},['Live tail']),
+  ]);
+  const out = el('pre',{},[]);
+  const params = ()=>{
+    const p = new URLSearchParams({lines:'200'});
+    ['level','since','until','q'].forEach(k=>{
+      const v = form.querySelector('#'+k).value.trim();
+      if(v) p.set(k,v);
+    });
+    return p;
+  };
+  const stop = ()=>{ if(logStream){ logStream.close(); logStream=null; } form.querySelector('#follow').textContent='Live tail'; };
+  const search = async()=>{
+    stop();
+    const r = await fetch('/api/logs?'+params(), {credentials:'same-origin'});
+    if(r.status===401){ location.href='/login'; return; }
+    if(!r.ok){ out.replaceChildren(await r.text()); return; }
+    const entries = await r.json();
+    out.replaceChildren(...(entries.length ? entries.map(logLine) : ['(no entries)']));
+  };
+  form.querySelector('#search').onclick = search;
+  form.querySelector('#follow').onclick = ()=>{
+    if(logStream){ stop(); return; }
+    const p = params(); p.delete('until');
+    out.replaceChildren();
+    logStream = new EventSource('/api/logs/stream?'+p);
+    logStream.onmessage = ev=>{
+      const atBottom = out.scrollTop + out.clientHeight >= out.scrollHeight - 4;
+      out.appendChild(logLine(JSON.parse(ev.data)));
+      while(out.childNodes.length > 2000) out.removeChild(out.firstChild);
+      if(atBottom) out.scrollTop = out.scrollHeight;
+    };
+    logStream.addEventListener('error', ev=>{ if(ev.data) out.appendChild(el('div',{class:'log log-err'},['stream: '+ev.data])); });
+    form.querySelector('#follow').textContent='Stop';
+  };
+  root.appendChild(card('Logs (journalctl -u hysteria-server.service)', el('div',{},[form, out])));
+  await search();
+}
+
+async function renderAudit(root){
+  const form = el('div',{class:'row'},[
+    el('input',{id:'action',placeholder:'action (node, login, ...)'}),
+    el('input',{id:'user',placeholder:'user'}),
+    el('input',{id:'since',placeholder:'since (24h, 2024-06-01)'}),
+    el('input',{id:'until',placeholder:'until'}),
+    el('button',{class:'btn primary',id:'search'},['Search']),
+  ]);
+  const table = el('table',{},[]);
+  const pager = el('div',{class:'row'},[]);
+  const limit = 50;
+  const load = async(offset)=>{
+    const p = new URLSearchParams({offset:String(offset), limit:String(limit)});
+    ['action','user','since','until'].forEach(k=>{
+      const v = form.querySelector('#'+k).value.trim();
+      if(v) p.set(k,v);
+    });
+    const r = await fetch('/api/audit?'+p, {credentials:'same-origin'});
+    if(r.status===401){ location.href='/login'; return; }
+    if(!r.ok){ table.replaceChildren(el('tr',{},[el('td',{},[await r.text()])])); pager.replaceChildren(); return; }
+    const d = await r.json();
+    const detail = e=>{
+      const lines = [];
+      if(e.detail) lines.push(e.detail);
+      if(e.result==='error') lines.push('failed: '+e.error);
+      (e.changes||[]).forEach(c=>lines.push(c.path+': '+(c.old||'(none)')+' → '+(c.new||'(none)')));
+      return el('td',{},lines.map(l=>el('div',l.startsWith('failed: ')?{class:'audit-fail'}:{},[l])));
+    };
+    table.replaceChildren(
+      el('tr',{},['Time','User','Source','IP','Action','Object','Detail'].map(h=>el('th',{},[h]))),
+      ...d.entries.map(e=>el('tr',{},[...[e.time,e.user,e.source||'',e.ip,e.action,e.object||''].map(v=>el('td',{},[v])), detail(e)])),
+    );
+    const prev = el('button',{class:'btn'},['Newer']);
+    const next = el('button',{class:'btn'},['Older']);
+    prev.disabled = offset===0;
+    next.disabled = offset+limit >= d.total;
+    prev.onclick = ()=>load(Math.max(0, offset-limit));
+    next.onclick = ()=>load(offset+limit);
+    const last = Math.min(offset+limit, d.total);
+    pager.replaceChildren(prev, next, el('span',{class:'small'},[d.total ? (offset+1)+'–'+last+' of '+d.total : 'no entries']));
+  };
+  form.querySelector('#search').onclick = ()=>load(0);
+  root.appendChild(card('Audit log', el('div',{},[form, table, pager])));
+  await load(0);
 }
 
 async function renderSettings(root){
@@ -187,6 +306,16 @@ async function renderSettings(root){
         el('input',{id:'rewrite', type:'checkbox'}),
       ]),
     ]),
+    el('div',{class:'row'},[
+      el('div',{},[
+        el('label',{},['Auto-revoke links fetched from more than N networks (0 = off)']),
+        el('input',{id:'revokeSubnets',value:s.subRevokeSubnets||0, inputmode:'numeric'}),
+      ]),
+      el('div',{},[
+        el('label',{},['Within hours']),
+        el('input',{id:'revokeHours',value:s.subRevokeWindowHours||24, inputmode:'numeric'}),
+      ]),
+    ]),
     el('div',{class:'row'},[
       el('button',{class:'btn primary',id:'save'},['Save & Apply']),
       el('button',{class:'btn',id:'rotateCert'},['Rotate cert']),
@@ -202,6 +331,8 @@ async function renderSettings(root){
       masqueradeUrl: form.querySelector('#masq').value.trim(),
       masqueradeRewrite: form.querySelector('#rewrite').checked,
       listenPort: parseInt(form.querySelector('#port').value,10),
+      subRevokeSubnets: parseInt(form.querySelector('#revokeSubnets').value,10)||0,
+      subRevokeWindowHours: parseInt(form.querySelector('#revokeHours').value,10)||24,
     };
     const r = await api('/api/settings', {method:'POST', headers:{'content-type':'application/json'}, body: JSON.stringify(payload)});
     alert('Saved.');
@@ -224,9 +355,43 @@ async function renderSettings(root){
 
   body.appendChild(form);
   root.appendChild(card('Settings', body));
+  root.appendChild(card('Backup', backupForm()));
+}
+
+function backupForm(){
+  const form = el('div',{},[
+    el('div',{class:'row'},[
+      el('div',{},[
+        el('label',{},['Passphrase (optional, encrypts the archive)']),
+        el('input',{id:'backupPass', type:'password', autocomplete:'new-password'}),
+      ]),
+    ]),
+    el('div',{class:'row'},[
+      el('button',{class:'btn',id:'backup'},['Download backup']),
+    ]),
+    el('p',{class:'small'},['State, certificate, config and unit files. Without a passphrase the archive includes the state key in the clear; keep it safe. Restore with: hy2mgr backup restore <file>']),
+  ]);
+  form.querySelector('#backup').onclick=async()=>{
+    const headers = new Headers({'content-type':'application/json'});
+    const token = document.querySelector('meta[name="csrf-token"]')?.getAttribute('content');
+    if(token) headers.set('X-CSRF-Token', token);
+    const r = await fetch('/api/backup', {method:'POST', credentials:'same-origin', headers,
+      body: JSON.stringify({passphrase: form.querySelector('#backupPass').value})});
+    if(r.status===401){ location.href="/login"; return; }
+    if(!r.ok){ alert('Backup failed: '+await r.text()); return; }
+    const name = (r.headers.get('content-disposition')||'').match(/filename="([^"]+)"/)?.[1] || 'hy2mgr-backup.tar.gz';
+    const url = URL.createObjectURL(await r.blob());
+    const a = el('a',{href:url, download:name});
+    document.body.appendChild(a);
+    a.click();
+    a.remove();
+    URL.revokeObjectURL(url);
+  };
+  return form;
 }
 
 async function route(){
+  if(logStream){ logStream.close(); logStream=null; }
   const root = document.getElementById('app');
   root.innerHTML='';
   root.appendChild(nav());
@@ -236,6 +401,7 @@ async function route(){
   if(h==='dashboard') await renderDashboard(cont);
   else if(h==='nodes') await renderNodes(cont);
   else if(h==='logs') await renderLogs(cont);
+  else if(h==='audit') await renderAudit(cont);
   else if(h==='settings') await renderSettings(cont);
   else await renderDashboard(cont);
 }